@@ -45,6 +45,7 @@ import kotlinx.coroutines.flow.combine
 import kotlinx.coroutines.flow.distinctUntilChanged
 import kotlinx.coroutines.flow.first
 import kotlinx.coroutines.launch
+import kotlinx.serialization.decodeFromString
 import kotlinx.serialization.encodeToString
 import kotlinx.serialization.json.Json
 import libtailscale.Libtailscale
@@ -89,6 +90,8 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
 
   override fun getPlatformDNSConfig(): String = dns.dnsConfigAsString
 
+  override fun getPlatformDNSConfigJSON(): String = dns.dnsConfigAsJSON
+
   override fun getInstallSource(): String = AppSourceChecker.getInstallSource(this)
 
   override fun shouldUseGoogleDNSFallback(): Boolean = BuildConfig.USE_GOOGLE_DNS_FALLBACK
@@ -235,7 +238,23 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
   // library and writes it to a global encrypted preference store.
   @Throws(IOException::class, GeneralSecurityException::class)
   override fun encryptToPref(prefKey: String?, plaintext: String?) {
-    getEncryptedPrefs().edit().putString(prefKey, plaintext).commit()
+    if (!getEncryptedPrefs().edit().putString(prefKey, plaintext).commit()) {
+      throw IOException("failed to commit encrypted preference $prefKey")
+    }
+  }
+
+  // encryptToPrefBatch writes several preferences in a single commit, so either all of them are
+  // persisted or none are. batchJSON maps keys to values; an empty value removes the key.
+  @Throws(IOException::class, GeneralSecurityException::class)
+  override fun encryptToPrefBatch(batchJSON: String) {
+    val batch = Json.decodeFromString<Map<String, String>>(batchJSON)
+    val editor = getEncryptedPrefs().edit()
+    for ((key, value) in batch) {
+      if (value.isEmpty()) editor.remove(key) else editor.putString(key, value)
+    }
+    if (!editor.commit()) {
+      throw IOException("failed to commit ${batch.size} encrypted preferences")
+    }
   }
 
   // decryptFromPref decrypts a encrypted preference using the Jetpack Security
@@ -245,6 +264,13 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
     return getEncryptedPrefs().getString(prefKey, null)
   }
 
+  // getEncryptedPrefKeysJSON lists every key in the encrypted preference store as a JSON array,
+  // so the Go backend can migrate its state to another store.
+  @Throws(IOException::class, GeneralSecurityException::class)
+  override fun getEncryptedPrefKeysJSON(): String {
+    return Json.encodeToString(getEncryptedPrefs().all.keys.toList())
+  }
+
   @Throws(IOException::class, GeneralSecurityException::class)
   fun getEncryptedPrefs(): SharedPreferences {
     val key = MasterKey.Builder(this).setKeyScheme(MasterKey.KeyScheme.AES256_GCM).build()
@@ -325,6 +351,10 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
     return sb.toString()
   }
 
+  override fun getInterfacesJSON(): String {
+    return InterfaceSnapshot.toJSON(connectivityManager)
+  }
+
   @Throws(
       IOException::class, GeneralSecurityException::class, MDMSettings.NoSuchKeyException::class)
   override fun getSyspolicyBooleanValue(key: String): Boolean {
@@ -341,6 +371,19 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
     return setting.value?.toString() ?: ""
   }
 
+  // getSyspolicyIntegerValue returns a numeric policy. Anything that is not an integer throws
+  // NotAnIntegerException so the backend can report the mismatch.
+  @Throws(
+      IOException::class, GeneralSecurityException::class, MDMSettings.NoSuchKeyException::class)
+  override fun getSyspolicyIntegerValue(key: String): Long {
+    val setting = MDMSettings.allSettingsByKey[key]?.flow?.value
+    if (setting?.isSet != true) {
+      throw MDMSettings.NoSuchKeyException()
+    }
+    return (setting.value as? Number)?.toLong()
+        ?: throw MDMSettings.NotAnIntegerException(key, setting.value)
+  }
+
   @Throws(
       IOException::class, GeneralSecurityException::class, MDMSettings.NoSuchKeyException::class)
   override fun getSyspolicyStringArrayJSONValue(key: String): String {
@@ -357,6 +400,15 @@ class App : UninitializedApp(), libtailscale.AppContext, ViewModelStoreOwner {
     }
   }
 
+  // Only the built-in list and the user's choices are returned here; the MDM
+  // IncludedPackageNames/ExcludedPackageNames policies are read by the Go backend.
+  override fun getDisallowedPackageNamesJSON(): String {
+    return Json.encodeToString(
+        mapOf(
+            "BuiltIn" to builtInDisallowedPackageNames,
+            "User" to userDisallowedPackageNames()))
+  }
+
   fun notifyPolicyChanged() {
     app.notifyPolicyChanged()
   }
@@ -569,9 +621,13 @@ open class UninitializedApp : Application() {
       TSLog.d(TAG, "Excluded application packages were set via MDM: $mdmDisallowed")
       return builtInDisallowedPackageNames + mdmDisallowed
     }
-    val userDisallowed =
-        getUnencryptedPrefs().getStringSet(DISALLOWED_APPS_KEY, emptySet())?.toList() ?: emptyList()
-    return builtInDisallowedPackageNames + userDisallowed
+    return builtInDisallowedPackageNames + userDisallowedPackageNames()
+  }
+
+  /** Returns the packages the user excluded in the split tunneling settings. */
+  protected fun userDisallowedPackageNames(): List<String> {
+    return getUnencryptedPrefs().getStringSet(DISALLOWED_APPS_KEY, emptySet())?.toList()
+        ?: emptyList()
   }
 
   fun getAppScopedViewModel(): VpnViewModel {
@@ -17,6 +17,7 @@ package com.tailscale.ipn;
 
 public class DnsConfig {
     private String dnsConfigs;
+    private String dnsConfigJSON = "";
 
     // getDnsConfigAsString returns the current DNS configuration as a multiline string:
     // line[0] DNS server addresses separated by spaces
@@ -41,10 +42,20 @@ public class DnsConfig {
         }
     }
 
-    boolean updateDNSFromNetwork(String dnsConfigs) {
+    // getDnsConfigAsJSON returns the versioned JSON form of the DNS configuration, with the
+    // resolvers, interface and Private DNS setting of every non-VPN network. See
+    // libtailscale/platformdns.go for the schema. An empty string means it is not available.
+    String getDnsConfigAsJSON() {
         synchronized (this) {
-            if (!dnsConfigs.equals(this.dnsConfigs)) {
+            return this.dnsConfigJSON;
+        }
+    }
+
+    boolean updateDNSFromNetwork(String dnsConfigs, String dnsConfigJSON) {
+        synchronized (this) {
+            if (!dnsConfigs.equals(this.dnsConfigs) || !dnsConfigJSON.equals(this.dnsConfigJSON)) {
                 this.dnsConfigs = dnsConfigs;
+                this.dnsConfigJSON = dnsConfigJSON;
                 return true;
             } else {
                 return false;
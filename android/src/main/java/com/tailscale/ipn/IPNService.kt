@@ -4,7 +4,6 @@ package com.tailscale.ipn
 
 import android.app.PendingIntent
 import android.content.Intent
-import android.content.pm.PackageManager
 import android.net.VpnService
 import android.os.Build
 import android.system.OsConstants
@@ -141,14 +140,6 @@ open class IPNService : VpnService(), libtailscale.IPNService {
         PendingIntent.FLAG_UPDATE_CURRENT or PendingIntent.FLAG_IMMUTABLE)
   }
 
-  private fun disallowApp(b: Builder, name: String) {
-    try {
-      b.addDisallowedApplication(name)
-    } catch (e: PackageManager.NameNotFoundException) {
-      TSLog.d(TAG, "Failed to add disallowed application: $e")
-    }
-  }
-
   override fun newBuilder(): VPNServiceBuilder {
     val b: Builder =
         Builder()
@@ -160,25 +151,9 @@ open class IPNService : VpnService(), libtailscale.IPNService {
     }
     b.setUnderlyingNetworks(null) // Use all available networks.
 
-    val includedPackages: List<String> =
-        MDMSettings.includedPackages.flow.value.value?.split(",")?.map { it.trim() } ?: emptyList()
-    if (includedPackages.isNotEmpty()) {
-      // If an admin defined a list of packages that are exclusively allowed to be used via
-      // Tailscale,
-      // then only allow those apps.
-      for (packageName in includedPackages) {
-        TSLog.d(TAG, "Including app: $packageName")
-        b.addAllowedApplication(packageName)
-      }
-    } else {
-      // Otherwise, prevent certain apps from getting their traffic + DNS routed via Tailscale:
-      // - any app that the user manually disallowed in the GUI
-      // - any app that we disallowed via hard-coding
-      for (disallowedPackageName in UninitializedApp.get().disallowedPackageNames()) {
-        TSLog.d(TAG, "Disallowing app: $disallowedPackageName")
-        disallowApp(b, disallowedPackageName)
-      }
-    }
+    // Per-app routing (included/excluded packages from MDM or the user's split tunneling choices)
+    // is applied by the Go backend through VPNServiceBuilder.addAllowedApplication and
+    // addDisallowedApplication.
 
     return VPNServiceBuilder(b)
   }
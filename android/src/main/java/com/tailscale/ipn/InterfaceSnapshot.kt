@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+package com.tailscale.ipn
+
+import android.net.ConnectivityManager
+import android.net.NetworkCapabilities
+import com.tailscale.ipn.util.TSLog
+import java.net.InetAddress
+import java.net.NetworkInterface
+import kotlinx.serialization.Serializable
+import kotlinx.serialization.encodeToString
+import kotlinx.serialization.json.Json
+
+// InterfaceSnapshot builds the versioned JSON interface snapshot consumed by the Go backend
+// (libtailscale/ifsnapshot.go). Bump VERSION only for incompatible changes; new optional fields
+// can be added without it.
+object InterfaceSnapshot {
+  private const val TAG = "InterfaceSnapshot"
+  private const val VERSION = 1
+
+  @Serializable data class Addr(val Prefix: String, val Scope: String? = null)
+
+  @Serializable
+  data class Interface(
+      val Name: String,
+      val Index: Int,
+      val MTU: Int,
+      val Up: Boolean,
+      val Broadcast: Boolean,
+      val Loopback: Boolean,
+      val PointToPoint: Boolean,
+      val Multicast: Boolean,
+      val Type: String? = null,
+      val Metered: Boolean = false,
+      val LinkSpeedKbps: Long = 0,
+      val Roaming: Boolean = false,
+      val CaptivePortal: Boolean = false,
+      val Addrs: List<Addr> = emptyList(),
+  )
+
+  @Serializable data class Snapshot(val Version: Int, val Interfaces: List<Interface>)
+
+  private data class NetworkMeta(
+      val type: String,
+      val metered: Boolean,
+      val linkSpeedKbps: Long,
+      val roaming: Boolean,
+      val captivePortal: Boolean,
+  )
+
+  fun toJSON(connectivityManager: ConnectivityManager): String {
+    val meta = networkMetaByInterface(connectivityManager)
+    val interfaces =
+        java.util.Collections.list(NetworkInterface.getNetworkInterfaces()).mapNotNull { nif ->
+          try {
+            val m = meta[nif.name]
+            Interface(
+                Name = nif.name,
+                Index = nif.index,
+                MTU = nif.mtu,
+                Up = nif.isUp,
+                Broadcast = nif.supportsMulticast(),
+                Loopback = nif.isLoopback,
+                PointToPoint = nif.isPointToPoint,
+                Multicast = nif.supportsMulticast(),
+                Type = m?.type,
+                Metered = m?.metered ?: false,
+                LinkSpeedKbps = m?.linkSpeedKbps ?: 0,
+                Roaming = m?.roaming ?: false,
+                CaptivePortal = m?.captivePortal ?: false,
+                Addrs =
+                    nif.interfaceAddresses.mapNotNull { ia ->
+                      val host = ia.address.hostAddress?.substringBefore('%') ?: return@mapNotNull null
+                      Addr("$host/${ia.networkPrefixLength}", scopeOf(ia.address))
+                    })
+          } catch (e: Exception) {
+            TSLog.d(TAG, "skipping interface ${nif.name}: $e")
+            null
+          }
+        }
+    return Json.encodeToString(Snapshot(VERSION, interfaces))
+  }
+
+  private fun networkMetaByInterface(cm: ConnectivityManager): Map<String, NetworkMeta> {
+    val out = mutableMapOf<String, NetworkMeta>()
+    for (network in cm.allNetworks) {
+      val name = cm.getLinkProperties(network)?.interfaceName ?: continue
+      val caps = cm.getNetworkCapabilities(network) ?: continue
+      val type =
+          when {
+            caps.hasTransport(NetworkCapabilities.TRANSPORT_VPN) -> "vpn"
+            caps.hasTransport(NetworkCapabilities.TRANSPORT_WIFI) -> "wifi"
+            caps.hasTransport(NetworkCapabilities.TRANSPORT_CELLULAR) -> "cellular"
+            caps.hasTransport(NetworkCapabilities.TRANSPORT_ETHERNET) -> "ethernet"
+            else -> "other"
+          }
+      out[name] =
+          NetworkMeta(
+              type = type,
+              metered = !caps.hasCapability(NetworkCapabilities.NET_CAPABILITY_NOT_METERED),
+              linkSpeedKbps = caps.linkDownstreamBandwidthKbps.toLong(),
+              roaming = !caps.hasCapability(NetworkCapabilities.NET_CAPABILITY_NOT_ROAMING),
+              captivePortal = caps.hasCapability(NetworkCapabilities.NET_CAPABILITY_CAPTIVE_PORTAL))
+    }
+    return out
+  }
+
+  // Scopes the JVM can tell apart; anything else is left for the Go side to derive.
+  private fun scopeOf(addr: InetAddress): String? =
+      when {
+        addr.isLoopbackAddress -> "host"
+        addr.isLinkLocalAddress -> "link"
+        addr.isSiteLocalAddress -> "site"
+        else -> null
+      }
+}
@@ -7,10 +7,14 @@ import android.net.LinkProperties
 import android.net.Network
 import android.net.NetworkCapabilities
 import android.net.NetworkRequest
+import android.os.Build
 import android.util.Log
 import com.tailscale.ipn.util.TSLog
 import java.util.concurrent.locks.ReentrantLock
 import kotlin.concurrent.withLock
+import kotlinx.serialization.Serializable
+import kotlinx.serialization.encodeToString
+import kotlinx.serialization.json.Json
 import libtailscale.Libtailscale
 
 object NetworkChangeCallback {
@@ -23,6 +27,27 @@ object NetworkChangeCallback {
 
   private val activeNetworks = mutableMapOf<Network, NetworkInfo>() // keyed by Network
 
+  // Versioned platform DNS config consumed by libtailscale/platformdns.go.
+  private const val DNS_CONFIG_VERSION = 1
+
+  @Serializable private data class PrivateDNS(val Mode: String, val Hostname: String? = null)
+
+  @Serializable
+  private data class NetworkDNS(
+      val Interface: String,
+      val Type: String,
+      val Nameservers: List<String>,
+      val SearchDomains: List<String>,
+      val PrivateDNS: PrivateDNS,
+  )
+
+  @Serializable
+  private data class PlatformDNSConfig(
+      val Version: Int,
+      val Default: String?,
+      val Networks: List<NetworkDNS>
+  )
+
   // monitorDnsChanges sets up a network callback to monitor changes to the
   // system's network state and update the DNS configuration when interfaces
   // become available or properties of those interfaces change.
@@ -56,7 +81,18 @@ object NetworkChangeCallback {
 
           override fun onCapabilitiesChanged(network: Network, capabilities: NetworkCapabilities) {
             super.onCapabilitiesChanged(network, capabilities)
-            lock.withLock { activeNetworks[network]?.caps = capabilities }
+            lock.withLock {
+              val info = activeNetworks[network] ?: return@withLock
+              val changed = policyCapsChanged(info.caps, capabilities)
+              info.caps = capabilities
+              // Metered, roaming and captive portal changes keep the interface name, so
+              // onDNSConfigChanged never fires for them; tell Go so its network policy follows.
+              val iface = info.linkProps.interfaceName
+              if (changed && iface != null) {
+                TSLog.d(TAG, "onCapabilitiesChanged: network policy flags changed on ${iface}")
+                Libtailscale.onNetworkCapabilitiesChanged(iface)
+              }
+            }
           }
 
           override fun onLinkPropertiesChanged(network: Network, linkProperties: LinkProperties) {
@@ -79,6 +115,15 @@ object NetworkChangeCallback {
         })
   }
 
+  // policyCapsChanged reports whether any capability the Go network policy (metered, roaming,
+  // captive portal) depends on differs between old and new.
+  private fun policyCapsChanged(old: NetworkCapabilities, new: NetworkCapabilities): Boolean =
+      listOf(
+              NetworkCapabilities.NET_CAPABILITY_NOT_METERED,
+              NetworkCapabilities.NET_CAPABILITY_NOT_ROAMING,
+              NetworkCapabilities.NET_CAPABILITY_CAPTIVE_PORTAL)
+          .any { old.hasCapability(it) != new.hasCapability(it) }
+
   // pickNonMetered returns the first non-metered network in the list of
   // networks, or the first network if none are non-metered.
   private fun pickNonMetered(networks: Map<Network, NetworkInfo>): Network? {
@@ -158,11 +203,47 @@ object NetworkChangeCallback {
       sb.append("\n")
       sb.append(searchDomains)
     }
-    if (dns.updateDNSFromNetwork(sb.toString())) {
+    if (dns.updateDNSFromNetwork(sb.toString(), dnsConfigJSON(info.linkProps.interfaceName))) {
       TSLog.d(
           TAG,
           "${why}: updated DNS config for network ${defaultNetwork} (${info.linkProps.interfaceName})")
       Libtailscale.onDNSConfigChanged(info.linkProps.interfaceName)
     }
   }
+
+  // dnsConfigJSON describes the DNS settings of every active non-VPN network, with defaultIface
+  // as the network Tailscale takes its platform DNS from.
+  private fun dnsConfigJSON(defaultIface: String?): String {
+    val networks =
+        activeNetworks.values.mapNotNull { info ->
+          val iface = info.linkProps.interfaceName ?: return@mapNotNull null
+          if (!info.caps.hasCapability(NetworkCapabilities.NET_CAPABILITY_NOT_VPN)) {
+            return@mapNotNull null
+          }
+          NetworkDNS(
+              Interface = iface,
+              Type = transportType(info.caps),
+              Nameservers = info.linkProps.dnsServers.mapNotNull { it.hostAddress },
+              SearchDomains =
+                  info.linkProps.domains?.split(" ")?.filter { it.isNotBlank() } ?: emptyList(),
+              PrivateDNS = privateDNS(info.linkProps))
+        }
+    return Json.encodeToString(PlatformDNSConfig(DNS_CONFIG_VERSION, defaultIface, networks))
+  }
+
+  private fun transportType(caps: NetworkCapabilities): String =
+      when {
+        caps.hasTransport(NetworkCapabilities.TRANSPORT_WIFI) -> "wifi"
+        caps.hasTransport(NetworkCapabilities.TRANSPORT_CELLULAR) -> "cellular"
+        caps.hasTransport(NetworkCapabilities.TRANSPORT_ETHERNET) -> "ethernet"
+        else -> "other"
+      }
+
+  private fun privateDNS(linkProps: LinkProperties): PrivateDNS {
+    if (Build.VERSION.SDK_INT < Build.VERSION_CODES.P || !linkProps.isPrivateDnsActive) {
+      return PrivateDNS("off")
+    }
+    val hostname = linkProps.privateDnsServerName
+    return if (hostname != null) PrivateDNS("strict", hostname) else PrivateDNS("opportunistic")
+  }
 }
@@ -42,6 +42,14 @@ class VPNServiceBuilder(private val builder: VpnService.Builder) : libtailscale.
   override fun setMTU(p0: Int) {
     builder.setMtu(p0)
   }
+
+  override fun addAllowedApplication(p0: String) {
+    builder.addAllowedApplication(p0)
+  }
+
+  override fun addDisallowedApplication(p0: String) {
+    builder.addDisallowedApplication(p0)
+  }
 }
 
 class ParcelFileDescriptor(private val fd: android.os.ParcelFileDescriptor) : ParcelFileDescriptor {
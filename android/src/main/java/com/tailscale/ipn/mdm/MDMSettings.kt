@@ -18,6 +18,12 @@ object MDMSettings {
   // to the backend.
   class NoSuchKeyException : Exception("no such key")
 
+  // Thrown when a numeric policy is set to something that is not an integer. The
+  // message must start with the text of errPolicyNotNumber in syspolicy_handler.go;
+  // other exceptions are reported as read errors rather than type mismatches.
+  class NotAnIntegerException(key: String, value: Any?) :
+      Exception("policy value is not an integer: $key=\"$value\"")
+
   val forceEnabled = BooleanMDMSetting("ForceEnabled", "Force Enabled Connection Toggle")
 
   // Handled on the backed
@@ -97,6 +103,43 @@ object MDMSettings {
   // Overrides the value provided by os.Hostname() in Go
   val hostname = StringMDMSetting("Hostname", "Device Hostname")
 
+  // Handled on the backend. MTU for the Tailscale TUN interface, overriding the value derived from
+  // the underlying network.
+  val tunnelMTU = IntegerMDMSetting("TunnelMTU", "Tunnel MTU")
+
+  // Handled on the backend. When true, a blackhole tunnel is kept up while the VPN is failing or
+  // reconnecting so that traffic never leaks to the underlying network.
+  val vpnLockdown = BooleanMDMSetting("VPNLockdown", "Block traffic while VPN is unavailable")
+
+  // Handled on the backend. Comma-separated fallback DNS resolvers used when the current network
+  // provides none: built-in list names (google, cloudflare, quad9, none) or IP addresses, queried
+  // over plain DNS. DNS-over-HTTPS and DNS-over-TLS entries are not supported and are skipped.
+  val dnsFallbackResolvers = StringMDMSetting("DNSFallbackResolvers", "Fallback DNS resolvers")
+
+  // Handled on the backend. Unset means disabled. When true, Taildrop and proxy sharing are
+  // paused while the default network is cellular.
+  val cellularPauseSharing =
+      BooleanMDMSetting("CellularPauseSharing", "Pause sharing on cellular networks")
+
+  // Handled on the backend. Unset means disabled. When true, logs are uploaded less often while the
+  // default network is metered.
+  val meteredReduceLogging =
+      BooleanMDMSetting("MeteredReduceLogging", "Reduce log uploads on metered networks")
+
+  // Handled on the backend. Minutes between log uploads while the default network is metered and
+  // MeteredReduceLogging is enabled. Unset or 0 keeps the built-in interval.
+  val meteredLogFlushMinutes =
+      IntegerMDMSetting("MeteredLogFlushMinutes", "Log upload interval on metered networks")
+
+  // Handled on the backend. Unset means disabled. When true, the exit node advertisement is
+  // withdrawn while roaming and restored afterwards.
+  val roamingBlockExitNode =
+      BooleanMDMSetting("RoamingBlockExitNode", "Disallow running as an exit node while roaming")
+
+  // Handled on the backend. Unset means allowed. When false, the node state (including its keys)
+  // cannot be exported to or restored from a passphrase-encrypted backup.
+  val allowStateBackup = BooleanMDMSetting("AllowStateBackup", "Allow state backup and restore")
+
   val allSettings by lazy {
     MDMSettings::class
         .declaredMemberProperties
@@ -6,6 +6,7 @@ package com.tailscale.ipn.mdm
 import android.content.SharedPreferences
 import android.os.Bundle
 import com.tailscale.ipn.ui.util.set
+import com.tailscale.ipn.util.TSLog
 import kotlinx.coroutines.flow.MutableStateFlow
 
 data class SettingState<T>(val value: T, val isSet: Boolean)
@@ -38,6 +39,28 @@ class BooleanMDMSetting(key: String, localizedTitle: String) :
   override fun getFromPrefs(prefs: SharedPreferences) = prefs.getBoolean(key, false)
 }
 
+class IntegerMDMSetting(key: String, localizedTitle: String) :
+    MDMSetting<Long?>(null, key, localizedTitle) {
+  @Suppress("DEPRECATION")
+  override fun getFromBundle(bundle: Bundle) = toLong(bundle.get(key))
+
+  override fun getFromPrefs(prefs: SharedPreferences) = toLong(prefs.all[key])
+
+  // Some MDM consoles deliver numeric restrictions as strings. Values that are not integers are
+  // logged and treated as unset.
+  private fun toLong(v: Any?): Long? =
+      when (v) {
+        is Number -> v.toLong()
+        is String ->
+            v.trim().toLongOrNull()
+                ?: run {
+                  TSLog.w("MDM", "$key value \"$v\" is not an integer, ignoring")
+                  null
+                }
+        else -> null
+      }
+}
+
 class StringMDMSetting(key: String, localizedTitle: String) :
     MDMSetting<String?>(null, key, localizedTitle) {
   override fun getFromBundle(bundle: Bundle) = bundle.getString(key)
@@ -31,6 +31,32 @@ class Ipn {
     }
   }
 
+  // Lockdown (kill switch) state reported by the backend. While Active, a blackhole tunnel drops
+  // all traffic until the VPN recovers.
+  @Serializable data class LockdownStatus(val Active: Boolean = false, val Reason: String? = null)
+
+  // VPN session state reported by the backend: idle, establishing, up, revoked or error. Error
+  // carries the reason for the revoked and error states.
+  @Serializable data class VPNStatus(val State: String = "idle", val Error: String? = null)
+
+  // Type of the default network and the restrictions the backend applies because of it. Type is
+  // wifi, cellular, ethernet or other, and empty when offline or unknown.
+  @Serializable
+  data class NetworkStatus(
+      val Interface: String? = null,
+      val Type: String? = null,
+      val Metered: Boolean = false,
+      val Roaming: Boolean = false,
+      val CaptivePortal: Boolean = false,
+      val TaildropPaused: Boolean = false,
+      val ProxyPaused: Boolean = false,
+      val LogsReduced: Boolean = false,
+      val ExitNodeBlocked: Boolean = false,
+      // Set when the backend's own probe found a captive portal; the tunnel is held until it clears.
+      val PortalDetected: Boolean = false,
+      val TUNHeld: Boolean = false,
+  )
+
   // A notification message received on the Notify bus.  Fields will be populated based
   // on which NotifyWatchOpts were set when the Notifier was created.
   @Serializable
@@ -51,6 +77,12 @@ class Ipn {
       var ClientVersion: Tailcfg.ClientVersion? = null,
       var TailFSShares: List<String>? = null,
       var Health: Health.State? = null,
+      // Lockdown: 锁定模式状态，仅在状态变化时下发。
+      val Lockdown: LockdownStatus? = null,
+      // VPN: VPN 会话状态，仅在状态变化时下发。
+      val VPN: VPNStatus? = null,
+      // Network: 默认网络类型与相应限制，仅在变化时下发。
+      val Network: NetworkStatus? = null,
       // RegisterV2URL: 注册流程专用，若为注册流程，Go 层会自动生成 V2 注册 URL 并通过此字段下发。
       // 例如：https://headscale.ipv4.name/registerV2/xxxxxx
       val RegisterV2URL: String? = null,
@@ -49,6 +49,9 @@ import kotlinx.coroutines.flow.update
  * - loginFinished: 登录完成事件。
  * - version: 后端版本信息。
  * - health: 健康状态。
+ * - lockdown: 锁定模式状态。
+ * - vpnStatus: VPN 会话状态。
+ * - networkStatus: 默认网络类型与相应限制。
  * - outgoingFiles/incomingFiles/filesWaiting: Taildrop 文件传输相关状态。
  *
  * 典型调用链：
@@ -89,6 +92,12 @@ object Notifier {
   val version: StateFlow<String?> = MutableStateFlow(null)
   /** 健康状态，包含警告、错误等健康信息。 */
   val health: StateFlow<Health.State?> = MutableStateFlow(null)
+  /** 锁定模式状态，Active 时所有流量被黑洞 TUN 丢弃。 */
+  val lockdown: StateFlow<Ipn.LockdownStatus?> = MutableStateFlow(null)
+  /** VPN 会话状态（idle/establishing/up/revoked/error）。 */
+  val vpnStatus: StateFlow<Ipn.VPNStatus?> = MutableStateFlow(null)
+  /** 默认网络类型（蜂窝、计费、漫游等）与据此暂停的功能。 */
+  val networkStatus: StateFlow<Ipn.NetworkStatus?> = MutableStateFlow(null)
 
   /** 正在发送的文件列表（Taildrop 功能）。 */
   val outgoingFiles: StateFlow<List<Ipn.OutgoingFile>?> = MutableStateFlow(null)
@@ -245,6 +254,18 @@ object Notifier {
             TSLog.d(TAG, "[TEST-FLINK] Health 变化: $it")
             health.set(it)
           }
+          notify.Lockdown?.let {
+            TSLog.d(TAG, "[TEST-FLINK] Lockdown 变化: $it")
+            lockdown.set(it)
+          }
+          notify.VPN?.let {
+            TSLog.d(TAG, "[TEST-FLINK] VPN 会话状态变化: $it")
+            vpnStatus.set(it)
+          }
+          notify.Network?.let {
+            TSLog.d(TAG, "[TEST-FLINK] 网络状态变化: $it")
+            networkStatus.set(it)
+          }
         }
     }
   }
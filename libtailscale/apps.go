@@ -0,0 +1,125 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// apps.go 负责按应用分流：决定哪些应用的流量走 Tailscale，并通过 VpnService.Builder 下发。
+package libtailscale
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+
+	"tailscale.com/util/syspolicy"
+)
+
+const (
+	// includedPackagesPolicyKey 逗号分隔的包名列表，非空时只有这些应用走 Tailscale。
+	includedPackagesPolicyKey = "IncludedPackageNames"
+	// excludedPackagesPolicyKey 逗号分隔的包名列表，这些应用不走 Tailscale，覆盖用户设置。
+	excludedPackagesPolicyKey = "ExcludedPackageNames"
+)
+
+// appFilter 描述 TUN 的按应用分流规则。
+// allowed 非空时只有其中的应用走 Tailscale，此时忽略 disallowed（Android 不允许两者同时使用）。
+type appFilter struct {
+	allowed    []string
+	disallowed []string
+}
+
+// disallowedPackageNames 对应 AppContext.GetDisallowedPackageNamesJSON 返回的 JSON。
+type disallowedPackageNames struct {
+	BuiltIn []string // 内置的不兼容应用，始终排除
+	User    []string // 用户在分应用设置中排除的应用
+}
+
+// equal 报告两组规则是否相同。
+func (f appFilter) equal(o appFilter) bool {
+	return slices.Equal(f.allowed, o.allowed) && slices.Equal(f.disallowed, o.disallowed)
+}
+
+// currentAppFilter 计算当前的分流规则。
+// 优先级：IncludedPackageNames 策略 > ExcludedPackageNames 策略 > 用户设置；内置排除列表在排除模式下始终生效。
+func (b *backend) currentAppFilter() appFilter {
+	if included := b.packagePolicy(includedPackagesPolicyKey); len(included) > 0 {
+		return appFilter{allowed: included}
+	}
+
+	var names disallowedPackageNames
+	if s, err := b.appCtx.GetDisallowedPackageNamesJSON(); err != nil {
+		log.Printf("currentAppFilter: GetDisallowedPackageNamesJSON: %v", err)
+	} else if s != "" {
+		if err := json.Unmarshal([]byte(s), &names); err != nil {
+			log.Printf("currentAppFilter: decode disallowed packages: %v", err)
+		}
+	}
+	disallowed := names.User
+	if excluded := b.packagePolicy(excludedPackagesPolicyKey); len(excluded) > 0 {
+		disallowed = excluded
+	}
+	return appFilter{disallowed: dedupePackages(append(slices.Clone(names.BuiltIn), disallowed...))}
+}
+
+// packagePolicy 读取逗号分隔的包名策略，未配置时返回 nil。
+func (b *backend) packagePolicy(key string) []string {
+	if b.policy == nil {
+		return nil
+	}
+	s, err := b.policy.ReadString(key)
+	if err != nil {
+		if !errors.Is(err, syspolicy.ErrNoSuchKey) {
+			log.Printf("packagePolicy: read %s: %v", key, err)
+		}
+		return nil
+	}
+	return parsePackageList(s)
+}
+
+// parsePackageList 解析逗号分隔的包名列表，忽略空白项。
+func parsePackageList(s string) []string {
+	var pkgs []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			pkgs = append(pkgs, p)
+		}
+	}
+	return dedupePackages(pkgs)
+}
+
+// dedupePackages 去除重复包名并保持原有顺序。
+func dedupePackages(pkgs []string) []string {
+	var out []string
+	for _, p := range pkgs {
+		if !slices.Contains(out, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// applyAppFilter 将分流规则下发到 builder。
+// 单个应用未安装等错误只记录日志，不影响其他应用；
+// 允许模式下若一个应用都没有成功添加，返回错误，避免退化为所有应用都走 Tailscale。
+func applyAppFilter(builder VPNServiceBuilder, f appFilter) error {
+	if len(f.allowed) > 0 {
+		added := 0
+		for _, pkg := range f.allowed {
+			if err := builder.AddAllowedApplication(pkg); err != nil {
+				log.Printf("applyAppFilter: allow %s: %v", pkg, err)
+				continue
+			}
+			added++
+		}
+		if added == 0 {
+			return errors.New("none of the included applications could be added to the VPN")
+		}
+		return nil
+	}
+	for _, pkg := range f.disallowed {
+		if err := builder.AddDisallowedApplication(pkg); err != nil {
+			log.Printf("applyAppFilter: disallow %s: %v", pkg, err)
+		}
+	}
+	return nil
+}
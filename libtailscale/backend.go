@@ -9,14 +9,16 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
-	"reflect"
 	"runtime/debug"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"tailscale.com/drive/driveimpl"
+	"tailscale.com/envknob"
 	_ "tailscale.com/feature/condregister"
 	"tailscale.com/feature/taildrop"
 	"tailscale.com/hostinfo"
@@ -27,7 +29,6 @@ import (
 	"tailscale.com/logtail"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/netmon"
-	"tailscale.com/net/netns"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/paths"
 	"tailscale.com/tsd"
@@ -35,6 +36,7 @@ import (
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
 	"tailscale.com/util/eventbus"
+	"tailscale.com/util/set"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/netstack"
 	"tailscale.com/wgengine/router"
@@ -43,9 +45,12 @@ import (
 type App struct {
 	dataDir string
 
-	// passes along SAF file information for the taildrop manager
+	// passes along SAF file information for the taildrop manager.
+	// 由 backendMu 保护，变化时直接交给运行中的 Taildrop 扩展，见 applyFileOpsLocked。
 	directFileRoot  string
 	shareFileHelper ShareFileHelper
+	// fileOps 交给各个 LocalBackend 的 Taildrop 扩展的同一个 FileOps，shareFileHelper 变化时原地替换。
+	fileOps *AndroidFileOps
 
 	// appCtx is a global reference to the com.tailscale.ipn.App instance.
 	appCtx AppContext
@@ -57,17 +62,53 @@ type App struct {
 	localAPIHandler http.Handler
 	backend         *ipnlocal.LocalBackend
 	ready           sync.WaitGroup
-	backendMu       sync.Mutex
+	// backendReady 与 startReady 分别对应 ready 等待的两个事件，各自只生效一次，
+	// 避免后端重启后重复调用 ready.Done 导致计数变负。
+	backendReady func()
+	startReady   func()
+
+	// backendMu 保护 cur、runCancel、restore、watchers 以及 directFileRoot 与 shareFileHelper。
+	backendMu sync.Mutex
+	// cur 当前运行中的 backend，未运行时为 nil。
+	cur *backend
+	// runCancel 取消当前这一次 runBackendOnce。
+	runCancel context.CancelFunc
+	// restore ImportState 提交、等待写入的恢复状态，见 backup.go。
+	restore *pendingRestore
+	// watchers 所有未停止的 WatchNotifications 订阅，后端重启后需重新挂接。
+	watchers set.HandleSet[*notificationManager]
+
+	// vpn VPN 会话：IPNService、TUN fd 归属与会话状态，见 vpnsession.go。
+	vpn *vpnSession
+	// network 当前默认网络的类型与据此生效的限制，见 netpolicy.go。
+	network *networkState
+	// lockdown 锁定模式的黑洞 TUN 与状态，见 lockdown.go。
+	lockdown *lockdownState
+
+	// ctx 与 App 生命周期绑定，Shutdown 时取消。
+	ctx    context.Context
+	cancel context.CancelFunc
+	// runDone 在 runBackend 退出后关闭，runErr 为其返回的错误。
+	runDone      chan struct{}
+	runErr       error
+	shutdownOnce sync.Once
 
 	backendRestartCh chan struct{}
+
+	// crashes 后端崩溃历史，由 runBackend 写入，通过 LocalAPI 查询。
+	crashes *crashHistory
+
+	// events 接收 Java 侧回调（RequestVPN、SetDirectFileRoot 等）的 App 级分发器。
+	events *appEvents
 }
 
 // start 启动 Tailscale 应用，初始化日志、环境变量，并返回 Application 实例。
 // dataDir: 数据目录路径。
 // directFileRoot: SAF 文件根目录。
 // appCtx: Android App 上下文。
+// store: 状态存储后端，为 nil 时使用 dataDir 中记录的后端。
 // 返回 Application 实例。
-func start(dataDir, directFileRoot string, appCtx AppContext) Application {
+func start(dataDir, directFileRoot string, appCtx AppContext, store StateStore) Application {
 	defer func() {
 		if p := recover(); p != nil {
 			log.Printf("panic in Start %s: %s", p, debug.Stack())
@@ -93,7 +134,11 @@ func start(dataDir, directFileRoot string, appCtx AppContext) Application {
 	}
 
 	// 创建并返回 App 实例
-	return newApp(dataDir, directFileRoot, appCtx)
+	kind := ""
+	if store == nil {
+		store, kind = openDefaultStateStore(dataDir, appCtx)
+	}
+	return newApp(dataDir, directFileRoot, appCtx, store, kind)
 }
 
 type backend struct {
@@ -104,49 +149,132 @@ type backend struct {
 	settings   settingsFunc
 	lastCfg    *router.Config
 	lastDNSCfg *dns.OSConfig
-	netMon     *netmon.Monitor
+	// lastAppFilter 最近一次建立 TUN 时使用的按应用分流规则。
+	lastAppFilter appFilter
+	// lastPlatformDNS 最近一次建立 TUN 时追加的平台 DNS 服务器（仅 Split DNS 时非空）。
+	lastPlatformDNS []netip.Addr
+	// external 嵌入方提供的 TUN，非 nil 时不再通过 VpnService 建立 TUN，见 externaltun.go。
+	external *ExternalTUN
+	netMon   *netmon.Monitor
 
 	logIDPublic logid.PublicID
 	logger      *logtail.Logger
 
 	bus *eventbus.Bus
 
+	// events 所属 App 的事件分发器，用于读取 Android 侧日志。
+	events *appEvents
+
 	// avoidEmptyDNS controls whether to use fallback nameservers
 	// when no nameservers are provided by Tailscale.
 	avoidEmptyDNS bool
 
 	appCtx AppContext
+
+	// vpn 所属 App 的 VPN 会话，跨后端重启保留。
+	vpn *vpnSession
+	// network 所属 App 的网络状态，跨后端重启保留。
+	network *networkState
+	// lockdown 所属 App 的锁定模式状态，跨后端重启保留。
+	lockdown *lockdownState
+	// netChanges 串行、去抖地把网络变化交给 netmon，见 netchange.go。
+	netChanges *netChangeProcessor
+	// captive 默认网络变化后探测强制门户，见 captive.go。
+	captive *captiveProber
+	// heldRcfg、heldDcfg 因强制门户暂缓建立 TUN 的配置，门户解除后补建。
+	heldRcfg *router.Config
+	heldDcfg *dns.OSConfig
+	// snapshotInterfaces 获取接口快照，用于判断默认网络的类型。
+	snapshotInterfaces func() (*interfaceSnapshot, error)
+	// meteredFlushDelay 按流量计费的网络下的日志上传间隔，策略变化时由 updateNetworkStatus 更新，0 表示默认值。
+	meteredFlushDelay atomic.Int64
+
+	// policy 读取 Android 专有策略（如 TunnelMTU），syspolicy 包不认识这些键。
+	policy *syspolicyHandler
+	// store 所属 App 的状态存储，用于读取用户设置（如兜底 DNS）。
+	store *stateStore
+	// lastFallbackSpec 最近一次生效的兜底 DNS 配置，变化时重新计算 DNS 配置，见 maybeReapplyDNS。
+	lastFallbackSpec string
+	// getInterfaces 列出设备网络接口，用于推算 TUN MTU。
+	getInterfaces func() ([]netmon.Interface, error)
+
+	// startErr 接收 LocalBackend.Start 的失败原因，由 runBackendOnce 转为运行错误交给 supervisor。
+	startErr chan error
+
+	// done 在 shutdown 开始时关闭，通知 backend 的辅助协程退出。
+	done         chan struct{}
+	shutdownOnce sync.Once
 }
 
 type settingsFunc func(*router.Config, *dns.OSConfig) error
 
-// runBackend 持续运行后端主循环，监听重启信号并重启后端。
-// ctx: 上下文，用于取消操作。
-// 返回错误信息（如有）。
+// runBackend 监督后端主循环直到 ctx 被取消。
+// runBackendOnce 出错或 panic 时记录崩溃原因，按指数退避自动重启；正常退出时等待重启信号。
+// ctx: 上下文，取消后当前后端被拆除且不再重启。
+// 返回最后一次运行（含拆除）的错误信息（如有）。
 func (a *App) runBackend(ctx context.Context) error {
+	var backoff time.Duration
 	for {
+		// 每次运行使用独立的子上下文，Restart 只取消当前这一次
+		runCtx, cancel := context.WithCancel(ctx)
+		a.backendMu.Lock()
+		a.runCancel = cancel
+		a.backendMu.Unlock()
+
+		// 上一个后端已拆除，写入待恢复的备份状态
+		a.applyPendingRestore()
+
 		// 启动一次后端主循环
-		err := a.runBackendOnce(ctx)
-		if err != nil {
-			log.Printf("runBackendOnce error: %v", err)
+		start := time.Now()
+		stack, err := a.runSupervised(runCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return err
+		}
+		if err == nil {
+			// 正常退出（Restart 等），等待重启信号或 App 关闭
+			backoff = 0
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-a.backendRestartCh:
+			}
+			continue
 		}
 
-		// 等待重启信号
-		<-a.backendRestartCh
+		uptime := time.Since(start)
+		backoff = nextBackoff(backoff, uptime)
+		log.Printf("runBackendOnce error after %v: %v; restarting in %v", uptime.Round(time.Second), err, backoff)
+		a.crashes.add(crashRecord{
+			Time:    time.Now(),
+			Reason:  err.Error(),
+			Panic:   stack != "",
+			Stack:   stack,
+			Uptime:  uptime,
+			Backoff: backoff,
+		})
+		metricBackendCrashes.Add(1)
+
+		// 退避期间收到显式重启请求时立即重启
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-a.backendRestartCh:
+		case <-t.C:
+		}
+		t.Stop()
 	}
 }
 
 // runBackendOnce 启动一次后端服务，处理 VPN、通知、代理等主循环。
+// ctx 取消时退出主循环，并拆除本次创建的 backend。
 // ctx: 上下文。
 // 返回错误信息（如有）。
-func (a *App) runBackendOnce(ctx context.Context) error {
+func (a *App) runBackendOnce(ctx context.Context) (err error) {
 	log.Printf("runBackendOnce: start")
-	// 检查是否有重启信号提前到达
-	select {
-	case <-a.backendRestartCh:
-		log.Printf("runBackendOnce: received backendRestartCh before start")
-	default:
-	}
+	started := time.Now()
 
 	// 设置全局共享目录
 	paths.AppSharedDir.Store(a.dataDir)
@@ -174,10 +302,19 @@ func (a *App) runBackendOnce(ctx context.Context) error {
 		if rcfg == nil {
 			return nil
 		}
-		// 发送配置到 configs 通道
-		configs <- configPair{rcfg, dcfg}
+		// 发送配置到 configs 通道，主循环退出后不再阻塞引擎
+		select {
+		case configs <- configPair{rcfg, dcfg}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		// 等待配置处理结果
-		return <-configErrs
+		select {
+		case err := <-configErrs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	})
 	if err != nil {
 		log.Printf("runBackendOnce: newBackend error: %v", err)
@@ -185,22 +322,54 @@ func (a *App) runBackendOnce(ctx context.Context) error {
 	}
 	// 存储日志公钥
 	a.logIDPublicAtomic.Store(&b.logIDPublic)
-	// 绑定后端
-	a.backend = b.backend
-	// 退出时关闭 TUN 设备
-	defer b.CloseTUNs()
+	// 退出时拆除本次创建的 backend
+	defer func() {
+		a.backendMu.Lock()
+		if a.cur == b {
+			a.cur = nil
+		}
+		a.backendMu.Unlock()
+		// 后端异常退出或重启期间，锁定模式用黑洞 TUN 顶替即将关闭的 TUN
+		if a.ctx.Err() == nil && b.vpn.currentService() != nil {
+			b.maybeEngageLockdown("backend restarting")
+		}
+		// 拆除错误只记录日志：是否记为崩溃只取决于本次运行的结果，
+		// 正常重启或 ctx 取消后的拆除错误不应触发退避重启
+		if serr := b.shutdown(); serr != nil {
+			log.Printf("runBackendOnce: shutdown: %v", serr)
+		}
+	}()
 
 	// 创建本地 API 处理器
 	h := localapi.NewHandler(ipnauth.Self, b.backend, log.Printf, *a.logIDPublicAtomic.Load())
 	h.PermitRead = true
 	h.PermitWrite = true
+
+	// 绑定后端，并把已有的通知订阅挂接到新的 LocalBackend
+	a.backendMu.Lock()
+	a.backend = b.backend
+	a.cur = b
+	// newBackend 之后到这里之间收到的文件操作事件没有交给 b，这里补上
+	a.applyFileOpsLocked(b.backend)
 	a.localAPIHandler = h
+	for _, nm := range a.watchers {
+		nm.watch(b.backend)
+	}
+	a.backendMu.Unlock()
 
 	// 标记 ready 完成
-	a.ready.Done()
+	a.backendReady()
+
+	// 策略变化转为后端事件，在主循环中处理
+	if unregister, err := a.policyStore.RegisterChangeCallback(func() {
+		a.events.backend.publish(policyChangedEvent{})
+	}); err == nil {
+		defer unregister()
+	}
 
 	// ChromeOS 兼容 DNS
 	b.avoidEmptyDNS = a.isChromeOS()
+	b.lastFallbackSpec, _ = b.dnsFallbackSpec()
 
 	// 定义主循环变量
 	var (
@@ -213,14 +382,31 @@ func (a *App) runBackendOnce(ctx context.Context) error {
 	stateCh := make(chan ipn.State)
 	// 网络映射通道
 	netmapCh := make(chan *netmap.NetworkMap)
+	// 偏好通道，用于漫游时拒绝出口节点
+	prefsCh := make(chan ipn.PrefsView)
 	log.Printf("runBackendOnce: starting WatchNotifications goroutine")
 	// 启动通知监听协程
 	go b.backend.WatchNotifications(ctx, ipn.NotifyInitialNetMap|ipn.NotifyInitialPrefs|ipn.NotifyInitialState, func() {}, func(notify *ipn.Notify) bool {
 		if notify.State != nil {
-			stateCh <- *notify.State
+			select {
+			case stateCh <- *notify.State:
+			case <-ctx.Done():
+				return false
+			}
 		}
 		if notify.NetMap != nil {
-			netmapCh <- notify.NetMap
+			select {
+			case netmapCh <- notify.NetMap:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if notify.Prefs != nil {
+			select {
+			case prefsCh <- *notify.Prefs:
+			case <-ctx.Done():
+				return false
+			}
 		}
 		if notify.BrowseToURL != nil && *notify.BrowseToURL != "" {
 			log.Printf("[TEST-FLINK] 【DEBUG】收到 authURL: %s", *notify.BrowseToURL)
@@ -231,14 +417,19 @@ func (a *App) runBackendOnce(ctx context.Context) error {
 	log.Printf("runBackendOnce: entering main select loop")
 	for {
 		select {
+		case <-ctx.Done():
+			log.Printf("runBackendOnce: context done, tearing down backend")
+			return nil
+		case err := <-b.startErr:
+			return err
 		case s := <-stateCh:
 			// 收到状态变更
 			log.Printf("r[TEST-FLINK] unBackendOnce: received stateCh: %v", s)
 			state = s
-			// VPN 启动后，配置有变化则更新 TUN
-			if state >= ipn.Starting && vpnService.service != nil && b.isConfigNonNilAndDifferent(cfg.rcfg, cfg.dcfg) {
-				log.Printf("[TEST-FLINK] runBackendOnce: updating TUN after stateCh")
-				if err := b.updateTUN(cfg.rcfg, cfg.dcfg); err != nil {
+			// VPN 启动后，配置有变化则更新 TUN 或解析器
+			if state >= ipn.Starting && b.hasTUNProvider() {
+				log.Printf("[TEST-FLINK] runBackendOnce: applying config after stateCh")
+				if err := b.updateConfig(cfg.rcfg, cfg.dcfg); err != nil {
 					if errors.Is(err, errMultipleUsers) {
 						log.Printf("[TEST-FLINK] runBackendOnce: multiple users error: %v", err)
 					}
@@ -249,60 +440,115 @@ func (a *App) runBackendOnce(ctx context.Context) error {
 			// 收到网络映射变更
 			log.Printf("[TEST-FLINK] runBackendOnce: received netmapCh, networkMap: %+v", n)
 			networkMap = n
+		case p := <-prefsCh:
+			// 漫游期间重新开启的出口节点同样撤下
+			if b.network.get().ExitNodeBlocked && p.AdvertisesExitNode() {
+				go b.withdrawExitNode(p)
+			}
 		case c := <-configs:
 			// 收到新配置
 			log.Printf("[TEST-FLINK] runBackendOnce: received configs")
 			cfg = c
-			if vpnService.service == nil || !b.isConfigNonNilAndDifferent(cfg.rcfg, cfg.dcfg) {
-				log.Printf("[TEST-FLINK] runBackendOnce: config not changed or vpnService nil")
+			if !b.hasTUNProvider() {
+				log.Printf("[TEST-FLINK] runBackendOnce: vpnService nil")
 				configErrs <- nil
 				break
 			}
-			log.Printf("[TEST-FLINK] runBackendOnce: updating TUN after configs")
-			configErrs <- b.updateTUN(cfg.rcfg, cfg.dcfg)
-		case s := <-onVPNRequested:
-			// 收到 VPN 启动请求
-			log.Printf("[TEST-FLINK] runBackendOnce: received onVPNRequested")
-			if vpnService.service != nil && vpnService.service.ID() == s.ID() {
-				log.Printf("runBackendOnce: vpnService already set, skipping")
-				break
-			}
-			// 设置 Android Protect 回调
-			netns.SetAndroidProtectFunc(func(fd int) error {
-				if !s.Protect(int32(fd)) {
-					log.Printf("[TEST-FLINK] [unexpected] VpnService.protect(%d) returned false", fd)
-				}
+			log.Printf("[TEST-FLINK] runBackendOnce: applying config after configs")
+			configErrs <- b.updateConfig(cfg.rcfg, cfg.dcfg)
+		case ev, ok := <-a.events.backend.C():
+			if !ok {
+				// App 已关闭，不会再有新的事件
 				return nil
-			})
-			log.Printf("[TEST-FLINK] onVPNRequested: rebind required")
-			b.backend.DebugRebind()
-			vpnService.service = s
-			if networkMap != nil {
-				log.Printf("[TEST-FLINK] onVPNRequested: networkMap present")
-				// TODO: 这里可扩展
 			}
-			if state >= ipn.Starting && b.isConfigNonNilAndDifferent(cfg.rcfg, cfg.dcfg) {
-				log.Printf("[TEST-FLINK] onVPNRequested: updating TUN after VPN requested")
-				if err := b.updateTUN(cfg.rcfg, cfg.dcfg); err != nil {
+			switch ev := ev.(type) {
+			case vpnRequestedEvent:
+				// 收到 VPN 启动请求
+				s := ev.service
+				log.Printf("[TEST-FLINK] runBackendOnce: received vpnRequestedEvent")
+				if !b.vpn.attach(s) {
+					log.Printf("runBackendOnce: vpnService already set, skipping")
+					break
+				}
+				// 设置 Android Protect 回调
+				setProtectFunc(func(fd int) error {
+					if !s.Protect(int32(fd)) {
+						log.Printf("[TEST-FLINK] [unexpected] VpnService.protect(%d) returned false", fd)
+					}
+					return nil
+				})
+				log.Printf("[TEST-FLINK] onVPNRequested: rebind required")
+				b.backend.DebugRebind()
+				if networkMap != nil {
+					log.Printf("[TEST-FLINK] onVPNRequested: networkMap present")
+					// TODO: 这里可扩展
+				}
+				if state >= ipn.Starting {
+					log.Printf("[TEST-FLINK] onVPNRequested: applying config after VPN requested")
+					if err := b.updateConfig(cfg.rcfg, cfg.dcfg); err != nil {
+						a.closeVpnService(err, b)
+					}
+				}
+			case vpnDisconnectedEvent:
+				// 收到 VPN 断开请求
+				s := ev.service
+				log.Printf("[TEST-FLINK] runBackendOnce: received vpnDisconnectedEvent")
+				b.CloseTUNs()
+				b.lockdown.release()
+				if b.vpn.detach(s) {
+					log.Printf("[TEST-FLINK] runBackendOnce: disconnecting vpnService")
+					setProtectFunc(nil)
+				}
+				// 停止代理服务
+				log.Printf("[TEST-FLINK] runBackendOnce: stopping proxyService")
+				stopProxyService()
+			case externalTUNEvent:
+				// 嵌入方提供或撤回自带的 TUN
+				if err := b.attachExternalTUN(ev.tun, cfg.rcfg, cfg.dcfg); err != nil {
+					log.Printf("attachExternalTUN: %v", err)
+					a.closeVpnService(err, b)
+				}
+			case policyChangedEvent:
+				// 锁定模式被关闭时立即释放黑洞 TUN
+				if b.lockdown.get().Active && !b.lockdownEnabled() {
+					log.Printf("runBackendOnce: lockdown disabled by policy, releasing")
+					b.lockdown.release()
+				}
+				// 兜底 DNS 来自策略或用户设置，变化时重新计算 DNS 配置
+				b.maybeReapplyDNS()
+				// 网络类型相关的限制由策略开启或关闭
+				b.updateNetworkStatus(b.network.get().Interface)
+				// 策略变化可能影响按应用分流，规则变化时重建 TUN
+				if b.lastCfg != nil && b.vpn.currentService() != nil && !b.currentAppFilter().equal(b.lastAppFilter) {
+					log.Printf("runBackendOnce: app filter changed, updating TUN")
+					if err := b.updateTUN(b.lastCfg, b.lastDNSCfg); err != nil {
+						a.closeVpnService(err, b)
+					}
+				}
+			case networkChangedEvent:
+				// 收到 DNS 配置变更
+				log.Printf("[TEST-FLINK] runBackendOnce: received networkChangedEvent: %s", ev.ifname)
+				b.netChanges.submit(ev.ifname)
+			case networkCapsChangedEvent:
+				// 计费、漫游或强制门户标志变化不会改变接口名，netChangeProcessor 与 netmon 都不会触发
+				if cur := b.network.get().Interface; ev.ifname != "" && ev.ifname == cur {
+					b.updateNetworkStatus(cur)
+				}
+			case captivePortalEvent:
+				if err := b.handleCaptivePortal(ev); err != nil {
+					a.closeVpnService(err, b)
+				}
+			case backendPanicEvent:
+				// 后端协程 panic 后状态不可信，返回错误交给 supervisor 记录并退避重启
+				if err := a.handleBackendPanic(ev, started); err != nil {
+					return err
+				}
+			case networkSettledEvent:
+				// 一阵网络变化平息后，按最新的接口名更新网络状态与平台 DNS
+				if err := b.onNetworkSettled(ev.ifname, state); err != nil {
 					a.closeVpnService(err, b)
 				}
 			}
-		case s := <-onDisconnect:
-			// 收到 VPN 断开请求
-			log.Printf("[TEST-FLINK] runBackendOnce: received onDisconnect")
-			b.CloseTUNs()
-			if vpnService.service != nil && vpnService.service.ID() == s.ID() {
-				log.Printf("[TEST-FLINK] runBackendOnce: disconnecting vpnService")
-				netns.SetAndroidProtectFunc(nil)
-				vpnService.service = nil
-			}
-			// 停止代理服务
-			log.Printf("[TEST-FLINK] runBackendOnce: stopping proxyService")
-			stopProxyService()
-		case i := <-onDNSConfigChanged:
-			// 收到 DNS 配置变更
-			log.Printf("[TEST-FLINK] runBackendOnce: received onDNSConfigChanged: %s", i)
-			go b.NetworkChanged(i)
 		}
 	}
 }
@@ -314,48 +560,95 @@ func (a *App) runBackendOnce(ctx context.Context) error {
 // settings: 路由和 DNS 配置回调。
 // 返回 backend 实例和错误信息。
 func (a *App) newBackend(dataDir string, appCtx AppContext, store *stateStore,
-	settings settingsFunc) (*backend, error) {
+	settings settingsFunc) (_ *backend, err error) {
 
 	sys := new(tsd.System)
 	sys.Set(store)
+	// 持久化失败（包括下面写入日志 ID）通过健康状态告警
+	store.setHealthTracker(sys.HealthTracker())
 
 	logf := logger.RusagePrefixLog(log.Printf)
 	b := &backend{
-		devices:  newTUNDevices(),
-		settings: settings,
-		appCtx:   appCtx,
-		bus:      eventbus.New(),
+		devices:       newTUNDevices(),
+		settings:      settings,
+		appCtx:        appCtx,
+		bus:           eventbus.New(),
+		events:        a.events,
+		policy:        a.policyStore,
+		store:         store,
+		vpn:           a.vpn,
+		network:       a.network,
+		lockdown:      a.lockdown,
+		getInterfaces: a.getInterfaces,
+
+		snapshotInterfaces: a.interfaceSnapshot,
+		startErr:           make(chan error, 1),
+		done:               make(chan struct{}),
 	}
+	// 初始化中途失败时回收已创建的资源，supervisor 会在退避后重试
+	defer func() {
+		if err != nil {
+			b.shutdown()
+		}
+	}()
 
 	var logID logid.PrivateID
 	logID.UnmarshalText([]byte("dead0000dead0000dead0000dead0000dead0000dead0000dead0000dead0000"))
-	storedLogID, err := store.read(logPrefKey)
-	// In all failure cases we ignore any errors and continue with the dead value above.
-	if err != nil || storedLogID == nil {
-		// Read failed or there was no previous log id.
-		newLogID, err := logid.NewPrivateID()
-		if err == nil {
+	storedLogID, readErr := store.read(logPrefKey)
+	persistLogID := false
+	switch {
+	case readErr != nil:
+		// 存储暂时不可用，使用临时 ID 且不写回，避免覆盖已保存的日志 ID
+		log.Printf("newBackend: read log ID: %v; using a temporary log ID", readErr)
+	case storedLogID == nil:
+		persistLogID = true
+	default:
+		if uerr := logID.UnmarshalText(storedLogID); uerr != nil {
+			log.Printf("newBackend: stored log ID is corrupt: %v; generating a new one", uerr)
+			persistLogID = true
+		}
+	}
+	if readErr != nil || persistLogID {
+		// In all failure cases we continue with the dead value above.
+		newLogID, gerr := logid.NewPrivateID()
+		if gerr == nil {
 			logID = newLogID
-			enc, err := newLogID.MarshalText()
-			if err == nil {
-				store.write(logPrefKey, enc)
+		} else {
+			persistLogID = false
+		}
+	}
+	if persistLogID {
+		if enc, merr := logID.MarshalText(); merr == nil {
+			if werr := store.write(logPrefKey, enc); werr != nil {
+				log.Printf("newBackend: persist log ID: %v", werr)
 			}
 		}
-	} else {
-		logID.UnmarshalText([]byte(storedLogID))
 	}
 
 	netMon, err := netmon.New(b.bus, logf)
 	if err != nil {
-		log.Printf("netmon.New: %w", err)
+		log.Printf("netmon.New: %v", err)
 	}
 	b.netMon = netMon
+	b.netChanges = newNetChangeProcessor(netChangeDebounce, netChangeMaxDelay, b.applyNetworkChange)
+	b.captive = &captiveProber{
+		detect:  newCaptiveDetector(logf, netMon).detect,
+		derpMap: a.currentDERPMap,
+		publish: func(ev captivePortalEvent) { a.events.backend.publish(ev) },
+	}
+	if netMon != nil {
+		netMon.RegisterChangeCallback(b.captive.onNetMonChange)
+	}
 	b.setupLogs(dataDir, logID, logf, sys.HealthTracker())
 	dialer := new(tsdial.Dialer)
 	vf := &VPNFacade{
 		SetBoth:           b.setCfg,
 		GetBaseConfigFunc: b.getDNSBaseConfig,
 	}
+	// 调试用：TS_DEBUG_MTU 固定 TUN MTU，与其他平台行为一致
+	if mtu, ok := envknob.LookupUintSized("TS_DEBUG_MTU", 10, 32); ok {
+		vf.InitialMTU = uint32(mtu)
+	}
 	engine, err := wgengine.NewUserspaceEngine(logf, wgengine.Config{
 		Tun:            b.devices,
 		Router:         vf,
@@ -371,6 +664,7 @@ func (a *App) newBackend(dataDir string, appCtx AppContext, store *stateStore,
 	if err != nil {
 		return nil, fmt.Errorf("[TEST-FLINK] runBackend: NewUserspaceEngine: %v", err)
 	}
+	b.engine = engine
 	sys.Set(engine)
 	b.logIDPublic = logID.Public()
 	ns, err := netstack.Create(logf, sys.Tun.Get(), engine, sys.MagicSock.Get(), dialer, sys.DNSManager.Get(), sys.ProxyMapper())
@@ -385,10 +679,13 @@ func (a *App) newBackend(dataDir string, appCtx AppContext, store *stateStore,
 		w.Start()
 	}
 	lb, err := ipnlocal.NewLocalBackend(logf, logID.Public(), sys, 0)
-	if ext, ok := ipnlocal.GetExt[*taildrop.Extension](lb); ok {
-		ext.SetFileOps(NewAndroidFileOps(a.shareFileHelper))
-		ext.SetDirectFileRoot(a.directFileRoot)
+	if err != nil {
+		return nil, fmt.Errorf("NewLocalBackend: %w", err)
 	}
+	// 须在 lb.Start 之前设置：Taildrop 在切换配置文件时按当时的设置创建 manager
+	a.backendMu.Lock()
+	a.applyFileOpsLocked(lb)
+	a.backendMu.Unlock()
 
 	if err := ns.Start(lb); err != nil {
 		return nil, fmt.Errorf("startNetstack: %w", err)
@@ -396,7 +693,6 @@ func (a *App) newBackend(dataDir string, appCtx AppContext, store *stateStore,
 	if b.logger != nil {
 		lb.SetLogFlusher(b.logger.StartFlush)
 	}
-	b.engine = engine
 	b.backend = lb
 	b.sys = sys
 	go func() {
@@ -410,42 +706,92 @@ func (a *App) newBackend(dataDir string, appCtx AppContext, store *stateStore,
 		prefs.WantRunning = true
 		opts.UpdatePrefs = prefs
 
-		err := lb.Start(opts)
-		if err != nil {
-			log.Printf("[TEST-FLINK] Failed to start LocalBackend, panicking: %s", err)
-			panic(err)
+		if err := lb.Start(opts); err != nil {
+			// 不再 panic：交给 runBackendOnce 返回错误，由 supervisor 退避后重启
+			log.Printf("[TEST-FLINK] Failed to start LocalBackend: %s", err)
+			b.startErr <- fmt.Errorf("LocalBackend.Start: %w", err)
+			return
 		}
-		a.ready.Done()
+		a.startReady()
 	}()
 	return b, nil
 }
 
-// watchFileOpsChanges 监听文件操作相关的全局通道，动态更新 directFileRoot 和 shareFileHelper。
+// watchFileOpsChanges 监听文件操作事件，动态更新 directFileRoot 和 shareFileHelper。
+// 新设置直接交给运行中的 Taildrop 扩展，不重启后端，避免打开 App 时断开 VPN。
 func (a *App) watchFileOpsChanges() {
-	for {
-		select {
-		case newPath := <-onFilePath:
+	for ev := range a.events.fileOps.C() {
+		a.backendMu.Lock()
+		switch ev := ev.(type) {
+		case directFileRootEvent:
 			log.Printf("Got new directFileRoot")
-			a.directFileRoot = newPath
-			a.backendRestartCh <- struct{}{}
-		case helper := <-onShareFileHelper:
+			a.directFileRoot = ev.path
+		case shareFileHelperEvent:
 			log.Printf("Got shareFIleHelper")
-			a.shareFileHelper = helper
-			a.backendRestartCh <- struct{}{}
+			a.shareFileHelper = ev.helper
+		}
+		if a.cur != nil {
+			a.applyFileOpsLocked(a.cur.backend)
 		}
+		a.backendMu.Unlock()
+	}
+}
+
+// applyFileOpsLocked 把当前的 directFileRoot 与 shareFileHelper 交给 lb 的 Taildrop 扩展，调用方需持有 a.backendMu。
+// Taildrop 的 manager 持有同一个 a.fileOps，新的 helper 立即用于之后的文件操作；
+// directFileRoot 在 Taildrop 下一次创建 manager（切换配置文件）时生效。
+func (a *App) applyFileOpsLocked(lb *ipnlocal.LocalBackend) {
+	if a.fileOps == nil {
+		a.fileOps = NewAndroidFileOps(a.shareFileHelper)
+		a.fileOps.paused = func() bool { return a.network.get().TaildropPaused }
+	}
+	a.fileOps.setHelper(a.shareFileHelper)
+	ext, ok := ipnlocal.GetExt[*taildrop.Extension](lb)
+	if !ok {
+		return
 	}
+	ext.SetFileOps(a.fileOps)
+	ext.SetDirectFileRoot(a.directFileRoot)
 }
 
-// isConfigNonNilAndDifferent 判断路由和 DNS 配置是否有变化且不为 nil。
+// isConfigNonNilAndDifferent 判断路由和 DNS 配置是否不为 nil 且有需要重建 TUN 的变化，比较规则见 configdiff.go。
+// 只做判断，不修改状态；无需重建的变化由 updateResolver 记录。
+// 锁定模式生效时始终需要重建，以便用真正的 TUN 取代黑洞 TUN。
 // rcfg: 路由配置。
 // dcfg: DNS 配置。
-// 返回 true 表示有变化。
+// 返回 true 表示需要调用 updateTUN。
 func (b *backend) isConfigNonNilAndDifferent(rcfg *router.Config, dcfg *dns.OSConfig) bool {
-	if reflect.DeepEqual(rcfg, b.lastCfg) && reflect.DeepEqual(dcfg, b.lastDNSCfg) {
-		b.logger.Logf("isConfigNonNilAndDifferent: no change to Routes or DNS, ignore")
+	if rcfg == nil {
 		return false
 	}
-	return rcfg != nil
+	if b.lockdown.get().Active {
+		return true
+	}
+	return diffConfig(b.lastCfg, rcfg, b.lastDNSCfg, dcfg).needsRebuild()
+}
+
+// updateConfig 应用新的路由和 DNS 配置：需要重建时调用 updateTUN，否则交给 updateResolver。
+func (b *backend) updateConfig(rcfg *router.Config, dcfg *dns.OSConfig) error {
+	if b.isConfigNonNilAndDifferent(rcfg, dcfg) {
+		log.Printf("updateConfig: change %v, TUN rebuild needed", diffConfig(b.lastCfg, rcfg, b.lastDNSCfg, dcfg))
+		return b.updateTUN(rcfg, dcfg)
+	}
+	b.updateResolver(rcfg, dcfg)
+	return nil
+}
+
+// updateResolver 应用无需重建 TUN 的变化（包括仅 DNS、匹配域或路由顺序变化）。
+// dns.Manager 在调用 SetDNS 之前已把新配置交给 quad-100 解析器，这里只把新配置记为最新，
+// 供之后的比较与重建使用。搜索域只能经 VpnService.Builder 下发，其变化总会触发重建，不会走到这里。
+func (b *backend) updateResolver(rcfg *router.Config, dcfg *dns.OSConfig) {
+	if rcfg == nil {
+		return
+	}
+	if c := diffConfig(b.lastCfg, rcfg, b.lastDNSCfg, dcfg); c != 0 {
+		log.Printf("updateResolver: change %v applied without a TUN rebuild", c)
+	}
+	b.lastCfg = rcfg
+	b.lastDNSCfg = dcfg
 }
 
 // closeVpnService 关闭 VPN 服务，清理配置并断开连接。
@@ -454,6 +800,11 @@ func (b *backend) isConfigNonNilAndDifferent(rcfg *router.Config, dcfg *dns.OSCo
 func (a *App) closeVpnService(err error, b *backend) {
 	log.Printf("[TEST-FLINK] VPN update failed: %v", err)
 
+	// 锁定模式下保留黑洞 TUN，不关闭 VPN，避免流量泄漏到底层网络
+	if b.maybeEngageLockdown(fmt.Sprintf("VPN update failed: %v", err)) {
+		return
+	}
+
 	mp := new(ipn.MaskedPrefs)
 	mp.WantRunning = false
 	mp.WantRunningSet = true
@@ -465,6 +816,5 @@ func (a *App) closeVpnService(err error, b *backend) {
 	b.lastCfg = nil
 	b.CloseTUNs()
 
-	vpnService.service.DisconnectVPN()
-	vpnService.service = nil
+	b.vpn.disconnect(err)
 }
@@ -0,0 +1,254 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// backup.go 把 stateStore 中的全部状态（机器密钥、节点密钥、配置文件与偏好设置等）导出为口令加密的备份包，
+// 并在新安装上恢复，保留节点身份，避免重新登录后因节点密钥变化破坏绑定该节点的 ACL。
+// 企业策略 AllowStateBackup 为 false 时禁止导出与恢复。
+package libtailscale
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"tailscale.com/util/syspolicy"
+)
+
+const (
+	// allowStateBackupPolicyKey 是否允许导出与恢复状态备份，未设置时允许。
+	allowStateBackupPolicyKey = "AllowStateBackup"
+
+	// stateBundleVersion 备份包格式版本。
+	stateBundleVersion = 1
+	// stateBundleKDF 口令派生密钥的算法，记录在备份包中。
+	stateBundleKDF = "pbkdf2-sha256"
+	// stateBundleIterations PBKDF2 迭代次数。
+	stateBundleIterations = 600000
+	// minBackupPassphraseLen 备份口令的最短长度。
+	minBackupPassphraseLen = 8
+)
+
+var (
+	// errStateBackupDisabled 表示企业策略禁止备份与恢复。
+	errStateBackupDisabled = errors.New("state backup is disabled by your organization")
+	// errBackupPassphrase 表示口令过短或与备份包不匹配。
+	errBackupPassphrase = errors.New("wrong or too short backup passphrase")
+)
+
+// backupExcludedKeys 只与本机相关、不随备份迁移的键；恢复时保留本机的值。
+var backupExcludedKeys = []string{
+	crashHistoryPrefKey,
+}
+
+// stateBundle 备份包的外层格式，以 JSON 序列化。Ciphertext 为 stateBundleContents 的 AES-256-GCM 密文，
+// 头部（Version、KDF、Iterations、Salt）作为附加数据参与认证，见 additionalData。
+type stateBundle struct {
+	Version    int
+	KDF        string
+	Iterations int
+	Salt       []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// stateBundleContents 备份包的明文内容。
+type stateBundleContents struct {
+	Created time.Time
+	State   map[string][]byte // stateStore 键到原始值
+}
+
+// pendingRestore 等待在下次创建后端前写入的恢复状态，见 applyPendingRestore。
+type pendingRestore struct {
+	state map[string][]byte
+	done  chan error
+}
+
+// stateBackupAllowed 报告企业策略是否允许备份与恢复，未设置或读取失败时允许。
+func (a *App) stateBackupAllowed() bool {
+	on, err := a.policyStore.ReadBoolean(allowStateBackupPolicyKey)
+	if err != nil {
+		if !errors.Is(err, syspolicy.ErrNoSuchKey) {
+			log.Printf("backup: read %s policy: %v", allowStateBackupPolicyKey, err)
+		}
+		return true
+	}
+	return on
+}
+
+// ExportState 把全部状态序列化并用 passphrase 加密，返回备份包。
+// 备份包包含节点私钥，应像密码一样保管。
+func (a *App) ExportState(passphrase string) ([]byte, error) {
+	if !a.stateBackupAllowed() {
+		return nil, errStateBackupDisabled
+	}
+	if len(passphrase) < minBackupPassphraseLen {
+		return nil, errBackupPassphrase
+	}
+	state, err := a.store.dump()
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	for _, k := range backupExcludedKeys {
+		delete(state, k)
+	}
+	plain, err := json.Marshal(stateBundleContents{Created: time.Now().UTC(), State: state})
+	if err != nil {
+		return nil, err
+	}
+	bundle := stateBundle{
+		Version:    stateBundleVersion,
+		KDF:        stateBundleKDF,
+		Iterations: stateBundleIterations,
+		Salt:       make([]byte, 16),
+	}
+	if _, err := rand.Read(bundle.Salt); err != nil {
+		return nil, err
+	}
+	if err := bundle.seal(passphrase, plain); err != nil {
+		return nil, err
+	}
+	log.Printf("backup: exported %d keys", len(state))
+	return json.Marshal(bundle)
+}
+
+// ImportState 用 passphrase 解密 ExportState 生成的备份包，替换全部状态并重启后端。
+// 状态在旧后端拆除之后、新后端创建之前写入，避免被旧后端覆盖；返回写入结果。
+func (a *App) ImportState(data []byte, passphrase string) error {
+	if !a.stateBackupAllowed() {
+		return errStateBackupDisabled
+	}
+	if a.ctx.Err() != nil {
+		return errAppClosed
+	}
+	var bundle stateBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return fmt.Errorf("parse backup: %w", err)
+	}
+	if bundle.Version != stateBundleVersion || bundle.KDF != stateBundleKDF {
+		return fmt.Errorf("unsupported backup version %d (%s)", bundle.Version, bundle.KDF)
+	}
+	plain, err := bundle.open(passphrase)
+	if err != nil {
+		return err
+	}
+	var contents stateBundleContents
+	if err := json.Unmarshal(plain, &contents); err != nil {
+		return fmt.Errorf("parse backup: %w", err)
+	}
+	if len(contents.State) == 0 {
+		return errors.New("parse backup: no state")
+	}
+	for k := range contents.State {
+		if !isMigratedKey(k) {
+			return fmt.Errorf("parse backup: unexpected key %q", k)
+		}
+	}
+	log.Printf("backup: restoring %d keys from backup created %v", len(contents.State), contents.Created)
+
+	r := &pendingRestore{state: contents.State, done: make(chan error, 1)}
+	a.backendMu.Lock()
+	a.restore = r
+	a.backendMu.Unlock()
+	a.requestRestart()
+	select {
+	case err := <-r.done:
+		return err
+	case <-a.ctx.Done():
+		return errAppClosed
+	}
+}
+
+// applyPendingRestore 写入 ImportState 提交的状态，由 runBackend 在创建后端前调用。
+func (a *App) applyPendingRestore() {
+	a.backendMu.Lock()
+	r := a.restore
+	a.restore = nil
+	a.backendMu.Unlock()
+	if r == nil {
+		return
+	}
+	for _, k := range backupExcludedKeys {
+		v, err := a.store.read(k)
+		if err != nil {
+			log.Printf("backup: keep %s: %v", k, err)
+		}
+		if v != nil {
+			r.state[k] = v
+		}
+	}
+	err := a.store.replace(r.state)
+	if err != nil {
+		log.Printf("backup: restore: %v", err)
+	} else {
+		log.Printf("backup: restored %d keys", len(r.state))
+	}
+	r.done <- err
+}
+
+// seal 用 passphrase 加密 plain，写入 Nonce 与 Ciphertext。调用前需填好头部。
+func (b *stateBundle) seal(passphrase string, plain []byte) error {
+	aead, err := b.aead(passphrase)
+	if err != nil {
+		return err
+	}
+	b.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(b.Nonce); err != nil {
+		return err
+	}
+	b.Ciphertext = aead.Seal(nil, b.Nonce, plain, b.additionalData())
+	return nil
+}
+
+// open 用 passphrase 解密备份包。口令错误、密文或头部被篡改时返回 errBackupPassphrase。
+func (b *stateBundle) open(passphrase string) ([]byte, error) {
+	aead, err := b.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.Nonce) != aead.NonceSize() {
+		return nil, errors.New("parse backup: bad nonce")
+	}
+	plain, err := aead.Open(nil, b.Nonce, b.Ciphertext, b.additionalData())
+	if err != nil {
+		return nil, errBackupPassphrase
+	}
+	return plain, nil
+}
+
+// additionalData 返回 GCM 附加数据：头部的 JSON 编码。头部不加密，但修改任一字段都会使解密失败。
+func (b *stateBundle) additionalData() []byte {
+	ad, _ := json.Marshal(struct {
+		Version    int
+		KDF        string
+		Iterations int
+		Salt       []byte
+	}{b.Version, b.KDF, b.Iterations, b.Salt})
+	return ad
+}
+
+// aead 由 passphrase 与备份包中的盐派生 AES-256-GCM 密钥。
+func (b *stateBundle) aead(passphrase string) (cipher.AEAD, error) {
+	if len(passphrase) < minBackupPassphraseLen {
+		return nil, errBackupPassphrase
+	}
+	// 迭代次数来自备份包，限制上限避免恶意备份包长时间占用 CPU
+	if b.Iterations <= 0 || b.Iterations > 10*stateBundleIterations || len(b.Salt) == 0 {
+		return nil, errors.New("parse backup: bad key derivation parameters")
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, b.Salt, b.Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,280 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"testing"
+	"time"
+
+	"tailscale.com/util/syspolicy"
+)
+
+// fakePolicyAppContext 只实现企业策略相关方法的 AppContext，未设置的键返回 ErrNoSuchKey。
+// errs 中的键无论以何种类型读取都返回对应的错误，模拟 Android 侧抛出的异常。
+type fakePolicyAppContext struct {
+	AppContext
+	bools   map[string]bool
+	ints    map[string]int64
+	strings map[string]string
+	arrays  map[string]string // 键到 JSON 编码的字符串数组
+	errs    map[string]error
+}
+
+// errFakeNoSuchKey 模拟 Android 侧返回的 ErrNoSuchKey，只有错误信息相同。
+var errFakeNoSuchKey = errors.New(syspolicy.ErrNoSuchKey.Error())
+
+func (c *fakePolicyAppContext) GetSyspolicyBooleanValue(key string) (bool, error) {
+	if err := c.errs[key]; err != nil {
+		return false, err
+	}
+	v, ok := c.bools[key]
+	if !ok {
+		return false, errFakeNoSuchKey
+	}
+	return v, nil
+}
+
+func (c *fakePolicyAppContext) GetSyspolicyIntegerValue(key string) (int64, error) {
+	if err := c.errs[key]; err != nil {
+		return 0, err
+	}
+	v, ok := c.ints[key]
+	if !ok {
+		return 0, errFakeNoSuchKey
+	}
+	return v, nil
+}
+
+func (c *fakePolicyAppContext) GetSyspolicyStringValue(key string) (string, error) {
+	if err := c.errs[key]; err != nil {
+		return "", err
+	}
+	v, ok := c.strings[key]
+	if !ok {
+		return "", errFakeNoSuchKey
+	}
+	return v, nil
+}
+
+func (c *fakePolicyAppContext) GetSyspolicyStringArrayJSONValue(key string) (string, error) {
+	if err := c.errs[key]; err != nil {
+		return "", err
+	}
+	v, ok := c.arrays[key]
+	if !ok {
+		return "", errFakeNoSuchKey
+	}
+	return v, nil
+}
+
+// newBackupTestApp 返回以内存 stateStore 保存 state 的 App，并模拟 runBackend：收到重启信号后写入待恢复的状态。
+func newBackupTestApp(t *testing.T, policy *fakePolicyAppContext, state map[string][]byte) *App {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	a := &App{
+		appCtx:           policy,
+		store:            newStateStore(newMemStateStore(), stateStoreMemory),
+		ctx:              ctx,
+		backendRestartCh: make(chan struct{}, 1),
+	}
+	a.policyStore = &syspolicyHandler{a: a}
+	if err := a.store.replace(state); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			select {
+			case <-a.backendRestartCh:
+				a.applyPendingRestore()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return a
+}
+
+// sealTestBundle 用较少的迭代次数加密任意状态，构造 ExportState 不会生成的备份包。
+func sealTestBundle(t *testing.T, passphrase string, state map[string][]byte) []byte {
+	t.Helper()
+	plain, err := json.Marshal(stateBundleContents{Created: time.Now().UTC(), State: state})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := stateBundle{
+		Version:    stateBundleVersion,
+		KDF:        stateBundleKDF,
+		Iterations: 1000,
+		Salt:       []byte("0123456789abcdef"),
+	}
+	if err := bundle.seal(passphrase, plain); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// modifyBundle 解析备份包，交给 f 修改后重新序列化。
+func modifyBundle(t *testing.T, data []byte, f func(*stateBundle)) []byte {
+	t.Helper()
+	var b stateBundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		t.Fatal(err)
+	}
+	f(&b)
+	out, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// TestStateBackupRoundTrip 恢复后状态与导出时一致，旧状态被替换，本机专属的键保留本机的值。
+func TestStateBackupRoundTrip(t *testing.T) {
+	const pass = "correct horse"
+	src := newBackupTestApp(t, &fakePolicyAppContext{}, map[string][]byte{
+		prefKeyFor("_machinekey"): []byte("machine"),
+		prefKeyFor("profile-1"):   []byte("profile"),
+		logPrefKey:                []byte("log id"),
+		crashHistoryPrefKey:       []byte("src crashes"),
+	})
+	data, err := src.ExportState(pass)
+	if err != nil {
+		t.Fatalf("ExportState: %v", err)
+	}
+
+	dst := newBackupTestApp(t, &fakePolicyAppContext{}, map[string][]byte{
+		prefKeyFor("_machinekey"): []byte("other machine"),
+		prefKeyFor("stale"):       []byte("stale"),
+		crashHistoryPrefKey:       []byte("dst crashes"),
+	})
+	if err := dst.ImportState(data, pass); err != nil {
+		t.Fatalf("ImportState: %v", err)
+	}
+	got, err := dst.store.dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		prefKeyFor("_machinekey"): []byte("machine"),
+		prefKeyFor("profile-1"):   []byte("profile"),
+		logPrefKey:                []byte("log id"),
+		crashHistoryPrefKey:       []byte("dst crashes"),
+	}
+	if !maps.EqualFunc(got, want, func(a, b []byte) bool { return string(a) == string(b) }) {
+		t.Errorf("state after import = %q, want %q", got, want)
+	}
+}
+
+// TestImportStateRejects 口令错误、密文或头部被篡改、包含未知键的备份包都不会写入状态。
+func TestImportStateRejects(t *testing.T) {
+	const pass = "correct horse"
+	good := sealTestBundle(t, pass, map[string][]byte{prefKeyFor("_machinekey"): []byte("machine")})
+	tests := []struct {
+		name    string
+		data    []byte
+		pass    string
+		wantErr error
+	}{
+		{name: "wrong passphrase", data: good, pass: "wrong horse", wantErr: errBackupPassphrase},
+		{name: "short passphrase", data: good, pass: "short", wantErr: errBackupPassphrase},
+		{
+			name: "tampered ciphertext",
+			data: modifyBundle(t, good, func(b *stateBundle) { b.Ciphertext[0] ^= 1 }),
+			pass: pass, wantErr: errBackupPassphrase,
+		},
+		{
+			name: "tampered iterations",
+			data: modifyBundle(t, good, func(b *stateBundle) { b.Iterations++ }),
+			pass: pass, wantErr: errBackupPassphrase,
+		},
+		{
+			name: "tampered salt",
+			data: modifyBundle(t, good, func(b *stateBundle) { b.Salt[0] ^= 1 }),
+			pass: pass, wantErr: errBackupPassphrase,
+		},
+		{
+			name: "unsupported version",
+			data: modifyBundle(t, good, func(b *stateBundle) { b.Version++ }),
+			pass: pass,
+		},
+		{
+			name: "key outside the state store",
+			data: sealTestBundle(t, pass, map[string][]byte{
+				prefKeyFor("_machinekey"): []byte("machine"),
+				"unrelated":               []byte("x"),
+			}),
+			pass: pass,
+		},
+		{name: "no state", data: sealTestBundle(t, pass, nil), pass: pass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newBackupTestApp(t, &fakePolicyAppContext{}, map[string][]byte{prefKeyFor("_machinekey"): []byte("mine")})
+			err := a.ImportState(tt.data, tt.pass)
+			if err == nil {
+				t.Fatal("ImportState succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("ImportState = %v, want %v", err, tt.wantErr)
+			}
+			if v, _ := a.store.read(prefKeyFor("_machinekey")); string(v) != "mine" {
+				t.Errorf("state changed to %q after a rejected import", v)
+			}
+		})
+	}
+}
+
+// TestStateBackupPolicy AllowStateBackup 为 false 时导出与恢复都被拒绝，未设置时允许。
+func TestStateBackupPolicy(t *testing.T) {
+	const pass = "correct horse"
+	data := sealTestBundle(t, pass, map[string][]byte{prefKeyFor("_machinekey"): []byte("machine")})
+	state := map[string][]byte{prefKeyFor("_machinekey"): []byte("mine")}
+
+	denied := newBackupTestApp(t, &fakePolicyAppContext{bools: map[string]bool{allowStateBackupPolicyKey: false}}, state)
+	if _, err := denied.ExportState(pass); !errors.Is(err, errStateBackupDisabled) {
+		t.Errorf("ExportState = %v, want %v", err, errStateBackupDisabled)
+	}
+	if err := denied.ImportState(data, pass); !errors.Is(err, errStateBackupDisabled) {
+		t.Errorf("ImportState = %v, want %v", err, errStateBackupDisabled)
+	}
+	if v, _ := denied.store.read(prefKeyFor("_machinekey")); string(v) != "mine" {
+		t.Errorf("state changed to %q while backups are disabled", v)
+	}
+
+	allowed := newBackupTestApp(t, &fakePolicyAppContext{}, state)
+	if err := allowed.ImportState(data, pass); err != nil {
+		t.Errorf("ImportState without the policy set: %v", err)
+	}
+}
+
+// TestStateBundleAdditionalData 头部字段即使不影响派生密钥，修改后也无法解密。
+func TestStateBundleAdditionalData(t *testing.T) {
+	const pass = "correct horse"
+	b := stateBundle{Version: stateBundleVersion, KDF: stateBundleKDF, Iterations: 1000, Salt: []byte("salt")}
+	if err := b.seal(pass, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.open(pass); err != nil || string(got) != "plain" {
+		t.Fatalf("open = %q, %v", got, err)
+	}
+	for name, f := range map[string]func(*stateBundle){
+		"Version": func(b *stateBundle) { b.Version++ },
+		"KDF":     func(b *stateBundle) { b.KDF = "other" },
+	} {
+		m := b
+		f(&m)
+		if _, err := m.open(pass); !errors.Is(err, errBackupPassphrase) {
+			t.Errorf("open with modified %s = %v, want %v", name, err, errBackupPassphrase)
+		}
+	}
+}
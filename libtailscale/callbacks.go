@@ -5,48 +5,234 @@
 package libtailscale
 
 import (
+	"log"
 	"sync"
 )
 
-var (
-	// onVPNRequested 用于接收 VPN 连接请求的全局通道，类型为 IPNService。
-	onVPNRequested = make(chan IPNService)
-	// onDisconnect 用于接收 VPN 断开请求的全局通道，类型为 IPNService。
-	onDisconnect = make(chan IPNService)
+// appEvents 是 App 级别的事件分发器，替代原先的包级全局通道。
+// 每个队列内部严格按发布顺序投递；不同队列之间不保证相对顺序。
+// 发布永不阻塞调用方（通常是 Java 线程）。
+type appEvents struct {
+	// backend 投递给 runBackendOnce 的事件：vpnRequestedEvent、vpnDisconnectedEvent、networkChangedEvent、
+	// networkSettledEvent、networkCapsChangedEvent、captivePortalEvent、policyChangedEvent、externalTUNEvent、
+	// backendPanicEvent。
+	// 三类事件共用一个队列，保证 RequestVPN 与 ServiceDisconnect 不会乱序。
+	backend *eventQueue[any]
+	// fileOps 投递给 watchFileOpsChanges 的事件：directFileRootEvent、shareFileHelperEvent。
+	fileOps *eventQueue[any]
+	// logs Android 侧日志，超过 logQueueLimit 时丢弃最旧的日志。
+	logs *eventQueue[string]
+}
 
-	// onGoogleToken 用于接收 Google ID token 的全局通道。
-	onGoogleToken = make(chan string)
+// logQueueLimit 日志队列的最大长度，与原 onLog 通道容量一致。
+const logQueueLimit = 10
 
-	// onDNSConfigChanged 用于通知网络变化、需要更新 DNS 配置的全局通道，内容为接口名。
-	onDNSConfigChanged = make(chan string, 1)
+// vpnRequestedEvent 对应 RequestVPN。
+type vpnRequestedEvent struct{ service IPNService }
 
-	// onLog 用于接收 Android 日志的全局通道。
-	onLog = make(chan string, 10)
+// vpnDisconnectedEvent 对应 ServiceDisconnect。
+type vpnDisconnectedEvent struct{ service IPNService }
 
-	// onShareFileHelper 用于接收 ShareFileHelper 实例的全局通道，便于文件接收。
-	onShareFileHelper = make(chan ShareFileHelper, 1)
+// networkChangedEvent 对应 OnDNSConfigChanged，ifname 为空表示断网。
+type networkChangedEvent struct{ ifname string }
 
-	// onFilePath 用于接收 Taildrop SAF 路径的全局通道。
-	onFilePath = make(chan string)
-)
+// networkSettledEvent 一阵网络变化平息后由 netChangeProcessor 发布，ifname 为最新的接口名。
+type networkSettledEvent struct{ ifname string }
+
+// networkCapsChangedEvent 对应 OnNetworkCapabilitiesChanged，ifname 为能力发生变化的网络接口名。
+type networkCapsChangedEvent struct{ ifname string }
+
+// captivePortalEvent 强制门户探测结果，由 captiveProber 发布；ifname 为空表示断网。
+type captivePortalEvent struct {
+	ifname string
+	found  bool
+}
+
+// policyChangedEvent 系统策略发生变化。
+type policyChangedEvent struct{}
+
+// directFileRootEvent 对应 SetDirectFileRoot。
+type directFileRootEvent struct{ path string }
+
+// shareFileHelperEvent 对应 SetShareFileHelper。
+type shareFileHelperEvent struct{ helper ShareFileHelper }
+
+// newAppEvents 创建事件分发器。
+func newAppEvents() *appEvents {
+	return &appEvents{
+		backend: newEventQueue[any](0),
+		fileOps: newEventQueue[any](0),
+		logs:    newEventQueue[string](logQueueLimit),
+	}
+}
+
+// close 关闭所有队列，之后的发布会被丢弃。
+func (e *appEvents) close() {
+	e.backend.close()
+	e.fileOps.close()
+	e.logs.close()
+}
+
+// eventQueue 是无阻塞发布、按序消费的事件队列。
+// 发布方只追加到内存队列；单个 pump 协程按顺序把事件送入 C()。
+type eventQueue[T any] struct {
+	limit int // 最大长度，0 表示不限；超出时丢弃最旧的事件
+
+	out  chan T
+	done chan struct{}
+
+	mu     sync.Mutex
+	items  []T
+	signal chan struct{}
+	closed bool
+}
+
+// newEventQueue 创建事件队列并启动 pump 协程。
+func newEventQueue[T any](limit int) *eventQueue[T] {
+	q := &eventQueue[T]{
+		limit:  limit,
+		out:    make(chan T),
+		done:   make(chan struct{}),
+		signal: make(chan struct{}, 1),
+	}
+	go q.pump()
+	return q
+}
+
+// publish 追加事件，永不阻塞。返回 false 表示队列已关闭或有旧事件被丢弃。
+func (q *eventQueue[T]) publish(v T) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	ok := true
+	if q.limit > 0 && len(q.items) >= q.limit {
+		copy(q.items, q.items[1:])
+		q.items = q.items[:len(q.items)-1]
+		ok = false
+	}
+	q.items = append(q.items, v)
+	q.mu.Unlock()
 
-// OnDNSConfigChanged 通知 Go 层网络发生变化，需要更新 DNS 配置。
-// ifname: 网络接口名，断网时为空字符串。
-func OnDNSConfigChanged(ifname string) {
-	// 非阻塞发送接口名到 onDNSConfigChanged 通道，通道满则丢弃
 	select {
-	case onDNSConfigChanged <- ifname:
-		// 成功发送
+	case q.signal <- struct{}{}:
 	default:
-		// 通道已满，丢弃本次变更
+	}
+	return ok
+}
+
+// C 返回按发布顺序输出事件的通道，队列关闭后该通道随之关闭。
+func (q *eventQueue[T]) C() <-chan T {
+	return q.out
+}
+
+// close 停止 pump 协程，未投递的事件被丢弃。
+func (q *eventQueue[T]) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		q.items = nil
+		close(q.done)
+	}
+}
+
+// pump 逐个取出事件并送入 out，上一条被消费前不会发送下一条。
+func (q *eventQueue[T]) pump() {
+	defer close(q.out)
+	for {
+		q.mu.Lock()
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			select {
+			case <-q.signal:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		v := q.items[0]
+		var zero T
+		q.items[0] = zero
+		q.items = q.items[1:]
+		q.mu.Unlock()
+
+		select {
+		case q.out <- v:
+		case <-q.done:
+			return
+		}
 	}
 }
 
-// android 结构体用于存储全局 Android App 上下文。
+// android 结构体保存当前接收 Java 回调的 App。
+// Java 侧通过包级函数（RequestVPN 等）发布事件，这些事件只会进入当前 App 的分发器。
 var android struct {
 	// mu 保护结构体所有字段的互斥锁。
 	mu sync.Mutex
 
-	// appCtx 全局 Android App context。
-	appCtx AppContext
+	// app 最近一次 Start 创建的 App，尚未启动时为 nil。
+	app *App
+}
+
+// setCurrentApp 将 a 设为接收 Java 回调的 App。
+func setCurrentApp(a *App) {
+	android.mu.Lock()
+	defer android.mu.Unlock()
+	android.app = a
+}
+
+// setCurrentAppIf 仅当当前 App 为 old 时替换为 a，避免关闭旧 App 时覆盖新 App。
+func setCurrentAppIf(old, a *App) {
+	android.mu.Lock()
+	defer android.mu.Unlock()
+	if android.app == old {
+		android.app = a
+	}
+}
+
+// currentEvents 返回当前 App 的事件分发器，尚未启动时返回 nil。
+func currentEvents() *appEvents {
+	android.mu.Lock()
+	defer android.mu.Unlock()
+	if android.app == nil {
+		return nil
+	}
+	return android.app.events
+}
+
+// publishBackendEvent 向当前 App 发布后端事件，App 未启动时丢弃并记录日志。
+func publishBackendEvent(ev any) {
+	e := currentEvents()
+	if e == nil {
+		log.Printf("dropping %T: no running App", ev)
+		if _, ok := ev.(networkChangedEvent); ok {
+			metricNetChangeDropped.Add(1)
+		}
+		return
+	}
+	e.backend.publish(ev)
+}
+
+// publishFileOpsEvent 向当前 App 发布文件操作事件，App 未启动时丢弃并记录日志。
+func publishFileOpsEvent(ev any) {
+	e := currentEvents()
+	if e == nil {
+		log.Printf("dropping %T: no running App", ev)
+		return
+	}
+	e.fileOps.publish(ev)
+}
+
+// OnDNSConfigChanged 通知 Go 层网络发生变化，需要更新 DNS 配置。
+// ifname: 网络接口名，断网时为空字符串。
+func OnDNSConfigChanged(ifname string) {
+	publishBackendEvent(networkChangedEvent{ifname})
+}
+
+// OnNetworkCapabilitiesChanged 通知 Go 层网络的计费、漫游或强制门户标志发生变化。
+// ifname: 能力发生变化的网络接口名；只有当前默认网络的变化会生效。
+func OnNetworkCapabilitiesChanged(ifname string) {
+	publishBackendEvent(networkCapsChangedEvent{ifname})
 }
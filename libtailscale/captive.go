@@ -0,0 +1,288 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// captive.go 在默认网络变化后探测强制门户（酒店、机场等需要网页登录的网络）。
+// 探测到门户时设置独立的健康状态并通过通知告知 Android 侧，同时暂缓重建 TUN，
+// 避免门户登录页被 VPN 拦截；门户解除后按暂缓的配置补建 TUN。
+// 探测请求经 netns 拨号，Android 上套接字经 VpnService.protect 绕过隧道；
+// 否则启用出口节点时请求进入隧道，永远看不到门户。
+package libtailscale
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/net/dns"
+	"tailscale.com/net/dnsfallback"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/netns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/wgengine/router"
+)
+
+const (
+	// captiveRecheckInterval 处于门户之后时重新探测的间隔，直到门户解除或网络变化。
+	captiveRecheckInterval = 15 * time.Second
+	// captiveProbeTimeout 单个探测请求的超时，门户通常位于局域网内，无需太长。
+	captiveProbeTimeout = 3 * time.Second
+	// maxCaptiveDERPEndpoints 每次探测使用的 DERP 节点数量上限。
+	maxCaptiveDERPEndpoints = 4
+)
+
+var (
+	// metricCaptiveProbes 强制门户探测次数。
+	metricCaptiveProbes = clientmetric.NewCounter("android_captive_probes")
+	// metricCaptiveDetected 探测到强制门户的次数。
+	metricCaptiveDetected = clientmetric.NewCounter("android_captive_detected")
+)
+
+// argInterface 强制门户所在的接口名，用于 captivePortalWarnable。
+const argInterface health.Arg = "interface"
+
+// captivePortalWarnable 默认网络处于强制门户之后时设置，与 LocalBackend 自身的门户告警相互独立。
+var captivePortalWarnable = health.Register(&health.Warnable{
+	Code:     "android-captive-portal",
+	Title:    "Network requires sign-in",
+	Severity: health.SeverityMedium,
+	Text: func(args health.Args) string {
+		return "The network on " + args[argInterface] + " requires you to sign in through a captive portal. Tailscale will reconnect once you have signed in."
+	},
+})
+
+// captiveEndpoint 强制门户探测端点，正常网络下返回 204。
+type captiveEndpoint struct {
+	url       string
+	challenge bool // 端点回显 X-Tailscale-Challenge，可识别篡改响应头的门户
+}
+
+// captiveEndpoints 返回探测端点：支持 80 端口的 DERP 节点 IP 优先（不依赖 DNS），最后是控制服务器。
+// dm 为空（后端尚未取得 DERP 地图）时使用 dnsfallback 内置的地图。
+func captiveEndpoints(dm *tailcfg.DERPMap) []captiveEndpoint {
+	if dm == nil || len(dm.Regions) == 0 {
+		dm = dnsfallback.GetDERPMap()
+	}
+	var eps []captiveEndpoint
+	for _, id := range dm.RegionIDs() {
+		r := dm.Regions[id]
+		if r.Avoid || r.NoMeasureNoHome {
+			continue
+		}
+		for _, n := range r.Nodes {
+			if len(eps) == maxCaptiveDERPEndpoints {
+				break
+			}
+			if n.IPv4 != "" && n.CanPort80 {
+				eps = append(eps, captiveEndpoint{url: "http://" + n.IPv4 + "/generate_204", challenge: true})
+			}
+		}
+	}
+	return append(eps, captiveEndpoint{url: "http://controlplane.tailscale.com/generate_204"})
+}
+
+// captiveDetector 经 netns 拨号的强制门户探测器。
+type captiveDetector struct {
+	client *http.Client
+}
+
+// newCaptiveDetector 创建探测器；netMon 为 nil（创建失败）时退回普通拨号。
+func newCaptiveDetector(logf logger.Logf, netMon *netmon.Monitor) *captiveDetector {
+	d := &net.Dialer{Timeout: captiveProbeTimeout}
+	var dial func(ctx context.Context, network, addr string) (net.Conn, error) = d.DialContext
+	if netMon != nil {
+		dial = netns.FromDialer(logf, netMon, d).DialContext
+	}
+	return &captiveDetector{client: &http.Client{
+		// 门户以重定向把请求引向登录页，不跟随
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		Transport: &http.Transport{
+			DialContext:       dial,
+			DisableKeepAlives: true,
+		},
+		Timeout: captiveProbeTimeout,
+	}}
+}
+
+// detect 并发请求 dm 中的探测端点，任一端点的响应不符合预期即认为处于门户之后；请求失败不视为门户。
+func (d *captiveDetector) detect(ctx context.Context, dm *tailcfg.DERPMap) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eps := captiveEndpoints(dm)
+	results := make(chan bool, len(eps))
+	for _, ep := range eps {
+		go func() { results <- d.probe(ctx, ep) }()
+	}
+	for range eps {
+		if <-results {
+			return true
+		}
+	}
+	return false
+}
+
+// probe 请求单个端点，报告响应是否像门户。
+func (d *captiveDetector) probe(ctx context.Context, ep captiveEndpoint) bool {
+	req, err := http.NewRequestWithContext(ctx, "GET", ep.url, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Cache-Control", "no-cache, no-store, must-revalidate, no-transform, max-age=0")
+	chal := "ts_" + req.URL.Host
+	if ep.challenge {
+		req.Header.Set("X-Tailscale-Challenge", chal)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return true
+	}
+	return ep.challenge && resp.Header.Get("X-Tailscale-Response") != "response "+chal
+}
+
+// captiveProber 在后台探测强制门户。每次网络变化取消上一次探测，结果以 captivePortalEvent 发布给主循环。
+type captiveProber struct {
+	detect  func(ctx context.Context, dm *tailcfg.DERPMap) bool
+	derpMap func() *tailcfg.DERPMap
+	publish func(captivePortalEvent)
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // 当前探测的取消函数，未在探测时为 nil
+}
+
+// start 取消上一次探测，并对 ifname 开始新的探测；ifname 为空（断网）时只取消。
+// 探测到门户后每隔 captiveRecheckInterval 重新探测，直到门户解除或再次调用 start/stop。
+func (p *captiveProber) start(ifname string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+	if ifname == "" {
+		p.publish(captivePortalEvent{})
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	go p.run(ctx, ifname)
+}
+
+// stop 取消正在进行的探测。
+func (p *captiveProber) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+}
+
+// run 探测 ifname 所在网络，直到未发现门户或 ctx 被取消。
+func (p *captiveProber) run(ctx context.Context, ifname string) {
+	for {
+		metricCaptiveProbes.Add(1)
+		found := p.detect(ctx, p.derpMap())
+		if ctx.Err() != nil {
+			return
+		}
+		if found {
+			metricCaptiveDetected.Add(1)
+		}
+		p.publish(captivePortalEvent{ifname: ifname, found: found})
+		if !found {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(captiveRecheckInterval):
+		}
+	}
+}
+
+// onNetMonChange 默认路由接口变化或设备从休眠中恢复时重新探测，由 netmon 回调调用。
+func (p *captiveProber) onNetMonChange(delta *netmon.ChangeDelta) {
+	if delta.Old != nil && !delta.TimeJumped && delta.Old.DefaultRouteInterface == delta.New.DefaultRouteInterface {
+		return
+	}
+	p.start(delta.New.DefaultRouteInterface)
+}
+
+// currentDERPMap 返回当前后端的 DERP 地图，用于选择门户探测端点；后端未就绪时返回 nil。
+func (a *App) currentDERPMap() *tailcfg.DERPMap {
+	a.backendMu.Lock()
+	lb := a.backend
+	a.backendMu.Unlock()
+	if lb == nil {
+		return nil
+	}
+	return lb.DERPMap()
+}
+
+// handleCaptivePortal 在主循环中处理探测结果：更新网络状态与健康状态，门户解除时补建暂缓的 TUN。
+// Android 侧报告的 NET_CAPABILITY_CAPTIVE_PORTAL 同样视为处于门户之后。
+// 返回补建 TUN 的错误。
+func (b *backend) handleCaptivePortal(ev captivePortalEvent) error {
+	cur := b.network.get()
+	if ev.ifname != "" && cur.Interface != "" && ev.ifname != cur.Interface {
+		// 已切换到其他网络，丢弃过期结果
+		return nil
+	}
+	detected := ev.found || cur.CaptivePortal
+	b.network.update(func(s *networkStatus) {
+		s.PortalDetected = ev.found
+	})
+	if b.sys != nil {
+		ht := b.sys.HealthTracker()
+		if detected {
+			ht.SetUnhealthy(captivePortalWarnable, health.Args{argInterface: ev.ifname})
+		} else {
+			ht.SetHealthy(captivePortalWarnable)
+		}
+	}
+	if detected {
+		log.Printf("captive: portal detected on %q, holding TUN", ev.ifname)
+		return nil
+	}
+	return b.releaseCaptiveHold()
+}
+
+// captivePortalActive 报告默认网络当前是否处于强制门户之后。
+func (b *backend) captivePortalActive() bool {
+	s := b.network.get()
+	return s.PortalDetected || s.CaptivePortal
+}
+
+// holdForCaptivePortal 处于门户之后时记录待建立的配置并返回 true，由 updateTUN 调用。
+func (b *backend) holdForCaptivePortal(rcfg *router.Config, dcfg *dns.OSConfig) bool {
+	if !b.captivePortalActive() {
+		return false
+	}
+	b.heldRcfg, b.heldDcfg = rcfg, dcfg
+	b.network.update(func(s *networkStatus) { s.TUNHeld = true })
+	return true
+}
+
+// releaseCaptiveHold 门户解除后按暂缓的配置建立 TUN。
+func (b *backend) releaseCaptiveHold() error {
+	rcfg, dcfg := b.heldRcfg, b.heldDcfg
+	if rcfg == nil {
+		return nil
+	}
+	b.heldRcfg, b.heldDcfg = nil, nil
+	b.network.update(func(s *networkStatus) { s.TUNHeld = false })
+	if !b.hasTUNProvider() {
+		return nil
+	}
+	log.Printf("captive: portal cleared, establishing held TUN")
+	return b.updateTUN(rcfg, dcfg)
+}
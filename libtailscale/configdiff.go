@@ -0,0 +1,160 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// configdiff.go 对路由与 DNS 配置做语义比较，只有影响 VpnService.Builder 参数的变化才重建 TUN。
+// 路由顺序、Android 不使用的字段等差异被忽略。dns.Manager 在调用 SetDNS 之前已更新 quad-100 解析器，
+// 因此系统 DNS 经由 quad-100 时，DNS 变化由解析器直接生效，无需重建；
+// 只有系统 DNS 入口本身变化（是否经由 quad-100、Split DNS 开关）才需要重新下发 DNS 服务器。
+package libtailscale
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"tailscale.com/net/dns"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/wgengine/router"
+)
+
+// configChange 按类别记录配置变化，可按位组合。
+type configChange uint8
+
+const (
+	changeAddrs    configChange = 1 << iota // TUN 本地地址
+	changeRoutes                            // 路由或排除路由
+	changeDNS                               // 系统 DNS 入口不变时的服务器，由解析器生效
+	changeMTU                               // 路由配置中的 MTU
+	changeResolver                          // 仅 quad-100 解析器的匹配域
+	changeDNSEntry                          // 系统 DNS 入口：是否经由 quad-100、Split DNS 开关、直连的服务器或搜索域
+)
+
+// changeRebuild 需要重新建立 TUN 的变化。changeDNS 与 changeResolver 只需更新解析器，见 backend.updateResolver。
+const changeRebuild = changeAddrs | changeRoutes | changeMTU | changeDNSEntry
+
+// needsRebuild 报告变化是否需要重新建立 TUN。
+func (c configChange) needsRebuild() bool {
+	return c&changeRebuild != 0
+}
+
+// String 返回以 "|" 分隔的变化类别，便于日志输出。
+func (c configChange) String() string {
+	if c == 0 {
+		return "none"
+	}
+	var parts []string
+	for _, n := range []struct {
+		bit  configChange
+		name string
+	}{
+		{changeAddrs, "addrs"},
+		{changeRoutes, "routes"},
+		{changeDNS, "dns"},
+		{changeMTU, "mtu"},
+		{changeResolver, "resolver"},
+		{changeDNSEntry, "dns-entry"},
+	} {
+		if c&n.bit != 0 {
+			parts = append(parts, n.name)
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// diffConfig 比较新旧配置并返回变化类别。旧路由配置为 nil（尚未建立 TUN）时视为全部变化。
+func diffConfig(oldR, newR *router.Config, oldD, newD *dns.OSConfig) configChange {
+	var c configChange
+	if oldR == nil || newR == nil {
+		if oldR != newR {
+			c |= changeAddrs | changeRoutes | changeMTU
+		}
+	} else {
+		if !prefixSetEqual(oldR.LocalAddrs, newR.LocalAddrs, false) {
+			c |= changeAddrs
+		}
+		if !prefixSetEqual(oldR.Routes, newR.Routes, true) || !prefixSetEqual(oldR.LocalRoutes, newR.LocalRoutes, true) {
+			c |= changeRoutes
+		}
+		if oldR.NewMTU != newR.NewMTU {
+			c |= changeMTU
+		}
+	}
+	return c | diffDNSConfig(oldD, newD)
+}
+
+// diffDNSConfig 比较 DNS 配置。两边都经由 quad-100 且 Split DNS 开关不变时，服务器的变化记为 changeDNS，
+// 匹配域按集合比较记为 changeResolver；否则 Android 直接查询下发的服务器，服务器变化记为 changeDNSEntry。
+// 搜索域通过 VpnService.Builder 交给系统，只能随 TUN 重建生效，变化总是记为 changeDNSEntry。
+// 服务器按序比较（Split DNS 依赖 quad-100 排第一）。
+func diffDNSConfig(oldD, newD *dns.OSConfig) configChange {
+	if oldD == nil || newD == nil {
+		if oldD != newD {
+			return changeDNSEntry
+		}
+		return 0
+	}
+	var c configChange
+	nsChanged := !slices.Equal(oldD.Nameservers, newD.Nameservers)
+	if (len(oldD.MatchDomains) == 0) != (len(newD.MatchDomains) == 0) ||
+		(nsChanged && !(viaQuad100(oldD) && viaQuad100(newD))) {
+		c |= changeDNSEntry
+	} else if nsChanged {
+		c |= changeDNS
+	}
+	if !slices.Equal(oldD.SearchDomains, newD.SearchDomains) {
+		c |= changeDNSEntry
+	}
+	if !fqdnSetEqual(oldD.MatchDomains, newD.MatchDomains) {
+		c |= changeResolver
+	}
+	return c
+}
+
+// viaQuad100 报告系统 DNS 是否首先查询 quad-100 解析器。
+func viaQuad100(d *dns.OSConfig) bool {
+	if len(d.Nameservers) == 0 {
+		return false
+	}
+	ip := d.Nameservers[0]
+	return ip == tsaddr.TailscaleServiceIP() || ip == tsaddr.TailscaleServiceIPv6()
+}
+
+// prefixSetEqual 按集合比较两组前缀，忽略顺序与重复；masked 为 true 时先标准化掩码。
+func prefixSetEqual(a, b []netip.Prefix, masked bool) bool {
+	norm := func(ps []netip.Prefix) map[netip.Prefix]bool {
+		m := make(map[netip.Prefix]bool, len(ps))
+		for _, p := range ps {
+			if masked {
+				p = p.Masked()
+			}
+			m[p] = true
+		}
+		return m
+	}
+	ma, mb := norm(a), norm(b)
+	if len(ma) != len(mb) {
+		return false
+	}
+	for p := range ma {
+		if !mb[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// fqdnSetEqual 按集合比较两组域名，忽略顺序与重复。
+func fqdnSetEqual(a, b []dnsname.FQDN) bool {
+	for _, d := range a {
+		if !slices.Contains(b, d) {
+			return false
+		}
+	}
+	for _, d := range b {
+		if !slices.Contains(a, d) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"testing"
+
+	"tailscale.com/net/dns"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/wgengine/router"
+)
+
+func TestDiffConfig(t *testing.T) {
+	rcfg := &router.Config{
+		LocalAddrs: prefixes("100.64.0.1/32"),
+		Routes:     prefixes("100.64.0.0/10", "10.1.0.0/16"),
+		NewMTU:     1280,
+	}
+	quad100DNS := &dns.OSConfig{
+		Nameservers:   addrs("100.100.100.100"),
+		SearchDomains: []dnsname.FQDN{"example.ts.net."},
+	}
+	tests := []struct {
+		name        string
+		oldR, newR  *router.Config
+		oldD, newD  *dns.OSConfig
+		want        configChange
+		wantRebuild bool
+	}{
+		{
+			name: "identical",
+			oldR: rcfg, newR: rcfg,
+			oldD: quad100DNS, newD: quad100DNS,
+		},
+		{
+			name: "no TUN yet",
+			newR: rcfg,
+			oldD: quad100DNS, newD: quad100DNS,
+			want:        changeAddrs | changeRoutes | changeMTU,
+			wantRebuild: true,
+		},
+		{
+			name: "route order and masking",
+			oldR: rcfg,
+			newR: &router.Config{
+				LocalAddrs: prefixes("100.64.0.1/32"),
+				Routes:     prefixes("10.1.2.3/16", "100.64.0.0/10"),
+				NewMTU:     1280,
+			},
+		},
+		{
+			name: "routes",
+			oldR: rcfg,
+			newR: &router.Config{
+				LocalAddrs: prefixes("100.64.0.1/32"),
+				Routes:     prefixes("100.64.0.0/10"),
+				NewMTU:     1280,
+			},
+			want:        changeRoutes,
+			wantRebuild: true,
+		},
+		{
+			name: "search domains through quad-100",
+			oldR: rcfg, newR: rcfg,
+			oldD: quad100DNS,
+			newD: &dns.OSConfig{
+				Nameservers:   addrs("100.100.100.100"),
+				SearchDomains: []dnsname.FQDN{"corp.example.com."},
+			},
+			want:        changeDNSEntry,
+			wantRebuild: true,
+		},
+		{
+			name: "search domains added to direct nameservers",
+			oldR: rcfg, newR: rcfg,
+			oldD:        &dns.OSConfig{Nameservers: addrs("8.8.8.8")},
+			newD:        &dns.OSConfig{Nameservers: addrs("8.8.8.8"), SearchDomains: []dnsname.FQDN{"example.ts.net."}},
+			want:        changeDNSEntry,
+			wantRebuild: true,
+		},
+		{
+			name: "search domains and nameservers behind quad-100",
+			oldR: rcfg, newR: rcfg,
+			oldD: quad100DNS,
+			newD: &dns.OSConfig{
+				Nameservers:   addrs("100.100.100.100", "fd7a:115c:a1e0::53"),
+				SearchDomains: []dnsname.FQDN{"corp.example.com."},
+			},
+			want:        changeDNSEntry | changeDNS,
+			wantRebuild: true,
+		},
+		{
+			name: "nameservers behind quad-100",
+			oldR: rcfg, newR: rcfg,
+			oldD: quad100DNS,
+			newD: &dns.OSConfig{
+				Nameservers:   addrs("100.100.100.100", "fd7a:115c:a1e0::53"),
+				SearchDomains: []dnsname.FQDN{"example.ts.net."},
+			},
+			want: changeDNS,
+		},
+		{
+			name: "match domains",
+			oldR: rcfg, newR: rcfg,
+			oldD: &dns.OSConfig{Nameservers: addrs("100.100.100.100"), MatchDomains: []dnsname.FQDN{"ts.net."}},
+			newD: &dns.OSConfig{Nameservers: addrs("100.100.100.100"), MatchDomains: []dnsname.FQDN{"corp.example.com.", "ts.net."}},
+			want: changeResolver,
+		},
+		{
+			name: "split DNS turned on",
+			oldR: rcfg, newR: rcfg,
+			oldD:        quad100DNS,
+			newD:        &dns.OSConfig{Nameservers: addrs("100.100.100.100"), MatchDomains: []dnsname.FQDN{"ts.net."}},
+			want:        changeDNSEntry | changeResolver,
+			wantRebuild: true,
+		},
+		{
+			name: "direct nameservers",
+			oldR: rcfg, newR: rcfg,
+			oldD:        &dns.OSConfig{Nameservers: addrs("8.8.8.8")},
+			newD:        &dns.OSConfig{Nameservers: addrs("1.1.1.1")},
+			want:        changeDNSEntry,
+			wantRebuild: true,
+		},
+		{
+			name: "switch to quad-100",
+			oldR: rcfg, newR: rcfg,
+			oldD:        &dns.OSConfig{Nameservers: addrs("8.8.8.8")},
+			newD:        &dns.OSConfig{Nameservers: addrs("100.100.100.100")},
+			want:        changeDNSEntry,
+			wantRebuild: true,
+		},
+		{
+			name: "DNS turned off",
+			oldR: rcfg, newR: rcfg,
+			oldD:        quad100DNS,
+			want:        changeDNSEntry,
+			wantRebuild: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := diffConfig(tt.oldR, tt.newR, tt.oldD, tt.newD)
+			if c != tt.want {
+				t.Errorf("diffConfig = %v, want %v", c, tt.want)
+			}
+			if c.needsRebuild() != tt.wantRebuild {
+				t.Errorf("%v.needsRebuild() = %v, want %v", c, c.needsRebuild(), tt.wantRebuild)
+			}
+		})
+	}
+}
+
+// TestUpdateResolver 无需重建的变化只更新记录，判断本身不修改状态。
+func TestUpdateResolver(t *testing.T) {
+	rcfg := &router.Config{LocalAddrs: prefixes("100.64.0.1/32")}
+	oldD := &dns.OSConfig{Nameservers: addrs("100.100.100.100")}
+	newD := &dns.OSConfig{Nameservers: addrs("100.100.100.100", "fd7a:115c:a1e0::53")}
+	b := &backend{
+		lockdown:   newLockdownState(nil),
+		lastCfg:    rcfg,
+		lastDNSCfg: oldD,
+	}
+	if b.isConfigNonNilAndDifferent(rcfg, newD) {
+		t.Fatal("nameserver change behind quad-100 needs a TUN rebuild")
+	}
+	if b.lastDNSCfg != oldD {
+		t.Fatal("isConfigNonNilAndDifferent modified lastDNSCfg")
+	}
+	if err := b.updateConfig(rcfg, newD); err != nil {
+		t.Fatalf("updateConfig: %v", err)
+	}
+	if b.lastCfg != rcfg || b.lastDNSCfg != newD {
+		t.Errorf("after updateConfig: lastCfg %p, lastDNSCfg %p; want %p, %p", b.lastCfg, b.lastDNSCfg, rcfg, newD)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// dnsfallback.go 决定平台没有可用 DNS 时使用的兜底解析器。
+// 兜底列表依次取自 DNSFallbackResolvers 策略、用户设置（stateStore）与构建配置（Google DNS）。
+// 列表元素只能是内置列表名或 IP 地址，兜底解析器均为普通 DNS（UDP/TCP 53）。
+//
+// 不支持 DNS-over-HTTPS 与 DNS-over-TLS 上游：DNS 管理器从 GetBaseConfig 只接收 IP 列表
+// （dns.OSConfig.Nameservers），无法携带 URL，Go 侧也没有可以代理任意 DoH/DoT 地址的转发器。
+// https:// 与 tls:// 元素作为不支持的元素拒绝，并设置 dnsFallbackWarnable。
+package libtailscale
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"tailscale.com/health"
+	"tailscale.com/util/syspolicy"
+)
+
+const (
+	// dnsFallbackPolicyKey 逗号分隔的兜底 DNS 列表，格式见 parseDNSFallbackList，优先于用户设置。
+	dnsFallbackPolicyKey = "DNSFallbackResolvers"
+	// dnsFallbackPrefKey 用户设置的兜底 DNS 列表，保存在 stateStore 中。
+	dnsFallbackPrefKey = "dnsfallbackresolvers"
+	// dnsFallbackEndpoint 读取（GET）或设置（PUT）用户兜底 DNS 列表的 Android 扩展 LocalAPI。
+	dnsFallbackEndpoint = "/localapi/v0/android/dns-fallback"
+)
+
+// dnsFallbackLists 内置的兜底 DNS 列表。
+var dnsFallbackLists = map[string][]netip.Addr{
+	"google": googleDNSServers,
+	"cloudflare": {
+		netip.MustParseAddr("1.1.1.1"),
+		netip.MustParseAddr("1.0.0.1"),
+		netip.MustParseAddr("2606:4700:4700::1111"),
+		netip.MustParseAddr("2606:4700:4700::1001"),
+	},
+	"quad9": {
+		netip.MustParseAddr("9.9.9.9"),
+		netip.MustParseAddr("149.112.112.112"),
+		netip.MustParseAddr("2620:fe::fe"),
+		netip.MustParseAddr("2620:fe::9"),
+	},
+	"none": nil,
+}
+
+// argResolver 不支持的兜底解析器，用于 dnsFallbackWarnable。
+const argResolver health.Arg = "resolver"
+
+// dnsFallbackWarnable 兜底列表中有不支持的元素（包括 DoH/DoT 上游）时设置。
+var dnsFallbackWarnable = health.Register(&health.Warnable{
+	Code:     "android-dns-fallback-unsupported",
+	Title:    "Unsupported fallback DNS resolver",
+	Severity: health.SeverityLow,
+	Text: func(args health.Args) string {
+		return fmt.Sprintf("The fallback DNS resolvers %s are not supported and were skipped. Use IP addresses or google, cloudflare, quad9 or none; DNS-over-HTTPS and DNS-over-TLS resolvers are not supported.", args[argResolver])
+	},
+})
+
+// dnsFallback 解析后的兜底 DNS。
+type dnsFallback struct {
+	// servers 兜底服务器。
+	servers []netip.Addr
+	// builtin 来自构建配置的默认 Google DNS，而非策略或用户设置。
+	builtin bool
+	// unsupported 无法识别或不支持的元素。
+	unsupported []string
+}
+
+// dnsFallbackSpec 返回当前生效的兜底列表配置：策略优先，其次用户设置；都未配置时 ok 为 false。
+func (b *backend) dnsFallbackSpec() (spec string, ok bool) {
+	if b.policy != nil {
+		s, err := b.policy.ReadString(dnsFallbackPolicyKey)
+		if err == nil {
+			return s, true
+		}
+		if !errors.Is(err, syspolicy.ErrNoSuchKey) {
+			log.Printf("dnsFallback: read %s policy: %v", dnsFallbackPolicyKey, err)
+		}
+	}
+	if b.store != nil {
+		s, err := b.store.ReadString(dnsFallbackPrefKey, "")
+		if err != nil {
+			log.Printf("dnsFallback: read %s: %v", dnsFallbackPrefKey, err)
+		}
+		if s != "" {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// dnsFallback 返回当前的兜底 DNS，并按是否有不支持的上游更新健康状态。
+func (b *backend) dnsFallback() dnsFallback {
+	spec, ok := b.dnsFallbackSpec()
+	var fb dnsFallback
+	switch {
+	case ok:
+		fb = parseDNSFallbackList(spec)
+	case b.appCtx.ShouldUseGoogleDNSFallback():
+		fb = dnsFallback{servers: googleDNSServers, builtin: true}
+	}
+	if b.sys != nil {
+		ht := b.sys.HealthTracker()
+		if len(fb.unsupported) > 0 {
+			ht.SetUnhealthy(dnsFallbackWarnable, health.Args{argResolver: strings.Join(fb.unsupported, ", ")})
+		} else {
+			ht.SetHealthy(dnsFallbackWarnable)
+		}
+	}
+	return fb
+}
+
+// parseDNSFallbackList 解析逗号分隔的兜底列表，结果去重并保持顺序。元素可以是：
+//   - 内置列表名：google、cloudflare、quad9、none；
+//   - IP 地址。
+//
+// 其他元素（包括 https:// 与 tls:// 上游）记录日志后跳过，并记入 unsupported。
+func parseDNSFallbackList(s string) dnsFallback {
+	var fb dnsFallback
+	add := func(ips ...netip.Addr) {
+		for _, ip := range ips {
+			if !slices.Contains(fb.servers, ip) {
+				fb.servers = append(fb.servers, ip)
+			}
+		}
+	}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if list, ok := dnsFallbackLists[strings.ToLower(f)]; ok {
+			add(list...)
+			continue
+		}
+		if ip, err := netip.ParseAddr(f); err == nil {
+			add(ip)
+			continue
+		}
+		log.Printf("dnsFallback: unsupported DNS fallback %q", f)
+		fb.unsupported = append(fb.unsupported, f)
+	}
+	return fb
+}
+
+// emptyDNSFallback ChromeOS 下 Tailscale 未提供任何 DNS 时使用的服务器。
+// NAT64 网络只能使用 IPv6 服务器，默认 Google DNS 换成 DNS64 版本。
+func (b *backend) emptyDNSFallback(env netEnv) []netip.Addr {
+	fb := b.dnsFallback()
+	if !env.nat64 {
+		return fb.servers
+	}
+	if fb.builtin {
+		return googleDNS64Servers
+	}
+	var v6 []netip.Addr
+	for _, ip := range fb.servers {
+		if ip.Is6() {
+			v6 = append(v6, ip)
+		}
+	}
+	return v6
+}
+
+// maybeReapplyDNS 兜底列表配置变化时注入网络变化事件，使 DNS 配置重新计算。
+func (b *backend) maybeReapplyDNS() {
+	spec, _ := b.dnsFallbackSpec()
+	if spec == b.lastFallbackSpec {
+		return
+	}
+	b.lastFallbackSpec = spec
+	log.Printf("dnsFallback: resolvers changed to %q, reapplying DNS", spec)
+	if b.netMon != nil {
+		b.netMon.InjectEvent()
+	}
+}
+
+// dnsFallbackPref 处理 dnsFallbackEndpoint，读写用户的兜底 DNS 列表。
+type dnsFallbackPref struct {
+	app *App
+}
+
+// dnsFallbackPrefBody dnsFallbackEndpoint 的请求与响应体。
+type dnsFallbackPrefBody struct {
+	Resolvers string // 逗号分隔的兜底列表，空字符串表示恢复默认
+}
+
+// ServeHTTP GET 返回当前设置；PUT 校验后保存，并通知后端重新计算 DNS 配置。
+func (p dnsFallbackPref) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s, err := p.app.store.ReadString(dnsFallbackPrefKey, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dnsFallbackPrefBody{Resolvers: s})
+	case http.MethodPut:
+		var body dnsFallbackPrefBody
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if fb := parseDNSFallbackList(body.Resolvers); len(fb.unsupported) > 0 {
+			http.Error(w, fmt.Sprintf("unsupported resolvers: %s", strings.Join(fb.unsupported, ", ")), http.StatusBadRequest)
+			return
+		}
+		if err := p.app.store.WriteString(dnsFallbackPrefKey, body.Resolvers); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// 与策略变化走同一路径，后端据此重新计算 DNS 配置
+		p.app.events.backend.publish(policyChangedEvent{})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or PUT", http.StatusMethodNotAllowed)
+	}
+}
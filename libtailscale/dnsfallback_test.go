@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParseDNSFallbackList(t *testing.T) {
+	tests := []struct {
+		name            string
+		in              string
+		want            []netip.Addr
+		wantUnsupported []string
+	}{
+		{name: "empty", in: ""},
+		{name: "none", in: "none"},
+		{name: "blank entries", in: " , ,"},
+		{
+			name: "list name is case insensitive",
+			in:   "Quad9",
+			want: dnsFallbackLists["quad9"],
+		},
+		{
+			name: "IPs keep order",
+			in:   "9.9.9.9, 2001:db8::53 ,1.1.1.1",
+			want: addrs("9.9.9.9", "2001:db8::53", "1.1.1.1"),
+		},
+		{
+			name: "duplicates removed",
+			in:   "1.1.1.1,cloudflare,1.1.1.1",
+			want: dnsFallbackLists["cloudflare"],
+		},
+		{
+			name:            "DoH and DoT are not supported",
+			in:              "https://dns.google/dns-query,tls://one.one.one.one,8.8.8.8",
+			want:            addrs("8.8.8.8"),
+			wantUnsupported: []string{"https://dns.google/dns-query", "tls://one.one.one.one"},
+		},
+		{
+			name:            "unknown names",
+			in:              "opendns,dns.example.com",
+			wantUnsupported: []string{"opendns", "dns.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := parseDNSFallbackList(tt.in)
+			if !slices.Equal(fb.servers, tt.want) {
+				t.Errorf("servers = %v, want %v", fb.servers, tt.want)
+			}
+			if !slices.Equal(fb.unsupported, tt.wantUnsupported) {
+				t.Errorf("unsupported = %q, want %q", fb.unsupported, tt.wantUnsupported)
+			}
+			if fb.builtin {
+				t.Error("parsed list marked as builtin")
+			}
+		})
+	}
+}
+
+// TestDNSFallback 用户设置优先于构建配置的 Google DNS；NAT64 网络只保留 IPv6 服务器。
+func TestDNSFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		pref      string
+		google    bool
+		want      []netip.Addr
+		wantNAT64 []netip.Addr
+	}{
+		{name: "nothing configured"},
+		{
+			name:      "build default",
+			google:    true,
+			want:      googleDNSServers,
+			wantNAT64: googleDNS64Servers,
+		},
+		{
+			name:      "user setting overrides the build default",
+			pref:      "9.9.9.9,2620:fe::fe",
+			google:    true,
+			want:      addrs("9.9.9.9", "2620:fe::fe"),
+			wantNAT64: addrs("2620:fe::fe"),
+		},
+		{
+			name:   "user setting none disables the fallback",
+			pref:   "none",
+			google: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newStateStore(newMemStateStore(), stateStoreMemory)
+			if tt.pref != "" {
+				store.WriteString(dnsFallbackPrefKey, tt.pref)
+			}
+			b := &backend{
+				appCtx: &fakeDNSAppContext{googleFallback: tt.google},
+				store:  store,
+			}
+			if got := b.emptyDNSFallback(netEnv{hasIPv4: true}); !slices.Equal(got, tt.want) {
+				t.Errorf("emptyDNSFallback = %v, want %v", got, tt.want)
+			}
+			if got := b.emptyDNSFallback(netEnv{hasIPv6: true, nat64: true}); !slices.Equal(got, tt.wantNAT64) {
+				t.Errorf("emptyDNSFallback on NAT64 = %v, want %v", got, tt.wantNAT64)
+			}
+		})
+	}
+}
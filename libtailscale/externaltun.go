@@ -0,0 +1,158 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// externaltun.go 允许嵌入方自带 TUN：由外部创建并配置好的 fd 或 tun.Device 直接交给 multiTUN，
+// 不再经过 VpnService.Builder。适用于其他 VPN 协议栈、测试工具以及 Linux 上基于 /dev/net/tun 的回退实现。
+package libtailscale
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/net/dns"
+	"tailscale.com/wgengine/router"
+)
+
+// ExternalTUN 描述由嵌入方创建并配置好的 TUN 设备。
+// 地址与路由由嵌入方负责配置，后端只用它们检查是否覆盖了 Tailscale 下发的配置。
+type ExternalTUN struct {
+	// Device 已打开的 TUN 设备，交给后端后由 multiTUN 负责关闭。
+	Device tun.Device
+	// MTU 设备 MTU，0 表示查询 Device.MTU()。
+	MTU int
+	// Addrs 设备上已配置的本地地址。
+	Addrs []netip.Prefix
+	// Routes 已指向该设备的路由。
+	Routes []netip.Prefix
+}
+
+// externalTUNEvent 对应 AttachTUN/AttachTUNFD/DetachTUN，tun 为 nil 表示解除外部 TUN。
+type externalTUNEvent struct{ tun *ExternalTUN }
+
+// errNoTUNDevice 表示 AttachTUN 未提供设备。
+var errNoTUNDevice = errors.New("libtailscale: external TUN has no device")
+
+// AttachTUN 把嵌入方创建的 TUN 交给后端，取代 VpnService 建立的 TUN。
+// 后端重启时设备随 multiTUN 一起关闭，需要重新调用。
+// gomobile 不支持 tun.Device，Go 嵌入方需将 Application 断言为 *App 后调用。
+func (a *App) AttachTUN(t *ExternalTUN) error {
+	if t == nil || t.Device == nil {
+		return errNoTUNDevice
+	}
+	if a.ctx.Err() != nil {
+		return errAppClosed
+	}
+	a.events.backend.publish(externalTUNEvent{t})
+	return nil
+}
+
+// AttachTUNFD 以已打开的 TUN fd 调用 AttachTUN，fd 的所有权随之转移。
+// mtu: 设备 MTU，<= 0 表示查询设备。
+// addrs、routes: 逗号分隔的 CIDR 列表，为设备上已配置的地址与路由。
+func (a *App) AttachTUNFD(fd int32, mtu int32, addrs, routes string) error {
+	localAddrs, err := parsePrefixList(addrs)
+	if err != nil {
+		return fmt.Errorf("AttachTUNFD: addrs: %w", err)
+	}
+	tunRoutes, err := parsePrefixList(routes)
+	if err != nil {
+		return fmt.Errorf("AttachTUNFD: routes: %w", err)
+	}
+	dev, _, err := tun.CreateUnmonitoredTUNFromFD(int(fd))
+	if err != nil {
+		return fmt.Errorf("AttachTUNFD: %w", err)
+	}
+	return a.AttachTUN(&ExternalTUN{
+		Device: dev,
+		MTU:    max(int(mtu), 0),
+		Addrs:  localAddrs,
+		Routes: tunRoutes,
+	})
+}
+
+// DetachTUN 关闭外部 TUN，之后重新由 VpnService 建立 TUN。
+func (a *App) DetachTUN() {
+	a.events.backend.publish(externalTUNEvent{})
+}
+
+// parsePrefixList 解析逗号分隔的 CIDR 列表，忽略空白项。
+func parsePrefixList(s string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(f)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// hasTUNProvider 报告当前是否有可用的 TUN 来源：VpnService 或外部 TUN。
+func (b *backend) hasTUNProvider() bool {
+	return b.vpn.currentService() != nil || b.external != nil
+}
+
+// attachExternalTUN 在后端主循环中处理 externalTUNEvent。
+// rcfg、dcfg 为当前的路由与 DNS 配置：挂接时检查外部 TUN 是否覆盖，解除时据此重新由 VpnService 建立 TUN。
+// 返回重建 TUN 的错误。
+func (b *backend) attachExternalTUN(t *ExternalTUN, rcfg *router.Config, dcfg *dns.OSConfig) error {
+	if t == nil {
+		if b.external == nil {
+			return nil
+		}
+		log.Printf("attachExternalTUN: detaching external TUN")
+		b.external = nil
+		b.CloseTUNs()
+		if rcfg == nil || b.vpn.currentService() == nil {
+			// 没有配置或 VpnService，等下一次配置事件或 VPN 请求时再建立
+			return nil
+		}
+		return b.updateTUN(rcfg, dcfg)
+	}
+	if b.vpn.currentService() != nil {
+		log.Printf("attachExternalTUN: external TUN replaces the VpnService TUN")
+	}
+	b.external = t
+	b.devices.add(t.Device, t.MTU)
+	b.lockdown.release()
+	b.lastCfg = nil
+	if rcfg != nil {
+		b.checkExternalTUN(rcfg)
+	}
+	return nil
+}
+
+// checkExternalTUN 检查外部 TUN 的地址与路由是否覆盖 rcfg 并记录配置。
+// 外部 TUN 无法由后端重新配置，缺失的部分只记录日志，由嵌入方负责补齐。
+func (b *backend) checkExternalTUN(rcfg *router.Config) {
+	t := b.external
+	for _, a := range rcfg.LocalAddrs {
+		if !containsPrefix(t.Addrs, a) {
+			log.Printf("checkExternalTUN: address %v is not configured on the external TUN", a)
+		}
+	}
+	for _, r := range rcfg.Routes {
+		if !containsPrefix(t.Routes, r.Masked()) {
+			log.Printf("checkExternalTUN: route %v is not covered by the external TUN", r)
+		}
+	}
+	b.lastCfg = rcfg
+}
+
+// containsPrefix 报告 ps 中是否有前缀完全覆盖 p。
+func containsPrefix(ps []netip.Prefix, p netip.Prefix) bool {
+	for _, q := range ps {
+		if q.Bits() <= p.Bits() && q.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
@@ -7,12 +7,17 @@ package libtailscale
 import (
 	"fmt"
 	"io"
+	"sync"
 )
 
 // AndroidFileOps 实现 ShareFileHelper 接口，封装 Android 侧 SAF 文件操作。
 type AndroidFileOps struct {
+	// mu 保护 helper：Java 侧可能在 Taildrop 使用期间重新设置 ShareFileHelper。
+	mu sync.Mutex
 	// helper 持有 Android 侧实现的 ShareFileHelper 实例。
 	helper ShareFileHelper
+	// paused 可选，返回 true 时拒绝接收文件（如蜂窝网络下暂停 Taildrop）。
+	paused func() bool
 }
 
 // NewAndroidFileOps 创建 AndroidFileOps 实例。
@@ -23,22 +28,40 @@ func NewAndroidFileOps(helper ShareFileHelper) *AndroidFileOps {
 	return &AndroidFileOps{helper: helper}
 }
 
+// setHelper 替换 Android 侧 helper，之后的文件操作使用新的 helper。
+func (ops *AndroidFileOps) setHelper(helper ShareFileHelper) {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	ops.helper = helper
+}
+
+// currentHelper 返回当前的 Android 侧 helper。
+func (ops *AndroidFileOps) currentHelper() ShareFileHelper {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	return ops.helper
+}
+
 // OpenFileURI 获取文件的 SAF URI。
 // filename: 文件名。
 // 返回 SAF URI 字符串。
 func (ops *AndroidFileOps) OpenFileURI(filename string) string {
 	// 调用 Android 侧 helper 获取 URI
-	return ops.helper.OpenFileURI(filename)
+	return ops.currentHelper().OpenFileURI(filename)
 }
 
 // OpenFileWriter 打开文件写入流。
 // filename: 文件名。
 // 返回 io.WriteCloser、SAF URI、错误。
 func (ops *AndroidFileOps) OpenFileWriter(filename string) (io.WriteCloser, string, error) {
+	if ops.paused != nil && ops.paused() {
+		return nil, "", errTaildropPaused
+	}
+	helper := ops.currentHelper()
 	// 获取文件 URI
-	uri := ops.helper.OpenFileURI(filename)
+	uri := helper.OpenFileURI(filename)
 	// 获取写入流
-	outputStream := ops.helper.OpenFileWriter(filename)
+	outputStream := helper.OpenFileWriter(filename)
 	if outputStream == nil {
 		// 打开失败，返回错误
 		return nil, uri, fmt.Errorf("failed to open SAF output stream for %s", filename)
@@ -54,7 +77,7 @@ func (ops *AndroidFileOps) OpenFileWriter(filename string) (io.WriteCloser, stri
 // 返回新文件 URI 和错误。
 func (ops *AndroidFileOps) RenamePartialFile(partialUri, targetDirUri, targetName string) (string, error) {
 	// 调用 Android 侧 helper 重命名
-	newURI := ops.helper.RenamePartialFile(partialUri, targetDirUri, targetName)
+	newURI := ops.currentHelper().RenamePartialFile(partialUri, targetDirUri, targetName)
 	if newURI == "" {
 		// 重命名失败
 		return "", fmt.Errorf("failed to rename partial file via SAF")
@@ -0,0 +1,228 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// ifsnapshot.go 定义 Android 侧上报的网络接口快照。优先使用带版本号的 JSON 格式（AppContext.GetInterfacesJSON），
+// 旧版 Android 侧不支持时回退到 GetInterfacesAsString 的文本格式，由 parseLegacyInterfaces 兼容解析。
+package libtailscale
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"tailscale.com/net/netmon"
+)
+
+// interfaceSnapshotVersion 当前支持的快照格式版本。更高版本只按已知字段解析。
+const interfaceSnapshotVersion = 1
+
+// 接口类型，取值与 Android 侧 NetworkCapabilities 的 transport 对应。
+const (
+	ifaceTypeWiFi     = "wifi"
+	ifaceTypeCellular = "cellular"
+	ifaceTypeEthernet = "ethernet"
+	ifaceTypeVPN      = "vpn"
+	ifaceTypeOther    = "other"
+)
+
+// 地址作用域。
+const (
+	scopeHost   = "host"   // 回环地址
+	scopeLink   = "link"   // 链路本地地址
+	scopeSite   = "site"   // 私有地址（RFC 1918、ULA 等）
+	scopeGlobal = "global" // 全局单播地址
+)
+
+// interfaceSnapshot 一次网络接口快照，对应 GetInterfacesJSON 返回的 JSON。
+type interfaceSnapshot struct {
+	Version    int
+	Interfaces []interfaceInfo
+}
+
+// interfaceInfo 单个网络接口。Type、Metered、LinkSpeedKbps、Roaming、CaptivePortal 来自 ConnectivityManager，
+// 接口不属于任何 Android Network 时为空值。
+type interfaceInfo struct {
+	Name         string
+	Index        int
+	MTU          int
+	Up           bool
+	Broadcast    bool
+	Loopback     bool
+	PointToPoint bool
+	Multicast    bool
+
+	Type          string `json:",omitempty"` // wifi、cellular、ethernet、vpn 或 other
+	Metered       bool   `json:",omitempty"` // 是否为按流量计费的网络
+	LinkSpeedKbps int64  `json:",omitempty"` // 下行链路带宽估计，0 表示未知
+	Roaming       bool   `json:",omitempty"` // 蜂窝网络是否处于漫游
+	CaptivePortal bool   `json:",omitempty"` // 网络是否需要登录认证页面
+
+	Addrs []interfaceAddr
+}
+
+// interfaceAddr 接口上的一个地址。
+type interfaceAddr struct {
+	Prefix netip.Prefix
+	Scope  string `json:",omitempty"` // host、link、site 或 global，为空时按地址推算
+}
+
+// parseInterfaceSnapshot 解析 JSON 格式的接口快照，补齐缺失的地址作用域。
+func parseInterfaceSnapshot(b []byte) (*interfaceSnapshot, error) {
+	var s interfaceSnapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("interface snapshot: %w", err)
+	}
+	if s.Version < 1 {
+		return nil, fmt.Errorf("interface snapshot: unsupported version %d", s.Version)
+	}
+	if s.Version > interfaceSnapshotVersion {
+		log.Printf("interface snapshot: version %d is newer than %d, ignoring unknown fields", s.Version, interfaceSnapshotVersion)
+	}
+	for i := range s.Interfaces {
+		for j, a := range s.Interfaces[i].Addrs {
+			if a.Scope == "" {
+				s.Interfaces[i].Addrs[j].Scope = addrScope(a.Prefix.Addr())
+			}
+		}
+	}
+	return &s, nil
+}
+
+// parseLegacyInterfaces 解析旧版文本格式：每行 "name index mtu up broadcast loopback pointToPoint multicast | addr/bits ..."。
+// 名称可能包含空格，因此从右侧取 7 个数值字段，其余部分为名称；以最后一个 "|" 分隔地址列表。
+// 无法解析的行记录日志后跳过。
+func parseLegacyInterfaces(s string) []interfaceInfo {
+	var ifaces []interfaceInfo
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		i := strings.LastIndex(line, "|")
+		if i < 0 {
+			log.Printf("getInterfaces: unable to split %q", line)
+			continue
+		}
+		info, err := parseLegacyInterfaceAttrs(line[:i])
+		if err != nil {
+			log.Printf("getInterfaces: unable to parse %q: %v", line, err)
+			continue
+		}
+		for _, f := range strings.Fields(line[i+1:]) {
+			pfx, err := netip.ParsePrefix(f)
+			if err != nil {
+				continue
+			}
+			info.Addrs = append(info.Addrs, interfaceAddr{Prefix: pfx, Scope: addrScope(pfx.Addr())})
+		}
+		ifaces = append(ifaces, info)
+	}
+	return ifaces
+}
+
+// parseLegacyInterfaceAttrs 解析旧版格式 "|" 之前的接口属性部分。
+func parseLegacyInterfaceAttrs(s string) (interfaceInfo, error) {
+	var info interfaceInfo
+	fields := strings.Fields(s)
+	if len(fields) < 8 {
+		return info, fmt.Errorf("want at least 8 fields, got %d", len(fields))
+	}
+	n := len(fields) - 7
+	info.Name = strings.Join(fields[:n], " ")
+	nums := fields[n:]
+	var err error
+	if info.Index, err = strconv.Atoi(nums[0]); err != nil {
+		return info, err
+	}
+	if info.MTU, err = strconv.Atoi(nums[1]); err != nil {
+		return info, err
+	}
+	for k, dst := range []*bool{&info.Up, &info.Broadcast, &info.Loopback, &info.PointToPoint, &info.Multicast} {
+		if *dst, err = strconv.ParseBool(nums[2+k]); err != nil {
+			return info, err
+		}
+	}
+	return info, nil
+}
+
+// addrScope 按地址推算作用域。
+func addrScope(a netip.Addr) string {
+	switch {
+	case a.IsLoopback():
+		return scopeHost
+	case a.IsLinkLocalUnicast() || a.IsLinkLocalMulticast():
+		return scopeLink
+	case a.IsPrivate():
+		return scopeSite
+	}
+	return scopeGlobal
+}
+
+// netmonInterface 转换为 netmon.Interface。AltAddrs 始终非 nil，避免 Go 使用 netlink。
+func (info interfaceInfo) netmonInterface() netmon.Interface {
+	iface := netmon.Interface{
+		Interface: &net.Interface{
+			Name:  info.Name,
+			Index: info.Index,
+			MTU:   info.MTU,
+		},
+		AltAddrs: []net.Addr{},
+	}
+	if info.Up {
+		iface.Flags |= net.FlagUp
+	}
+	if info.Broadcast {
+		iface.Flags |= net.FlagBroadcast
+	}
+	if info.Loopback {
+		iface.Flags |= net.FlagLoopback
+	}
+	if info.PointToPoint {
+		iface.Flags |= net.FlagPointToPoint
+	}
+	if info.Multicast {
+		iface.Flags |= net.FlagMulticast
+	}
+	for _, a := range info.Addrs {
+		iface.AltAddrs = append(iface.AltAddrs, &net.IPNet{
+			IP:   a.Prefix.Masked().Addr().AsSlice(),
+			Mask: net.CIDRMask(a.Prefix.Bits(), a.Prefix.Addr().BitLen()),
+		})
+	}
+	return iface
+}
+
+// errNoInterfaceJSON 表示 Android 侧未提供 JSON 快照（旧版本），需回退到文本格式。
+var errNoInterfaceJSON = errors.New("interface JSON snapshot not available")
+
+// interfaceSnapshot 获取当前接口快照，优先使用 JSON 格式，失败时回退到旧版文本格式。
+func (a *App) interfaceSnapshot() (*interfaceSnapshot, error) {
+	snap, err := a.interfaceSnapshotJSON()
+	if err == nil {
+		return snap, nil
+	}
+	if !errors.Is(err, errNoInterfaceJSON) {
+		log.Printf("getInterfaces: %v, falling back to text format", err)
+	}
+	s, err := a.appCtx.GetInterfacesAsString()
+	if err != nil {
+		return nil, err
+	}
+	return &interfaceSnapshot{Version: 0, Interfaces: parseLegacyInterfaces(s)}, nil
+}
+
+// interfaceSnapshotJSON 通过 GetInterfacesJSON 获取 JSON 快照。
+func (a *App) interfaceSnapshotJSON() (*interfaceSnapshot, error) {
+	s, err := a.appCtx.GetInterfacesJSON()
+	if err != nil {
+		return nil, fmt.Errorf("GetInterfacesJSON: %w", err)
+	}
+	if s == "" {
+		return nil, errNoInterfaceJSON
+	}
+	return parseInterfaceSnapshot([]byte(s))
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// validScopes parseInterfaceSnapshot 与 parseLegacyInterfaces 填充的地址作用域。
+var validScopes = []string{scopeHost, scopeLink, scopeSite, scopeGlobal}
+
+func FuzzParseInterfaceSnapshot(f *testing.F) {
+	f.Add([]byte(`{"Version":1,"Interfaces":[{"Name":"wlan0","Index":30,"MTU":1500,"Up":true,"Broadcast":true,"Multicast":true,"Type":"wifi","LinkSpeedKbps":86000,"Addrs":[{"Prefix":"192.168.1.23/24","Scope":"site"},{"Prefix":"fe80::1/64"}]}]}`))
+	f.Add([]byte(`{"Version":1,"Interfaces":[{"Name":"rmnet_data0","Index":12,"MTU":1440,"Up":true,"PointToPoint":true,"Type":"cellular","Metered":true,"Roaming":true,"Addrs":[{"Prefix":"2001:db8::5/64"}]},{"Name":"lo","Index":1,"MTU":65536,"Up":true,"Loopback":true,"Addrs":[{"Prefix":"127.0.0.1/8"}]}]}`))
+	f.Add([]byte(`{"Version":2,"Interfaces":[],"Future":{"x":1}}`))
+	f.Add([]byte(`{"Version":0}`))
+	f.Add([]byte(`{"Version":1,"Interfaces":[{"Addrs":[{"Prefix":""}]}]}`))
+	f.Add([]byte(`{"Version":1,"Interfaces":[{"Addrs":[{"Prefix":"1.2.3.4/33"}]}]}`))
+	f.Add([]byte(`null`))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s, err := parseInterfaceSnapshot(b)
+		if err != nil {
+			if s != nil {
+				t.Fatalf("non-nil snapshot with error %v", err)
+			}
+			return
+		}
+		if s.Version < 1 {
+			t.Fatalf("accepted version %d", s.Version)
+		}
+		for _, info := range s.Interfaces {
+			for _, a := range info.Addrs {
+				if a.Scope == "" {
+					t.Fatalf("%s: address %v has no scope", info.Name, a.Prefix)
+				}
+			}
+			iface := info.netmonInterface()
+			if iface.AltAddrs == nil || len(iface.AltAddrs) != len(info.Addrs) {
+				t.Fatalf("%s: netmonInterface has %d addrs, want %d", info.Name, len(iface.AltAddrs), len(info.Addrs))
+			}
+		}
+		// 解析结果重新编码后应解析为同一快照
+		b2, err := json.Marshal(s)
+		if err != nil {
+			t.Fatalf("re-encode: %v", err)
+		}
+		s2, err := parseInterfaceSnapshot(b2)
+		if err != nil {
+			t.Fatalf("re-parse %s: %v", b2, err)
+		}
+		if !reflect.DeepEqual(s, s2) {
+			t.Fatalf("round trip changed snapshot:\n got %+v\nwant %+v", s2, s)
+		}
+	})
+}
+
+// formatLegacyInterfaces 按旧版文本格式输出，用于验证 parseLegacyInterfaces 的往返。
+func formatLegacyInterfaces(ifaces []interfaceInfo) string {
+	var sb strings.Builder
+	for _, info := range ifaces {
+		sb.WriteString(info.Name)
+		for _, n := range []int{info.Index, info.MTU} {
+			sb.WriteString(" " + strconv.Itoa(n))
+		}
+		for _, v := range []bool{info.Up, info.Broadcast, info.Loopback, info.PointToPoint, info.Multicast} {
+			sb.WriteString(" " + strconv.FormatBool(v))
+		}
+		sb.WriteString(" |")
+		for _, a := range info.Addrs {
+			sb.WriteString(" " + a.Prefix.String())
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func FuzzParseLegacyInterfaces(f *testing.F) {
+	f.Add("wlan0 30 1500 true true false false true | 192.168.1.23/24 fe80::1/64\nlo 1 65536 true false true false false | 127.0.0.1/8 ::1/128\n")
+	f.Add("My Wi-Fi 7 1500 true false false false true | 10.0.0.2/8\n")
+	f.Add("weird|name 3 1280 false false false true false | \n")
+	f.Add("rmnet0 12 1440 true false false true false\n")
+	f.Add("short 1 2 true | 1.2.3.4/32\n")
+	f.Add("tun0 x 1500 true false false true false | 100.64.0.1/32\n")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, s string) {
+		ifaces := parseLegacyInterfaces(s)
+		for _, info := range ifaces {
+			if info.Name == "" || strings.TrimSpace(info.Name) != info.Name {
+				t.Fatalf("bad interface name %q", info.Name)
+			}
+			for _, a := range info.Addrs {
+				if !a.Prefix.IsValid() {
+					t.Fatalf("%s: invalid prefix %v", info.Name, a.Prefix)
+				}
+				if !slices.Contains(validScopes, a.Scope) {
+					t.Fatalf("%s: address %v has scope %q", info.Name, a.Prefix, a.Scope)
+				}
+			}
+			info.netmonInterface()
+		}
+		// 解析结果重新输出后应解析为相同的接口
+		again := parseLegacyInterfaces(formatLegacyInterfaces(ifaces))
+		if !reflect.DeepEqual(ifaces, again) {
+			t.Fatalf("round trip changed interfaces:\n got %+v\nwant %+v", again, ifaces)
+		}
+	})
+}
@@ -17,7 +17,13 @@ import (
 // 返回 Application 实例。
 func Start(dataDir, directFileRoot string, appCtx AppContext) Application {
 	// 直接调用内部 start 方法，返回 Application 实例
-	return start(dataDir, directFileRoot, appCtx)
+	return start(dataDir, directFileRoot, appCtx, nil)
+}
+
+// StartWithStateStore 同 Start，但使用 store 保存全部状态，不读取 dataDir 中记录的后端。
+// 用于在设备外运行 Go 后端（例如测试中使用内存后端），gomobile 不导出该函数。
+func StartWithStateStore(dataDir, directFileRoot string, appCtx AppContext, store StateStore) Application {
+	return start(dataDir, directFileRoot, appCtx, store)
 }
 
 // AppContext 提供应用运行的上下文，所有方法均由 Android 侧实现。
@@ -37,6 +43,13 @@ type AppContext interface {
 	// 返回值和错误。
 	DecryptFromPref(key string) (string, error)
 
+	// EncryptToPrefBatch 在一次提交中原子地加密存储多个键值对。
+	// batchJSON: JSON 对象，键为存储键，值为空字符串表示删除该键。
+	EncryptToPrefBatch(batchJSON string) error
+
+	// GetEncryptedPrefKeysJSON 以 JSON 字符串数组返回加密存储中的所有键，用于迁移状态存储后端。
+	GetEncryptedPrefKeysJSON() (string, error)
+
 	// GetOSVersion 获取 Android 版本。
 	GetOSVersion() (string, error)
 
@@ -55,9 +68,17 @@ type AppContext interface {
 	// GetInterfacesAsString 获取所有网络接口字符串。
 	GetInterfacesAsString() (string, error)
 
+	// GetInterfacesJSON 获取带版本号的 JSON 格式网络接口快照（格式见 ifsnapshot.go），
+	// 包含接口类型、是否计费、链路速率与地址作用域。返回空字符串时回退到 GetInterfacesAsString。
+	GetInterfacesJSON() (string, error)
+
 	// GetPlatformDNSConfig 获取当前 DNS 配置字符串。
 	GetPlatformDNSConfig() string
 
+	// GetPlatformDNSConfigJSON 获取带版本号的 JSON 格式平台 DNS 配置（格式见 platformdns.go），
+	// 包含每个网络的 DNS 服务器、接口名与 Private DNS 设置。返回空字符串时回退到 GetPlatformDNSConfig。
+	GetPlatformDNSConfigJSON() (string, error)
+
 	// GetSyspolicyStringValue 获取系统策略字符串值。
 	GetSyspolicyStringValue(key string) (string, error)
 
@@ -66,6 +87,13 @@ type AppContext interface {
 
 	// GetSyspolicyStringArrayJSONValue 获取系统策略字符串数组（JSON）。
 	GetSyspolicyStringArrayJSONValue(key string) (string, error)
+
+	// GetSyspolicyIntegerValue 获取系统策略整数值，值不是整数时返回错误。
+	GetSyspolicyIntegerValue(key string) (int64, error)
+
+	// GetDisallowedPackageNamesJSON 获取不走 Tailscale 的应用包名（JSON），
+	// 格式为 {"BuiltIn": [...], "User": [...]}，策略部分由 Go 侧读取。
+	GetDisallowedPackageNamesJSON() (string, error)
 }
 
 // IPNService 对应 Java 侧的 IPNService。
@@ -93,6 +121,10 @@ type IPNService interface {
 type VPNServiceBuilder interface {
 	// SetMTU 设置 MTU。
 	SetMTU(int32) error
+	// AddAllowedApplication 仅允许指定应用使用 VPN，不能与 AddDisallowedApplication 同时使用。
+	AddAllowedApplication(packageName string) error
+	// AddDisallowedApplication 禁止指定应用使用 VPN。
+	AddDisallowedApplication(packageName string) error
 	// AddDNSServer 添加 DNS 服务器。
 	AddDNSServer(string) error
 	// AddSearchDomain 添加搜索域。
@@ -123,6 +155,22 @@ type Application interface {
 	NotifyPolicyChanged()
 	// WatchNotifications 订阅通知。
 	WatchNotifications(mask int, cb NotificationCallback) NotificationManager
+	// Restart 拆除并重新创建后端，已有的通知订阅会自动挂接到新后端。
+	Restart() error
+	// Shutdown 关闭应用并释放后端、引擎、TUN、代理与日志上传等资源。
+	// timeoutMillis <= 0 时使用默认超时。
+	Shutdown(timeoutMillis int) error
+	// AttachTUNFD 使用嵌入方已打开并配置好的 TUN fd 取代 VpnService 建立的 TUN。
+	// addrs、routes 为逗号分隔的 CIDR 列表，描述设备上已有的地址与路由。
+	AttachTUNFD(fd int32, mtu int32, addrs, routes string) error
+	// DetachTUN 关闭 AttachTUNFD 提供的 TUN。
+	DetachTUN()
+	// MigrateStateStore 把全部状态迁移到 kind 指定的存储后端（prefs 或 file），之后的启动沿用该后端。
+	MigrateStateStore(kind string) error
+	// ExportState 导出用 passphrase 加密的全部状态（含节点身份），企业策略可禁止。
+	ExportState(passphrase string) ([]byte, error)
+	// ImportState 从 ExportState 的备份包恢复全部状态并重启后端。
+	ImportState(data []byte, passphrase string) error
 }
 
 // FileParts 表示多个文件分片。
@@ -155,7 +203,10 @@ type NotificationCallback interface {
 
 // NotificationManager 通知管理器。
 type NotificationManager interface {
+	// Stop 停止监听。
 	Stop()
+	// ResyncNetMap 请求重新全量下发 NetMap，仅在开启 NotifyNetMapDelta 时生效。
+	ResyncNetMap()
 }
 
 // InputStream 适配 Java InputStream。
@@ -183,54 +234,38 @@ type ShareFileHelper interface {
 // RequestVPN 通知 Go 层有新的 VPN 服务需要处理。
 // service: IPNService 实例。
 func RequestVPN(service IPNService) {
-	// 发送 IPNService 实例到全局 onVPNRequested 通道，通知 Go 层有新的 VPN 服务需要处理
-	onVPNRequested <- service
+	// 发布到当前 App 的事件队列，不阻塞 Java 线程
+	publishBackendEvent(vpnRequestedEvent{service})
 }
 
 // ServiceDisconnect 通知 Go 层 VPN 服务已断开。
 // service: IPNService 实例。
 func ServiceDisconnect(service IPNService) {
-	// 发送 IPNService 实例到全局 onDisconnect 通道，通知 Go 层 VPN 服务已断开
-	onDisconnect <- service
+	// 与 RequestVPN 共用同一队列，保证处理顺序与调用顺序一致
+	publishBackendEvent(vpnDisconnectedEvent{service})
 }
 
-// SendLog 发送日志到全局日志通道。
+// SendLog 发送日志到当前 App 的日志队列。
 // logstr: 日志内容字节数组。
 func SendLog(logstr []byte) {
-	// 非阻塞发送日志到 onLog 通道，通道满则丢弃并打印警告
-	select {
-	case onLog <- string(logstr):
-		// 成功发送日志
-	default:
-		// 通道已满，日志未发送，打印警告
-		log.Printf("Log %v not sent", logstr) // 这里 logstr 直接打印字节数组
+	e := currentEvents()
+	if e == nil {
+		return
+	}
+	// 队列满时丢弃最旧的日志并打印警告
+	if !e.logs.publish(string(logstr)) {
+		log.Printf("Log queue full, dropped oldest log")
 	}
 }
 
-// SetShareFileHelper 设置全局 ShareFileHelper 实例。
+// SetShareFileHelper 设置 ShareFileHelper 实例。
 // fileHelper: ShareFileHelper 实例。
 func SetShareFileHelper(fileHelper ShareFileHelper) {
-	// 如果通道已有旧值，先清空，保证只保留最新 helper
-	select {
-	case <-onShareFileHelper:
-		// 已清空旧值
-	default:
-		// 通道本为空，无需处理
-	}
-	// 尝试发送新 helper，若通道仍满则强制清空再发送
-	select {
-	case onShareFileHelper <- fileHelper:
-		// 发送成功
-	default:
-		// 通道仍满，强制清空再发送
-		<-onShareFileHelper
-		onShareFileHelper <- fileHelper
-	}
+	publishFileOpsEvent(shareFileHelperEvent{fileHelper})
 }
 
-// SetDirectFileRoot 设置全局 directFileRoot 路径。
+// SetDirectFileRoot 设置 directFileRoot 路径。
 // filePath: SAF 根路径。
 func SetDirectFileRoot(filePath string) {
-	// 直接发送 SAF 根路径到 onFilePath 通道，供后端监听
-	onFilePath <- filePath
+	publishFileOpsEvent(directFileRootEvent{filePath})
 }
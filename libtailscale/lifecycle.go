@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// lifecycle.go 负责 App 与 backend 的生命周期管理：重启、关闭以及拆除时的资源回收。
+package libtailscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// defaultShutdownTimeout Close 使用的关闭超时。
+const defaultShutdownTimeout = 10 * time.Second
+
+// logtailShutdownTimeout 拆除 backend 时等待日志上传完成的最长时间。
+const logtailShutdownTimeout = 5 * time.Second
+
+// errAppClosed 表示 App 已经关闭，不能再重启。
+var errAppClosed = errors.New("libtailscale: App is shut down")
+
+// Restart 拆除当前后端并重新创建，用于从卡死的后端中恢复而无需杀进程。
+// 已有的 WatchNotifications 订阅会自动挂接到新的后端。
+func (a *App) Restart() error {
+	if a.ctx.Err() != nil {
+		return errAppClosed
+	}
+	log.Printf("Restart: requested")
+	a.requestRestart()
+	return nil
+}
+
+// requestRestart 发出重启信号并取消当前这一次 runBackendOnce。
+func (a *App) requestRestart() {
+	select {
+	case a.backendRestartCh <- struct{}{}:
+	default:
+		// 已有未处理的重启信号
+	}
+	a.backendMu.Lock()
+	cancel := a.runCancel
+	a.backendMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Shutdown 关闭 App：停止所有通知订阅，取消后端上下文，拆除 LocalBackend、引擎、代理、TUN 与日志上传。
+// timeoutMillis: 等待拆除完成的超时时间（毫秒），<= 0 表示使用默认值。
+// 返回拆除过程中的错误；超时返回超时错误，此时拆除仍在后台继续。
+func (a *App) Shutdown(timeoutMillis int) error {
+	timeout := time.Duration(timeoutMillis) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	a.shutdownOnce.Do(func() {
+		log.Printf("Shutdown: start")
+		a.stopWatchers()
+		a.lockdown.setChangedFunc(nil)
+		a.lockdown.release()
+		a.cancel()
+		a.events.close()
+		setCurrentAppIf(a, nil)
+	})
+
+	select {
+	case <-a.runDone:
+	case <-time.After(timeout):
+		return fmt.Errorf("libtailscale: shutdown timed out after %v", timeout)
+	}
+	log.Printf("Shutdown: done, err=%v", a.runErr)
+	return a.runErr
+}
+
+// Close 以默认超时关闭 App。
+func (a *App) Close() {
+	if err := a.Shutdown(0); err != nil {
+		log.Printf("Close: %v", err)
+	}
+}
+
+// stopWatchers 停止所有 WatchNotifications 订阅。
+func (a *App) stopWatchers() {
+	a.backendMu.Lock()
+	watchers := a.watchers
+	a.watchers = nil
+	a.backendMu.Unlock()
+	for _, nm := range watchers {
+		nm.cancel()
+	}
+}
+
+// shutdown 拆除 backend 持有的所有资源，返回过程中遇到的错误。
+// 顺序：代理 -> TUN -> LocalBackend（会一并关闭引擎） -> multiTUN -> netmon -> 日志上传 -> 事件总线。
+func (b *backend) shutdown() error {
+	var errs []error
+
+	b.shutdownOnce.Do(func() {
+		log.Printf("backend: shutting down")
+		close(b.done)
+
+		if b.netChanges != nil {
+			b.netChanges.stop()
+		}
+		if b.captive != nil {
+			b.captive.stop()
+		}
+		stopProxyService()
+		b.CloseTUNs()
+		if b.backend != nil {
+			b.backend.Shutdown()
+		} else if b.engine != nil {
+			// newBackend 中途失败，LocalBackend 尚未接管引擎
+			b.engine.Close()
+		}
+		if b.devices != nil {
+			if err := b.devices.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("close TUN: %w", err))
+			}
+		}
+		if b.netMon != nil {
+			if err := b.netMon.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("close netmon: %w", err))
+			}
+		}
+		if b.logger != nil {
+			// logtail 关闭后日志改回直接写 logcat
+			log.SetOutput(platformLogWriter(b.appCtx))
+			ctx, cancel := context.WithTimeout(context.Background(), logtailShutdownTimeout)
+			if err := b.logger.Shutdown(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("shutdown logtail: %w", err))
+			}
+			cancel()
+		}
+		if b.bus != nil {
+			b.bus.Close()
+		}
+	})
+	return errors.Join(errs...)
+}
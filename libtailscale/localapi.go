@@ -136,6 +136,21 @@ func (app *App) EditPrefs(prefs ipn.MaskedPrefs) (LocalAPIResponse, error) {
 	return app.callLocalAPI(30000, "PATCH", "prefs", nil, r)
 }
 
+// androidHandler 返回 Android 扩展端点的处理器，其他端点返回 nil，交给 LocalAPI 处理。
+func (app *App) androidHandler(endpoint string) http.Handler {
+	switch endpoint {
+	case crashHistoryEndpoint:
+		return app.crashes
+	case dnsFallbackEndpoint:
+		return dnsFallbackPref{app}
+	case networkStatusEndpoint:
+		return networkStatusHandler{app.network}
+	case policyDiagnosticsEndpoint:
+		return policyDiagnosticsHandler{app.policyStore}
+	}
+	return nil
+}
+
 // callLocalAPI 实现本地 API 调用的底层逻辑。
 // timeoutMillis: 超时时间。
 // method: HTTP 方法。
@@ -151,8 +166,18 @@ func (app *App) callLocalAPI(timeoutMillis int, method, endpoint string, header
 		}
 	}()
 
-	// 等待后端就绪
-	app.ready.Wait()
+	// 当前网络下被暂停的功能直接拒绝
+	if err := app.checkNetworkPolicy(endpoint); err != nil {
+		return nil, err
+	}
+
+	// Android 扩展端点不依赖后端，后端反复崩溃时也可查询
+	handler := app.androidHandler(endpoint)
+	if handler == nil {
+		// 等待后端就绪
+		app.ready.Wait()
+		handler = app.localAPIHandler
+	}
 
 	// 设置超时上下文
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(uint64(timeoutMillis)*uint64(time.Millisecond)))
@@ -193,7 +218,7 @@ func (app *App) callLocalAPI(timeoutMillis int, method, endpoint string, header
 		}()
 
 		defer pipeWriter.Close()
-		app.localAPIHandler.ServeHTTP(resp, req)
+		handler.ServeHTTP(resp, req)
 		resp.Flush()
 	}()
 
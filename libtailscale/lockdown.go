@@ -0,0 +1,196 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// lockdown.go 实现锁定模式（kill switch）：TUN 建立失败、重连或后端重启期间保持一个黑洞 TUN，
+// 所有流量进入隧道后直接丢弃，避免泄漏到底层网络，直到后端恢复并建立真正的 TUN。
+package libtailscale
+
+import (
+	"errors"
+	"log"
+	"net/netip"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/util/syspolicy"
+)
+
+// lockdownPolicyKey 为 true 时启用锁定模式，供受监管设备使用。
+const lockdownPolicyKey = "VPNLockdown"
+
+var (
+	// lockdownAddrs 黑洞 TUN 尚不知道 Tailscale 地址时使用的占位地址，
+	// 位于 Tailscale 保留给 quad-100 的网段内，不会分配给任何节点。
+	lockdownAddrs = []netip.Prefix{
+		netip.MustParsePrefix("100.100.100.101/32"),
+		netip.MustParsePrefix("fd7a:115c:a1e0::101/128"),
+	}
+)
+
+// lockdownStatus 锁定模式状态，通过通知的 Lockdown 字段下发给 Android 侧。
+type lockdownStatus struct {
+	Active bool   // 黑洞 TUN 是否正在生效
+	Reason string `json:",omitempty"` // 进入锁定的原因
+}
+
+// lockdownState 由 App 持有的黑洞 TUN 及当前状态。与 VPN 会话一样跟随 VpnService 存在，后端重启时不会被拆除。
+// 所有字段由 mu 保护。
+type lockdownState struct {
+	mu     sync.Mutex
+	dev    *blackholeTUN
+	status lockdownStatus
+	// changed 状态变化时调用，用于唤醒通知订阅者。
+	changed func()
+}
+
+// newLockdownState 创建未锁定的状态，changed 可为 nil。
+func newLockdownState(changed func()) *lockdownState {
+	return &lockdownState{changed: changed}
+}
+
+// blackholeTUN 读取并丢弃 TUN 上的所有数据包。
+type blackholeTUN struct {
+	f *os.File
+}
+
+// newBlackholeTUN 接管 fd 并启动丢弃协程。
+// fd 先设为非阻塞再交给 os.File，由 Go 运行时轮询，Close 才能打断阻塞中的 Read；与 tun.CreateUnmonitoredTUNFromFD 一致。
+func newBlackholeTUN(fd int) (*blackholeTUN, error) {
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	t := &blackholeTUN{f: os.NewFile(uintptr(fd), "lockdown-tun")}
+	go func() {
+		buf := make([]byte, maxTunnelMTU)
+		for {
+			if _, err := t.f.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return t, nil
+}
+
+// Close 关闭 fd，丢弃协程随之退出。
+func (t *blackholeTUN) Close() error {
+	return t.f.Close()
+}
+
+// get 返回当前锁定状态。
+func (l *lockdownState) get() lockdownStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status
+}
+
+// setChangedFunc 设置状态变化回调。
+func (l *lockdownState) setChangedFunc(f func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changed = f
+}
+
+// set 替换黑洞 TUN 与状态，关闭旧的黑洞 TUN 并在状态变化时通知订阅者。
+func (l *lockdownState) set(dev *blackholeTUN, status lockdownStatus) {
+	l.mu.Lock()
+	old := l.dev
+	l.dev = dev
+	changed := l.status != status
+	l.status = status
+	notify := l.changed
+	l.mu.Unlock()
+
+	if old != nil && old != dev {
+		old.Close()
+	}
+	if changed {
+		log.Printf("lockdown: active=%v reason=%q", status.Active, status.Reason)
+		if notify != nil {
+			notify()
+		}
+	}
+}
+
+// release 退出锁定模式。真正的 TUN 建立后，或 VPN 被用户断开、App 关闭时调用。
+func (l *lockdownState) release() {
+	l.set(nil, lockdownStatus{})
+}
+
+// lockdownEnabled 报告 VPNLockdown 策略是否开启，未配置时为关闭。
+func (b *backend) lockdownEnabled() bool {
+	if b.policy == nil {
+		return false
+	}
+	on, err := b.policy.ReadBoolean(lockdownPolicyKey)
+	if err != nil {
+		if !errors.Is(err, syspolicy.ErrNoSuchKey) {
+			log.Printf("lockdown: read %s policy: %v", lockdownPolicyKey, err)
+		}
+		return false
+	}
+	return on
+}
+
+// engageLockdown 建立黑洞 TUN 接管所有流量并关闭现有 TUN。
+// 黑洞 TUN 沿用上一次的 Tailscale 地址与按应用分流规则，DNS 指向 quad-100 同样被丢弃。
+func (b *backend) engageLockdown(reason string) error {
+	service := b.vpn.currentService()
+	if service == nil {
+		return errVPNNotPrepared
+	}
+	builder := service.NewBuilder()
+	if err := builder.SetMTU(defaultMTU); err != nil {
+		return err
+	}
+	addrs := lockdownAddrs
+	if b.lastCfg != nil && len(b.lastCfg.LocalAddrs) > 0 {
+		addrs = b.lastCfg.LocalAddrs
+	}
+	plan := routePlan{
+		addrs:  addrs,
+		routes: []netip.Prefix{tsaddr.AllIPv4(), tsaddr.AllIPv6()},
+	}
+	if err := applyRoutePlan(builder, plan); err != nil {
+		return err
+	}
+	if err := builder.AddDNSServer(tsaddr.TailscaleServiceIP().String()); err != nil {
+		return err
+	}
+	if err := applyAppFilter(builder, b.currentAppFilter()); err != nil {
+		return err
+	}
+	parcelFD, err := builder.Establish()
+	if err != nil {
+		return err
+	}
+	if parcelFD == nil {
+		return errVPNNotPrepared
+	}
+	fd, err := parcelFD.Detach()
+	if err != nil {
+		return err
+	}
+	dev, err := newBlackholeTUN(int(fd))
+	if err != nil {
+		return err
+	}
+	// 黑洞 TUN 已接管路由，旧的 TUN 不再收到流量
+	b.CloseTUNs()
+	b.lockdown.set(dev, lockdownStatus{Active: true, Reason: reason})
+	return nil
+}
+
+// maybeEngageLockdown 在锁定模式开启时进入锁定，返回是否成功进入。
+func (b *backend) maybeEngageLockdown(reason string) bool {
+	if !b.lockdownEnabled() {
+		return false
+	}
+	if err := b.engageLockdown(reason); err != nil {
+		log.Printf("lockdown: engage (%s): %v", reason, err)
+		return false
+	}
+	return true
+}
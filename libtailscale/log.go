@@ -1,6 +1,8 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
+//go:build android
+
 // Gratefully borrowed from Gio UI https://gioui.org/ under MIT license
 // log.go 提供 Android 平台下的日志重定向与适配。
 package libtailscale
@@ -15,11 +17,11 @@ import "C"
 
 import (
 	"bufio"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
-	"runtime/debug"
 	"syscall"
 	"unsafe"
 )
@@ -39,15 +41,18 @@ func initLogging(appCtx AppContext) {
 	// Android logcat 已包含时间戳，去除 Go 日志时间。
 	log.SetFlags(log.Flags() &^ log.LstdFlags)
 	// 设置日志输出为 androidLogWriter
-	log.SetOutput(&androidLogWriter{
-		appCtx: appCtx,
-	})
+	log.SetOutput(platformLogWriter(appCtx))
 
 	// 重定向 stdout 和 stderr 到 Android 日志
 	logFd(os.Stdout.Fd())
 	logFd(os.Stderr.Fd())
 }
 
+// platformLogWriter 返回直接写入 logcat 的日志输出。
+func platformLogWriter(appCtx AppContext) io.Writer {
+	return &androidLogWriter{appCtx: appCtx}
+}
+
 // androidLogWriter 实现 io.Writer，将日志写入 Android logcat。
 type androidLogWriter struct {
 	appCtx AppContext
@@ -84,8 +89,7 @@ func logFd(fd uintptr) {
 	go func() {
 		defer func() {
 			if p := recover(); p != nil {
-				log.Printf("panic in logFd %s: %s", p, debug.Stack())
-				panic(p)
+				reportPanic("logFd", p)
 			}
 		}()
 
@@ -0,0 +1,23 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !android
+
+// log_other.go 非 Android 平台（测试、设备外运行）没有 logcat，日志保持输出到 stderr。
+package libtailscale
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// initLogging 去除 Go 日志自带的时间戳，与 Android 上的格式一致。
+func initLogging(appCtx AppContext) {
+	log.SetFlags(log.Flags() &^ log.LstdFlags)
+}
+
+// platformLogWriter 返回标准错误输出。
+func platformLogWriter(appCtx AppContext) io.Writer {
+	return os.Stderr
+}
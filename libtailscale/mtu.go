@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// mtu.go 负责选择 TUN 设备的 MTU：策略覆盖优先，其次是路由配置，最后根据底层网络接口 MTU 推算。
+package libtailscale
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+
+	"tailscale.com/net/tstun"
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/wgengine/router"
+)
+
+// tunnelMTUPolicyKey 管理员通过该整数策略强制指定 TUN MTU。
+const tunnelMTUPolicyKey = "TunnelMTU"
+
+// maxTunnelMTU TUN MTU 上限，与 wireguard-go 的最大包长保持一致。
+const maxTunnelMTU = int(tstun.MaxPacketSize)
+
+// tunMTU 返回建立 TUN 时使用的 MTU，结果总在 [defaultMTU, maxTunnelMTU] 范围内。
+// 优先级：TunnelMTU 策略 > rcfg.NewMTU > 底层物理接口 MTU 减去 WireGuard 封装开销 > defaultMTU。
+func (b *backend) tunMTU(rcfg *router.Config) int {
+	if mtu, ok := b.policyMTU(); ok {
+		return clampMTU(mtu)
+	}
+	if rcfg != nil && rcfg.NewMTU > 0 {
+		return clampMTU(rcfg.NewMTU)
+	}
+	if mtu, ok := b.probeMTU(); ok {
+		return clampMTU(mtu)
+	}
+	return defaultMTU
+}
+
+// policyMTU 读取 TunnelMTU 策略，未配置、为 0 或读取失败时返回 false。
+func (b *backend) policyMTU() (int, bool) {
+	if b.policy == nil {
+		return 0, false
+	}
+	v, err := b.policy.ReadUInt64(tunnelMTUPolicyKey)
+	if err != nil {
+		if !errors.Is(err, syspolicy.ErrNoSuchKey) {
+			log.Printf("tunMTU: read %s policy: %v", tunnelMTUPolicyKey, err)
+		}
+		return 0, false
+	}
+	if v == 0 {
+		return 0, false
+	}
+	return int(min(v, uint64(maxTunnelMTU))), true
+}
+
+// probeMTU 根据当前已启用的物理接口推算 TUN MTU：取其中最小的接口 MTU，再减去 WireGuard 封装开销。
+// 取最小值是因为 Android 可能在 Wi-Fi 与蜂窝之间随时切换，TUN 在切换后不会立刻重建。
+func (b *backend) probeMTU() (int, bool) {
+	if b.getInterfaces == nil {
+		return 0, false
+	}
+	ifaces, err := b.getInterfaces()
+	if err != nil {
+		log.Printf("tunMTU: getInterfaces: %v", err)
+		return 0, false
+	}
+	wire := 0
+	for _, iface := range ifaces {
+		if iface.Interface == nil || iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if strings.HasPrefix(iface.Name, "tun") {
+			// 跳过 VPN 接口（包括我们自己的 TUN）；蜂窝接口可能是点对点接口，不能按 flag 排除
+			continue
+		}
+		if iface.MTU <= 0 {
+			continue
+		}
+		if wire == 0 || iface.MTU < wire {
+			wire = iface.MTU
+		}
+	}
+	if wire == 0 {
+		return 0, false
+	}
+	return int(tstun.WireToTUNMTU(tstun.WireMTU(wire))), true
+}
+
+// clampMTU 将 MTU 限制在 [defaultMTU, maxTunnelMTU] 范围内，低于 1280 时 IPv6 无法工作。
+func clampMTU(mtu int) int {
+	return max(defaultMTU, min(mtu, maxTunnelMTU))
+}
@@ -7,7 +7,9 @@ package libtailscale
 import (
 	"log"
 	"os"
-	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tailscale/wireguard-go/tun"
 )
@@ -15,30 +17,69 @@ import (
 // multiTUN 实现 tun.Device 接口，支持多个底层 TUN 设备。
 type multiTUN struct {
 	// devices 用于添加新设备。
-	devices chan tun.Device
+	devices chan addRequest
 	// events 汇总所有活跃设备的事件。
 	events chan tun.Event
 
 	close    chan struct{}
 	closeErr chan error
+	// closeOnce 保证 Close 可重复调用：引擎关闭与 backend 拆除都会调用 Close。
+	closeOnce   sync.Once
+	closeResult error
+
+	// readMu 保护 reader 与 readerChanged。
+	// Read 直接读取当前读取设备（最老的设备），不经过 run 主循环。
+	readMu sync.Mutex
+	// reader 当前读取设备，没有设备时为 nil。
+	reader *tunDevice
+	// readerChanged 在 reader 被替换时关闭。
+	readerChanged chan struct{}
 
-	reads        chan ioRequest
 	writes       chan ioRequest
 	mtus         chan chan mtuReply
 	names        chan chan nameReply
 	shutdowns    chan struct{}
 	shutdownDone chan struct{}
+
+	// drainGrace 被取代的设备成为读取设备后保持打开的时长，见 retiredDrainGrace。
+	drainGrace time.Duration
+
+	// failed 在 run 主循环 panic 后关闭，等待应答的调用方不再阻塞；failErr 为对应的错误，关闭前写入。
+	failed  chan struct{}
+	failErr error
 }
 
 // tunDevice 封装单个 tun.Device。
 type tunDevice struct {
 	dev tun.Device
-	// close 关闭设备
+	// mtu 建立设备时通过 VpnService.Builder 配置的 MTU，0 表示未知
+	mtu int
+	// close 通知 runDevice 停止写入
 	close chan struct{}
-	// closeDone 关闭完成通知
-	closeDone chan error
-	// readDone 读协程完成通知
+	// writeDone runDevice 退出通知
+	writeDone chan struct{}
+	// readDone 读取到设备关闭后通知 run 主循环切换读取设备
 	readDone chan struct{}
+	// readDoneOnce 保证 readDone 只通知一次
+	readDoneOnce sync.Once
+	// retired 设备已被新设备取代或已关闭
+	retired atomic.Bool
+
+	// 以下字段只在 run 主循环中访问。
+	// stopped 已调用过 retire
+	stopped bool
+	// closed 底层设备已关闭
+	closed bool
+	// closeAfterWrite 宽限期已到，但 runDevice 尚未退出，退出后再关闭
+	closeAfterWrite bool
+	// graceStarted 已开始宽限期计时
+	graceStarted bool
+}
+
+// addRequest 添加设备请求，mtu 为建立该设备时配置的 MTU。
+type addRequest struct {
+	dev tun.Device
+	mtu int
 }
 
 type ioRequest struct {
@@ -53,6 +94,22 @@ type ioReply struct {
 	err   error
 }
 
+// maxTUNBatchSize multiTUN 对外声明的最大批大小。
+// tstun.Wrapper 在创建时按此值预分配读缓冲（每个 64KiB），之后不会再询问，
+// 因此这里取一个固定上限，实际每次读取的数量受当前设备的 BatchSize 限制。
+const maxTUNBatchSize = 16
+
+// retiredDrainGrace 被取代的设备成为读取设备后继续保持打开的时长。
+// 真实 TUN 的 fd 关闭后内核会丢弃队列中尚未读取的包，因此旧设备不能在取代时立即关闭；
+// 宽限期内 Read 继续读取其中的包，期满后关闭设备并切换到下一个设备。
+const retiredDrainGrace = 200 * time.Millisecond
+
+// ioReplyPool 复用写请求的应答通道，避免每次 Write 分配。
+// 通道带 1 个缓冲，应答方永不阻塞；请求方总会取走应答后再放回。
+var ioReplyPool = sync.Pool{
+	New: func() any { return make(chan ioReply, 1) },
+}
+
 type mtuReply struct {
 	mtu int
 	err error
@@ -66,16 +123,18 @@ type nameReply struct {
 // newTUNDevices 创建 multiTUN 实例。
 func newTUNDevices() *multiTUN {
 	d := &multiTUN{
-		devices:      make(chan tun.Device),
-		events:       make(chan tun.Event),
-		close:        make(chan struct{}),
-		closeErr:     make(chan error),
-		reads:        make(chan ioRequest),
-		writes:       make(chan ioRequest),
-		mtus:         make(chan chan mtuReply),
-		names:        make(chan chan nameReply),
-		shutdowns:    make(chan struct{}),
-		shutdownDone: make(chan struct{}),
+		devices:       make(chan addRequest),
+		events:        make(chan tun.Event),
+		close:         make(chan struct{}),
+		closeErr:      make(chan error),
+		readerChanged: make(chan struct{}),
+		writes:        make(chan ioRequest),
+		mtus:          make(chan chan mtuReply),
+		names:         make(chan chan nameReply),
+		shutdowns:     make(chan struct{}),
+		shutdownDone:  make(chan struct{}),
+		failed:        make(chan struct{}),
+		drainGrace:    retiredDrainGrace,
 	}
 	// 启动主循环
 	go d.run()
@@ -83,80 +142,172 @@ func newTUNDevices() *multiTUN {
 }
 
 // run 主循环，管理设备切换、事件分发等。
+//
+// 设备按添加顺序排列：最新的设备是写入设备，由 runDevice 负责写入；
+// 最老的设备是读取设备，由 Read 直接读取。添加新设备时旧设备才被取代，
+// 因此切换过程中始终至少有一个设备可用，不会出现没有 TUN 的空窗期。
+// 被取代的设备立即停止写入，但保持打开，成为读取设备后再经过 drainGrace 才关闭，
+// 让其中已排队的包仍能读出。Shutdown 与 Close 则立即关闭所有设备。
 func (d *multiTUN) run() {
 	defer func() {
 		if p := recover(); p != nil {
-			log.Printf("panic in multiTUN.run %s: %s", p, debug.Stack())
-			panic(p)
+			d.runFailed(reportPanic("multiTUN.run", p))
 		}
 	}()
 
 	var devices []*tunDevice
 	// readDone 当前读取设备的 readDone 通道
 	var readDone chan struct{}
-	// runDone 当前写入设备的 closeDone 通道
-	var runDone chan error
+	// writer 当前运行 runDevice 的设备，runDone 为其 writeDone 通道
+	var writer *tunDevice
+	var runDone chan struct{}
+	// graceDone 接收宽限期已到的设备
+	graceDone := make(chan *tunDevice)
+
+	// closeDev 关闭底层设备；runDevice 仍在写入时推迟到其退出后关闭。
+	closeDev := func(dev *tunDevice) error {
+		if dev.closed {
+			return nil
+		}
+		if dev == writer {
+			dev.closeAfterWrite = true
+			return nil
+		}
+		dev.closed = true
+		return dev.dev.Close()
+	}
+	// startGrace 被取代的读取设备开始宽限期计时，期满后由主循环关闭。
+	startGrace := func(dev *tunDevice) {
+		if !dev.stopped || dev.closed || dev.graceStarted {
+			return
+		}
+		dev.graceStarted = true
+		time.AfterFunc(d.drainGrace, func() {
+			select {
+			case graceDone <- dev:
+			case <-d.close:
+			}
+		})
+	}
+	// retire 取代设备：停止写入，读取设备开始宽限期计时，其余设备等轮到读取时再计时。
+	retire := func(dev *tunDevice) {
+		if dev.stopped {
+			return
+		}
+		dev.stopped = true
+		dev.retired.Store(true)
+		if dev == writer {
+			close(dev.close)
+		}
+		if len(devices) > 0 && devices[0] == dev {
+			startGrace(dev)
+		}
+	}
+	// startWriter 在没有写入设备时，让最新的设备接管写入。
+	startWriter := func() {
+		if writer != nil || len(devices) == 0 {
+			return
+		}
+		dev := devices[len(devices)-1]
+		if dev.stopped {
+			return
+		}
+		writer = dev
+		runDone = dev.writeDone
+		go d.runDevice(dev)
+	}
+	// retireAll 取代并立即关闭所有设备，返回遇到的最后一个错误。
+	retireAll := func() error {
+		for _, dev := range devices {
+			retire(dev)
+		}
+		if writer != nil {
+			<-runDone
+			writer, runDone = nil, nil
+		}
+		var derr error
+		for _, dev := range devices {
+			if err := closeDev(dev); err != nil {
+				derr = err
+			}
+		}
+		devices = nil
+		readDone = nil
+		d.setReader(nil)
+		return derr
+	}
+
 	for {
 		select {
 		case <-readDone:
-			// 最老设备 EOF，切换下一个
+			// 读取设备已读到关闭，切换到下一个
 			n := copy(devices, devices[1:])
+			devices[n] = nil
 			devices = devices[:n]
+			readDone = nil
 			if len(devices) > 0 {
 				dev := devices[0]
 				readDone = dev.readDone
-				go d.readFrom(dev)
+				d.setReader(dev)
+				startGrace(dev)
+			} else {
+				d.setReader(nil)
 			}
 		case <-runDone:
-			// 写入设备完成，切换下一个
-			if len(devices) > 0 {
-				dev := devices[len(devices)-1]
-				runDone = dev.closeDone
-				go d.runDevice(dev)
+			// 写入设备已停止写入，交给最新的设备
+			prev := writer
+			writer, runDone = nil, nil
+			if prev.closeAfterWrite {
+				if err := closeDev(prev); err != nil {
+					log.Printf("multiTUN: close retired device: %v", err)
+				}
+			}
+			startWriter()
+		case dev := <-graceDone:
+			// 宽限期已到，关闭设备；Read 读到关闭后切换到下一个设备
+			if err := closeDev(dev); err != nil {
+				log.Printf("multiTUN: close retired device: %v", err)
 			}
 		case <-d.shutdowns:
 			// 关闭所有设备
-			for _, dev := range devices {
-				close(dev.close)
-				<-dev.closeDone
-				<-dev.readDone
+			if err := retireAll(); err != nil {
+				log.Printf("multiTUN: shutdown: %v", err)
 			}
-			devices = nil
 			d.shutdownDone <- struct{}{}
 		case <-d.close:
 			// 关闭并返回错误
-			var derr error
-			for _, dev := range devices {
-				if err := <-dev.closeDone; err != nil {
-					derr = err
-				}
-			}
-			d.closeErr <- derr
+			d.closeErr <- retireAll()
 			return
-		case dev := <-d.devices:
-			// 添加新设备
-			if len(devices) > 0 {
-				prev := devices[len(devices)-1]
-				close(prev.close)
-			}
+		case req := <-d.devices:
+			// 添加新设备，新设备就绪后才取代上一个设备
 			wrap := &tunDevice{
-				dev:       dev,
+				dev:       req.dev,
+				mtu:       req.mtu,
 				close:     make(chan struct{}),
-				closeDone: make(chan error),
+				writeDone: make(chan struct{}),
 				readDone:  make(chan struct{}, 1),
 			}
-			if len(devices) == 0 {
-				readDone = wrap.readDone
-				go d.readFrom(wrap)
-				runDone = wrap.closeDone
-				go d.runDevice(wrap)
+			prevMTU := defaultMTU
+			if len(devices) > 0 {
+				prev := devices[len(devices)-1]
+				prevMTU = prev.currentMTU()
+				retire(prev)
 			}
 			devices = append(devices, wrap)
+			if mtu := wrap.currentMTU(); mtu != prevMTU {
+				// MTU 变化，通知 wireguard-go 重新读取 MTU()
+				log.Printf("multiTUN: MTU changed %d -> %d", prevMTU, mtu)
+				go d.sendEvent(tun.EventMTUUpdate)
+			}
+			if len(devices) == 1 {
+				readDone = wrap.readDone
+				d.setReader(wrap)
+			}
+			startWriter()
 		case m := <-d.mtus:
 			r := mtuReply{mtu: defaultMTU}
 			if len(devices) > 0 {
-				dev := devices[len(devices)-1]
-				r.mtu, r.err = dev.dev.MTU()
+				r.mtu = devices[len(devices)-1].currentMTU()
 			}
 			m <- r
 		case n := <-d.names:
@@ -170,67 +321,80 @@ func (d *multiTUN) run() {
 	}
 }
 
-// readFrom 读取数据。
-func (d *multiTUN) readFrom(dev *tunDevice) {
-	defer func() {
-		if p := recover(); p != nil {
-			log.Printf("panic in multiTUN.readFrom %s: %s", p, debug.Stack())
-			panic(p)
-		}
-	}()
-
-	defer func() {
-		dev.readDone <- struct{}{}
-	}()
+// runFailed 在 run 主循环 panic 后接管，继续接收 Close、Shutdown 等请求，避免后端拆除时永久阻塞；
+// 等待应答的调用方经 failed 返回，之后添加的设备直接关闭。err 为 panic 对应的错误，由 Close 返回。
+func (d *multiTUN) runFailed(err error) {
+	d.failErr = err
+	close(d.failed)
 	for {
 		select {
-		case r := <-d.reads:
-			n, err := dev.dev.Read(r.data, r.sizes, r.offset)
-			stop := false
-			if err != nil {
-				select {
-				case <-dev.close:
-					stop = true
-					err = nil
-				default:
-				}
-			}
-			r.reply <- ioReply{n, err}
-			if stop {
-				return
-			}
 		case <-d.close:
+			d.closeErr <- err
 			return
+		case req := <-d.devices:
+			req.dev.Close()
+		case <-d.shutdowns:
+		case <-d.mtus:
+		case <-d.names:
 		}
 	}
 }
 
+// setReader 替换当前读取设备并唤醒等待中的 Read。
+func (d *multiTUN) setReader(dev *tunDevice) {
+	d.readMu.Lock()
+	defer d.readMu.Unlock()
+	d.reader = dev
+	close(d.readerChanged)
+	d.readerChanged = make(chan struct{})
+}
+
+// currentReader 返回当前读取设备，以及该设备被替换时会关闭的通道。
+func (d *multiTUN) currentReader() (*tunDevice, <-chan struct{}) {
+	d.readMu.Lock()
+	defer d.readMu.Unlock()
+	return d.reader, d.readerChanged
+}
+
+// readerDone 通知 run 主循环该设备已读到关闭，可以切换到下一个设备。
+func (dev *tunDevice) readerDone() {
+	dev.readDoneOnce.Do(func() {
+		dev.readDone <- struct{}{}
+	})
+}
+
 // runDevice 处理设备写入和事件。
 func (d *multiTUN) runDevice(dev *tunDevice) {
 	defer func() {
 		if p := recover(); p != nil {
-			log.Printf("panic in multiTUN.runDevice %s: %s", p, debug.Stack())
-			panic(p)
+			reportPanic("multiTUN.runDevice", p)
 		}
 	}()
 
 	defer func() {
-		dev.closeDone <- dev.dev.Close()
+		dev.writeDone <- struct{}{}
 	}()
 	// 事件分发协程
 	go func() {
 		defer func() {
 			if p := recover(); p != nil {
-				log.Printf("panic in multiTUN.readFrom.events %s: %s", p, debug.Stack())
-				panic(p)
+				reportPanic("multiTUN.runDevice.events", p)
 			}
 		}()
 		for {
 			select {
 			case e := <-dev.dev.Events():
-				d.events <- e
+				select {
+				case d.events <- e:
+				case <-dev.close:
+					return
+				case <-d.close:
+					return
+				}
 			case <-dev.close:
 				return
+			case <-d.close:
+				return
 			}
 		}
 	}()
@@ -249,9 +413,31 @@ func (d *multiTUN) runDevice(dev *tunDevice) {
 	}
 }
 
-// add 添加新 tun 设备。
-func (d *multiTUN) add(dev tun.Device) {
-	d.devices <- dev
+// add 添加新 tun 设备，mtu 为建立该设备时配置的 MTU。
+// 新设备成为写入设备，上一个设备随即停止写入，读完或宽限期后关闭；MTU 与上一个设备不同时发出 tun.EventMTUUpdate。
+func (d *multiTUN) add(dev tun.Device, mtu int) {
+	d.devices <- addRequest{dev, mtu}
+}
+
+// sendEvent 向 Events() 发送事件，multiTUN 关闭后放弃。
+func (d *multiTUN) sendEvent(e tun.Event) {
+	select {
+	case d.events <- e:
+	case <-d.close:
+	}
+}
+
+// currentMTU 返回设备 MTU：优先使用建立时配置的值，保证 MTU() 与 MTU 事件一致；
+// 未知时查询底层设备，仍失败则返回 defaultMTU。
+func (dev *tunDevice) currentMTU() int {
+	if dev.mtu > 0 {
+		return dev.mtu
+	}
+	mtu, err := dev.dev.MTU()
+	if err != nil || mtu <= 0 {
+		return defaultMTU
+	}
+	return mtu
 }
 
 // File 返回底层文件（Android 不支持）。
@@ -259,36 +445,71 @@ func (d *multiTUN) File() *os.File {
 	panic("not available on Android")
 }
 
-// Read 读取数据。
+// Read 直接从当前读取设备读取数据，一次最多读取该设备 BatchSize 个包。
+// 读取设备被取代并关闭后，自动切换到下一个设备继续读取。
 func (d *multiTUN) Read(data [][]byte, sizes []int, offset int) (int, error) {
-	r := make(chan ioReply)
-	d.reads <- ioRequest{data, sizes, offset, r}
-	rep := <-r
-	return rep.count, rep.err
+	for {
+		dev, changed := d.currentReader()
+		if dev == nil {
+			// 还没有设备，等待 add
+			select {
+			case <-changed:
+				continue
+			case <-d.close:
+				return 0, os.ErrClosed
+			}
+		}
+		// 被取代的设备在宽限期后关闭，继续读取直到读到关闭，交付其中尚未读取的包后再切换
+		n := min(len(data), max(dev.dev.BatchSize(), 1))
+		count, err := dev.dev.Read(data[:n], sizes[:n], offset)
+		if err == nil || !dev.retired.Load() {
+			return count, err
+		}
+		if count > 0 {
+			// 关闭前读到的数据照常交付，下一次再切换
+			return count, nil
+		}
+		// 设备已被取代并关闭：通知主循环切换，等待新的读取设备
+		dev.readerDone()
+		select {
+		case <-changed:
+		case <-d.close:
+			return 0, os.ErrClosed
+		}
+	}
 }
 
-// Write 写入数据。
+// Write 写入数据，由当前写入设备（最新的设备）的 runDevice 协程完成。
 func (d *multiTUN) Write(data [][]byte, offset int) (int, error) {
-	r := make(chan ioReply)
+	r := ioReplyPool.Get().(chan ioReply)
+	defer ioReplyPool.Put(r)
 	d.writes <- ioRequest{data, nil, offset, r}
 	rep := <-r
 	return rep.count, rep.err
 }
 
-// MTU 获取 MTU。
+// MTU 获取当前写入设备的 MTU，没有设备时返回 defaultMTU。
 func (d *multiTUN) MTU() (int, error) {
 	r := make(chan mtuReply)
 	d.mtus <- r
-	rep := <-r
-	return rep.mtu, rep.err
+	select {
+	case rep := <-r:
+		return rep.mtu, rep.err
+	case <-d.failed:
+		return defaultMTU, nil
+	}
 }
 
 // Name 获取设备名。
 func (d *multiTUN) Name() (string, error) {
 	r := make(chan nameReply)
 	d.names <- r
-	rep := <-r
-	return rep.name, rep.err
+	select {
+	case rep := <-r:
+		return rep.name, rep.err
+	case <-d.failed:
+		return "", d.failErr
+	}
 }
 
 // Events 获取事件通道。
@@ -299,16 +520,22 @@ func (d *multiTUN) Events() <-chan tun.Event {
 // Shutdown 关闭所有设备。
 func (d *multiTUN) Shutdown() {
 	d.shutdowns <- struct{}{}
-	<-d.shutdownDone
+	select {
+	case <-d.shutdownDone:
+	case <-d.failed:
+	}
 }
 
 // Close 关闭 multiTUN。
 func (d *multiTUN) Close() error {
-	close(d.close)
-	return <-d.closeErr
+	d.closeOnce.Do(func() {
+		close(d.close)
+		d.closeResult = <-d.closeErr
+	})
+	return d.closeResult
 }
 
-// BatchSize 返回批处理大小（Android 固定为 1）。
+// BatchSize 返回批处理大小上限，见 maxTUNBatchSize。
 func (d *multiTUN) BatchSize() int {
-	return 1
+	return maxTUNBatchSize
 }
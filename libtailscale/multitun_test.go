@@ -0,0 +1,365 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+// fakeTUN 内存中的 tun.Device：inject 的包由 Read 依次返回，Write 的包记录在 written 中。
+// 与真实 TUN 的 fd 一样，Close 丢弃尚未读取的包，之后 Read 返回 os.ErrClosed。
+type fakeTUN struct {
+	name   string
+	queue  chan []byte
+	events chan tun.Event
+	closed chan struct{}
+	once   sync.Once
+
+	mu      sync.Mutex
+	written [][]byte
+}
+
+func newFakeTUN(name string) *fakeTUN {
+	return &fakeTUN{
+		name:   name,
+		queue:  make(chan []byte, 1024),
+		events: make(chan tun.Event),
+		closed: make(chan struct{}),
+	}
+}
+
+func (t *fakeTUN) inject(pkt []byte) { t.queue <- pkt }
+
+func (t *fakeTUN) writes() [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.written
+}
+
+func (t *fakeTUN) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *fakeTUN) File() *os.File { return nil }
+
+func (t *fakeTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	if t.isClosed() {
+		return 0, os.ErrClosed
+	}
+	select {
+	case pkt := <-t.queue:
+		sizes[0] = copy(bufs[0][offset:], pkt)
+		return 1, nil
+	case <-t.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (t *fakeTUN) Write(bufs [][]byte, offset int) (int, error) {
+	if t.isClosed() {
+		return 0, os.ErrClosed
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range bufs {
+		t.written = append(t.written, append([]byte(nil), b[offset:]...))
+	}
+	return len(bufs), nil
+}
+
+func (t *fakeTUN) MTU() (int, error)        { return defaultMTU, nil }
+func (t *fakeTUN) Name() (string, error)    { return t.name, nil }
+func (t *fakeTUN) Events() <-chan tun.Event { return t.events }
+func (t *fakeTUN) BatchSize() int           { return 1 }
+
+func (t *fakeTUN) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+		for {
+			select {
+			case <-t.queue:
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// injectRange 依次排入序号为 [from, to) 的包。
+func (t *fakeTUN) injectRange(from, to int) {
+	for i := from; i < to; i++ {
+		t.inject(seqPacket(i))
+	}
+}
+
+// waitClosed 等待设备被关闭。
+func (t *fakeTUN) waitClosed(tb testing.TB) {
+	tb.Helper()
+	waitFor(tb, "close of "+t.name, t.isClosed)
+}
+
+// seqPacket 返回携带序号 i 的包，packetSeq 取回序号。
+func seqPacket(i int) []byte { return binary.BigEndian.AppendUint32(nil, uint32(i)) }
+func packetSeq(b []byte) int { return int(int32(binary.BigEndian.Uint32(b))) }
+
+// waitFor 轮询 cond 直到为 true，超时则测试失败。
+func waitFor(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readAll 持续从 d 读取，直到读到错误，把包的序号依次发送到返回的通道。
+func readAll(d *multiTUN) (<-chan int, <-chan error) {
+	seqs := make(chan int, 4096)
+	errc := make(chan error, 1)
+	go func() {
+		bufs := make([][]byte, maxTUNBatchSize)
+		for i := range bufs {
+			bufs[i] = make([]byte, 64)
+		}
+		sizes := make([]int, len(bufs))
+		for {
+			n, err := d.Read(bufs, sizes, 0)
+			for i := range n {
+				seqs <- packetSeq(bufs[i][:sizes[i]])
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	return seqs, errc
+}
+
+// TestMultiTUNHandoverNoLoss 在读写进行中多次替换设备：旧设备排队的包在切换前全部交付且顺序不变，
+// 切换期间的写入全部落到某个设备上，被取代的设备最终被关闭。
+func TestMultiTUNHandoverNoLoss(t *testing.T) {
+	const perDevice = 200
+	d := newTUNDevices()
+	defer d.Close()
+	seqs, errc := readAll(d)
+
+	var devs []*fakeTUN
+	var writeErrs []error
+	var writeMu sync.Mutex
+	stopWrites := make(chan struct{})
+	var writers sync.WaitGroup
+	writes := 0
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		for {
+			select {
+			case <-stopWrites:
+				return
+			default:
+			}
+			_, err := d.Write([][]byte{seqPacket(writes)}, 0)
+			writeMu.Lock()
+			writes++
+			if err != nil {
+				writeErrs = append(writeErrs, err)
+			}
+			writeMu.Unlock()
+		}
+	}()
+
+	for i := range 4 {
+		dev := newFakeTUN(fmt.Sprintf("tun%d", i))
+		// 先排队再加入：新设备取代旧设备时，旧设备中尚未读取的包必须先被交付
+		dev.injectRange(i*perDevice, (i+1)*perDevice)
+		d.add(dev, defaultMTU)
+		devs = append(devs, dev)
+	}
+	close(stopWrites)
+	writers.Wait()
+
+	for want := range 4 * perDevice {
+		select {
+		case got := <-seqs:
+			if got != want {
+				t.Fatalf("read packet %d, want %d", got, want)
+			}
+		case err := <-errc:
+			t.Fatalf("Read failed after %d packets: %v", want, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d of %d packets", want, 4*perDevice)
+		}
+	}
+	for _, dev := range devs[:len(devs)-1] {
+		dev.waitClosed(t)
+	}
+	if devs[len(devs)-1].isClosed() {
+		t.Errorf("current device %s closed", devs[len(devs)-1].name)
+	}
+
+	if len(writeErrs) > 0 {
+		t.Errorf("%d writes failed during handover, first: %v", len(writeErrs), writeErrs[0])
+	}
+	got := 0
+	for _, dev := range devs {
+		got += len(dev.writes())
+	}
+	if got != writes {
+		t.Errorf("devices received %d writes, want %d", got, writes)
+	}
+
+	// 切换完成后的写入只到达最新的设备
+	last := devs[len(devs)-1]
+	before := len(last.writes())
+	if _, err := d.Write([][]byte{seqPacket(-1)}, 0); err != nil {
+		t.Fatalf("Write after handover: %v", err)
+	}
+	if n := len(last.writes()); n != before+1 {
+		t.Errorf("latest device has %d writes, want %d", n, before+1)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Read after Close = %v, want os.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read still blocked after Close")
+	}
+	last.waitClosed(t)
+}
+
+// TestMultiTUNRetiredDrainGrace 被取代的设备在宽限期内保持打开并可读，期满后关闭，读取切换到新设备。
+func TestMultiTUNRetiredDrainGrace(t *testing.T) {
+	d := newTUNDevices()
+	defer d.Close()
+	d.drainGrace = 500 * time.Millisecond
+
+	old := newFakeTUN("tun0")
+	old.injectRange(0, 5)
+	d.add(old, defaultMTU)
+	cur := newFakeTUN("tun1")
+	d.add(cur, defaultMTU)
+	seqs, errc := readAll(d)
+
+	next := func(want int) {
+		t.Helper()
+		select {
+		case got := <-seqs:
+			if got != want {
+				t.Fatalf("read packet %d, want %d", got, want)
+			}
+		case err := <-errc:
+			t.Fatalf("Read: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for packet %d", want)
+		}
+	}
+	for i := range 5 {
+		next(i)
+	}
+	if old.isClosed() {
+		t.Fatal("retired device closed before the grace period")
+	}
+	old.waitClosed(t)
+
+	cur.injectRange(5, 10)
+	for i := 5; i < 10; i++ {
+		next(i)
+	}
+	if cur.isClosed() {
+		t.Error("current device closed")
+	}
+}
+
+// TestMultiTUNReadWaitsForDevice 没有设备时 Read 阻塞，加入设备后继续读取。
+func TestMultiTUNReadWaitsForDevice(t *testing.T) {
+	d := newTUNDevices()
+	defer d.Close()
+	seqs, errc := readAll(d)
+
+	select {
+	case s := <-seqs:
+		t.Fatalf("read packet %d with no device", s)
+	case err := <-errc:
+		t.Fatalf("Read with no device: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	dev := newFakeTUN("tun0")
+	d.add(dev, defaultMTU)
+	dev.inject(seqPacket(7))
+	select {
+	case s := <-seqs:
+		if s != 7 {
+			t.Errorf("read packet %d, want 7", s)
+		}
+	case err := <-errc:
+		t.Fatalf("Read: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for packet")
+	}
+}
+
+// panicNameTUN Name 会 panic 的 fakeTUN，用于让 run 主循环 panic。
+type panicNameTUN struct{ *fakeTUN }
+
+func (t panicNameTUN) Name() (string, error) { panic("injected Name panic") }
+
+// TestMultiTUNRunPanic run 主循环 panic 后交给 supervisor，Name、Shutdown 与 Close 仍能返回，不会阻塞后端拆除。
+func TestMultiTUNRunPanic(t *testing.T) {
+	a := &App{events: newAppEvents()}
+	defer a.events.close()
+	setCurrentApp(a)
+	defer setCurrentAppIf(a, nil)
+
+	d := newTUNDevices()
+	dev := newFakeTUN("tun0")
+	d.add(panicNameTUN{dev}, defaultMTU)
+	if _, err := d.Name(); err == nil {
+		t.Fatal("Name after run panicked: nil error")
+	}
+
+	select {
+	case ev := <-a.events.backend.C():
+		pe, ok := ev.(backendPanicEvent)
+		if !ok {
+			t.Fatalf("got %T, want backendPanicEvent", ev)
+		}
+		if pe.err.where != "multiTUN.run" || pe.err.stack == "" {
+			t.Errorf("panic event = %q with stack %d bytes, want multiTUN.run with a stack", pe.err.where, len(pe.err.stack))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for backendPanicEvent")
+	}
+
+	later := newFakeTUN("tun1")
+	d.add(later, defaultMTU)
+	later.waitClosed(t)
+	d.Shutdown()
+	var pe *goroutinePanicError
+	if err := d.Close(); !errors.As(err, &pe) {
+		t.Errorf("Close = %v, want the run panic", err)
+	}
+}
@@ -8,16 +8,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/netip"
-	"runtime/debug"
 	"strings"
-	"syscall"
 
 	"github.com/tailscale/wireguard-go/tun"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/netmon"
-	"tailscale.com/util/dnsname"
 	"tailscale.com/wgengine/router"
 )
 
@@ -29,95 +25,21 @@ var errVPNNotPrepared = errors.New("VPN service not prepared or was revoked")
 // 见 https://github.com/tailscale/tailscale/issues/2180
 var errMultipleUsers = errors.New("VPN cannot be created on this device due to an Android bug with multiple users")
 
-// VpnService 封装 Android 侧 IPNService、fd 及其状态。
-// 设计说明：fdDetached 标记 fd 是否已被 Detach，避免重复关闭。
-type VpnService struct {
-	service    IPNService // Android 侧服务实例，负责实际 VPN 操作
-	fd         int32      // 当前 TUN 设备的文件描述符
-	fdDetached bool       // 是否已分离，避免重复关闭
-}
-
-// vpnService 全局唯一 VpnService 实例，保证全局唯一性。
-var vpnService = &VpnService{}
-
-// getInterfaces 获取设备所有网络接口信息，适配 Android 平台接口字符串格式。
-// 设计说明：Android 侧通过字符串传递所有接口信息，需逐行解析。
+// getInterfaces 获取设备所有网络接口信息，快照格式见 ifsnapshot.go。
 // 返回 netmon.Interface 列表和错误。
 func (a *App) getInterfaces() ([]netmon.Interface, error) {
-	var ifaces []netmon.Interface
-
-	// 1. 从 Android 侧获取接口字符串，格式为多行文本。
-	ifaceString, err := a.appCtx.GetInterfacesAsString()
+	snap, err := a.interfaceSnapshot()
 	if err != nil {
-		return ifaces, err
+		return nil, err
 	}
-
-	// 2. 逐行解析接口信息，每行格式为"属性 | 地址列表"。
-	for _, iface := range strings.Split(ifaceString, "\n") {
-		// 跳过空行
-		if strings.TrimSpace(iface) == "" {
-			continue
-		}
-
-		fields := strings.Split(iface, "|")
-		if len(fields) != 2 {
-			log.Printf("getInterfaces: unable to split %q", iface)
-			continue
-		}
-
-		// 解析接口属性
-		var name string
-		var index, mtu int
-		var up, broadcast, loopback, pointToPoint, multicast bool
-		_, err := fmt.Sscanf(fields[0], "%s %d %d %t %t %t %t %t",
-			&name, &index, &mtu, &up, &broadcast, &loopback, &pointToPoint, &multicast)
-		if err != nil {
-			log.Printf("getInterfaces: unable to parse %q: %v", iface, err)
-			continue
-		}
-
-		// 构造 netmon.Interface，AltAddrs 非 nil 避免 Go 使用 netlink
-		newIf := netmon.Interface{
-			Interface: &net.Interface{
-				Name:  name,
-				Index: index,
-				MTU:   mtu,
-			},
-			AltAddrs: []net.Addr{},
-		}
-		// 设置 flags
-		if up {
-			newIf.Flags |= net.FlagUp
-		}
-		if broadcast {
-			newIf.Flags |= net.FlagBroadcast
-		}
-		if loopback {
-			newIf.Flags |= net.FlagLoopback
-		}
-		if pointToPoint {
-			newIf.Flags |= net.FlagPointToPoint
-		}
-		if multicast {
-			newIf.Flags |= net.FlagMulticast
-		}
-
-		// 解析地址列表
-		addrs := strings.Trim(fields[1], " \n")
-		for _, addr := range strings.Split(addrs, " ") {
-			_, ipnet, err := net.ParseCIDR(addr)
-			if err == nil {
-				newIf.AltAddrs = append(newIf.AltAddrs, ipnet)
-			}
-		}
-
-		ifaces = append(ifaces, newIf)
+	ifaces := make([]netmon.Interface, 0, len(snap.Interfaces))
+	for _, info := range snap.Interfaces {
+		ifaces = append(ifaces, info.netmonInterface())
 	}
-
 	return ifaces, nil
 }
 
-// googleDNSServers ChromeOS 下的兜底 DNS。
+// googleDNSServers 默认的兜底 DNS，构建配置启用 Google DNS 兜底时使用。
 // 设计说明：ChromeOS 平台若 DNS 配置为空会清空系统 DNS，需兜底。
 var googleDNSServers = []netip.Addr{
 	netip.MustParseAddr("8.8.8.8"),
@@ -127,44 +49,82 @@ var googleDNSServers = []netip.Addr{
 }
 
 // updateTUN 更新 TUN 设备配置，适配 Android/ChromeOS 平台的特殊要求。
-// 该方法会关闭旧的 TUN 设备，重新建立 VPN 通道，并根据传入的路由和 DNS 配置进行设置。
-// 注意：Android 平台 TUN 设备配置不可热更新，必须销毁重建。
+// 该方法根据传入的路由和 DNS 配置重新建立 VPN 通道，新 TUN 设备就绪后才取代旧设备。
+// 注意：Android 平台 TUN 设备配置不可热更新，必须重建；
+// 先建立新的 fd 再由 multiTUN 淘汰旧设备，路由或 DNS 变化时不会出现断流。
 // rcfg: 路由配置，包含所有需要下发到 TUN 的路由信息。
 // dcfg: DNS 配置，包含所有需要下发到 TUN 的 DNS 信息。
-// 返回：如有错误则返回，否则返回 nil。
-func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) error {
+// 返回：如有错误则返回，否则返回 nil。VPN 会话状态随结果迁移为 up、error 或 revoked。
+func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) (err error) {
 	b.logger.Logf("updateTUN: changed")
 	defer b.logger.Logf("updateTUN: finished")
 
-	// 1. 关闭旧 TUN 设备，防止 Android/ChromeOS 平台下路由/DNS 配置无法热更新。
-	//    这是因为 Android 的 VpnService 不支持动态变更配置，必须销毁重建。
-	b.logger.Logf("updateTUN: closing old TUNs")
-	b.CloseTUNs()
-	b.logger.Logf("updateTUN: closed old TUNs")
+	// 0. 使用外部 TUN 时只检查覆盖情况，不经过 VpnService。
+	if b.external != nil {
+		b.checkExternalTUN(rcfg)
+		b.lastDNSCfg = dcfg
+		return nil
+	}
 
-	// 2. 如果没有本地地址，说明当前不需要建立 TUN，直接返回。
+	// 1. 如果没有本地地址，说明当前不需要 TUN，关闭旧设备后直接返回。
+	//    锁定模式下改为保持黑洞 TUN，直到重新连接。
 	if len(rcfg.LocalAddrs) == 0 {
+		if b.vpn.currentService() != nil && b.maybeEngageLockdown("no local addresses") {
+			b.logger.Logf("updateTUN: no local addrs, lockdown engaged")
+			return nil
+		}
+		b.logger.Logf("updateTUN: no local addrs, closing old TUNs")
+		b.CloseTUNs()
+		b.vpn.setState(vpnIdle, nil)
+		return nil
+	}
+
+	// 处于强制门户之后时暂缓重建，保留现有 TUN，避免门户登录页被拦截；门户解除后补建，见 captive.go。
+	if b.holdForCaptivePortal(rcfg, dcfg) {
+		b.logger.Logf("updateTUN: captive portal, holding TUN")
 		return nil
 	}
 
+	service := b.vpn.currentService()
+	if service == nil {
+		return errVPNNotPrepared
+	}
+	if err := b.vpn.setState(vpnEstablishing, nil); err != nil {
+		return err
+	}
+	defer func() {
+		switch {
+		case err == nil:
+			b.vpn.setState(vpnUp, nil)
+		case errors.Is(err, errVPNNotPrepared):
+			b.vpn.setState(vpnRevoked, err)
+		default:
+			b.vpn.setState(vpnError, err)
+		}
+	}()
+
+	// 2. 旧 TUN 设备保持工作，直到下面新设备建立并加入 multiTUN。
+	//    出错时旧设备同样保留，由调用方决定是否关闭 VPN。
+
 	// 3. 创建新的 VpnService.Builder，用于配置新的 TUN 设备。
 	//    该 Builder 由 Android 侧实现，负责实际的 TUN 配置下发。
-	builder := vpnService.service.NewBuilder()
+	builder := service.NewBuilder()
 	b.logger.Logf("updateTUN: got new builder")
 
-	// 4. 设置 MTU，Android 推荐 1280 以兼容 IPv6。
-	if err := builder.SetMTU(defaultMTU); err != nil {
+	// 4. 设置 MTU：策略 > 路由配置 > 物理接口推算，下限 1280 以兼容 IPv6。
+	mtu := b.tunMTU(rcfg)
+	if err := builder.SetMTU(int32(mtu)); err != nil {
 		return err
 	}
-	b.logger.Logf("updateTUN: set MTU")
+	b.logger.Logf("updateTUN: set MTU %d", mtu)
+
+	// 当前物理网络的地址族情况，影响 DNS 兜底与路由方案。
+	env := b.currentNetEnv()
 
-	// 5. 配置 DNS，若 ChromeOS 且无 DNS，兜底使用 Google DNS。
+	// 5. 配置 DNS：Split DNS 时 Tailscale 解析器在前、平台 DNS 在后，见 splitdns.go；
+	//    若 ChromeOS 且无 DNS，兜底使用 Google DNS（NAT64 网络使用 DNS64）。
 	if dcfg != nil {
-		nameservers := dcfg.Nameservers
-		if b.avoidEmptyDNS && len(nameservers) == 0 {
-			// ChromeOS 平台特殊处理，避免 DNS 配置为空导致系统 DNS 被清空。
-			nameservers = googleDNSServers
-		}
+		nameservers := b.tunNameservers(dcfg, env)
 		for _, dns := range nameservers {
 			if err := builder.AddDNSServer(dns.String()); err != nil {
 				return err
@@ -178,36 +138,21 @@ func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) error {
 		b.logger.Logf("updateTUN: set nameservers")
 	}
 
-	// 6. 配置路由，所有下发到 TUN 的路由都需归一化掩码。
-	for _, route := range rcfg.Routes {
-		// Android 要求路由掩码必须标准化，否则会抛异常。
-		route = route.Masked()
-		if err := builder.AddRoute(route.Addr().String(), int32(route.Bits())); err != nil {
-			return err
-		}
-	}
-
-	// 7. 配置本地排除路由，跳过回环地址（Android 不支持）。
-	for _, route := range rcfg.LocalRoutes {
-		addr := route.Addr()
-		if addr.IsLoopback() {
-			// Android 平台不允许添加回环路由，否则会抛异常。
-			continue
-		}
-		route = route.Masked()
-		if err := builder.ExcludeRoute(route.Addr().String(), int32(route.Bits())); err != nil {
-			return err
-		}
+	// 6-8. 配置路由、排除路由与本地地址，双栈、纯 IPv6 与 NAT64 的处理见 routeplan.go。
+	//      Android 要求路由掩码必须标准化，且不允许排除回环路由，planRoutes 已处理。
+	plan := planRoutes(rcfg, env)
+	if err := applyRoutePlan(builder, plan); err != nil {
+		return err
 	}
-	b.logger.Logf("updateTUN: added %d routes", len(rcfg.Routes))
+	b.logger.Logf("updateTUN: added %d routes, %d excluded routes, %d local addrs (env %+v)",
+		len(plan.routes), len(plan.excludes), len(plan.addrs), env)
 
-	// 8. 配置本地地址，所有需要分配到 TUN 的地址。
-	for _, addr := range rcfg.LocalAddrs {
-		if err := builder.AddAddress(addr.Addr().String(), int32(addr.Bits())); err != nil {
-			return err
-		}
+	// 按应用分流，见 apps.go。
+	apps := b.currentAppFilter()
+	if err := applyAppFilter(builder, apps); err != nil {
+		return err
 	}
-	b.logger.Logf("updateTUN: added %d local addrs", len(rcfg.LocalAddrs))
+	b.logger.Logf("updateTUN: %d allowed, %d disallowed apps", len(apps.allowed), len(apps.disallowed))
 
 	// 9. 调用 Builder.Establish() 真正建立 TUN 设备，返回 ParcelFileDescriptor。
 	//    注意：此处如遇 INTERACT_ACROSS_USERS 错误，说明 Android 多用户场景不支持。
@@ -215,13 +160,13 @@ func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) error {
 	if err != nil {
 		if strings.Contains(err.Error(), "INTERACT_ACROSS_USERS") {
 			b.logger.Logf("updateTUN: could not establish VPN because %v", err)
-			vpnService.service.UpdateVpnStatus(false)
+			service.UpdateVpnStatus(false)
 			return errMultipleUsers
 		}
 		return fmt.Errorf("VpnService.Builder.establish: %v", err)
 	}
 	log.Printf("Setting vpn activity status to true")
-	vpnService.service.UpdateVpnStatus(true)
+	service.UpdateVpnStatus(true)
 	b.logger.Logf("updateTUN: established VPN")
 
 	if parcelFD == nil {
@@ -229,48 +174,43 @@ func (b *backend) updateTUN(rcfg *router.Config, dcfg *dns.OSConfig) error {
 		return errVPNNotPrepared
 	}
 
-	// 10. 分离 fd，获得底层 TUN 设备的文件描述符。
+	// 10. 分离 fd，获得底层 TUN 设备的文件描述符，在交给 tun.Device 之前由 VPN 会话持有。
 	tunFD, err := parcelFD.Detach()
-	vpnService.fdDetached = true
-	vpnService.fd = tunFD
-
 	if err != nil {
 		return fmt.Errorf("detachFd: %v", err)
 	}
+	b.vpn.setFD(tunFD)
 	b.logger.Logf("updateTUN: detached FD")
 
 	// 11. 创建 TUN 设备，调用 wireguard-go 的 Android 适配接口。
 	//     注意：此处依赖 wireguard-go 的 Android 适配，需交叉编译环境支持。
 	tunDev, _, err := tun.CreateUnmonitoredTUNFromFD(int(tunFD))
 	if err != nil {
-		closeFileDescriptor()
+		if cerr := b.vpn.closeFD(); cerr != nil {
+			b.logger.Logf("updateTUN: %v", cerr)
+		}
 		return err
 	}
+	// fd 此后归 tun.Device 所有，随设备关闭
+	b.vpn.releaseFD()
 	b.logger.Logf("updateTUN: created TUN device")
 
-	// 12. 注册新 TUN 设备到多路复用器。
-	b.devices.add(tunDev)
+	// 12. 注册新 TUN 设备到多路复用器，multiTUN 随即淘汰旧设备。
+	b.devices.add(tunDev, mtu)
 	b.logger.Logf("updateTUN: added TUN device")
+	// 真正的 TUN 已接管路由，退出锁定模式
+	b.lockdown.release()
 
 	// 13. 记录最新配置，便于后续对比。
 	b.lastCfg = rcfg
 	b.lastDNSCfg = dcfg
+	b.lastAppFilter = apps
 
-	// VPN建立成功后自动启动代理服务
-	startProxyService()
-
-	return nil
-}
-
-// closeFileDescriptor 关闭已分离的 fd，防止资源泄漏。
-// 注意：仅在 fdDetached=true 时调用。
-func closeFileDescriptor() error {
-	if vpnService.fd != -1 && vpnService.fdDetached {
-		err := syscall.Close(int(vpnService.fd))
-		vpnService.fd = -1
-		vpnService.fdDetached = false
-		return fmt.Errorf("error closing file descriptor: %w", err)
+	// VPN建立成功后自动启动代理服务，蜂窝网络下按策略暂停（见 netpolicy.go）
+	if !b.network.get().ProxyPaused {
+		startProxyService()
 	}
+
 	return nil
 }
 
@@ -283,17 +223,16 @@ func (b *backend) CloseTUNs() {
 
 // NetworkChanged 网络变化时触发，通知 netmon 更新默认路由接口。
 // ifname: 网络接口名，断网时为空字符串。
-// 设计说明：Android 侧通过回调触发，需手动注入事件。
+// 设计说明：Android 侧通过回调触发，需手动注入事件；由 netChangeProcessor 串行调用，不会以旧接口覆盖新接口。
 func (b *backend) NetworkChanged(ifname string) {
 	defer func() {
 		if p := recover(); p != nil {
-			log.Printf("panic in NetworkChanged %s: %s", p, debug.Stack())
-			panic(p)
+			reportPanic("NetworkChanged", p)
 		}
 	}()
 
 	// 1. 更新默认路由接口，影响 DNS/路由选择。
-	netmon.UpdateLastKnownDefaultRouteInterface(ifname)
+	setDefaultRouteInterface(ifname)
 	if b.sys != nil {
 		if nm, ok := b.sys.NetMon.GetOK(); ok {
 			nm.InjectEvent()
@@ -301,42 +240,23 @@ func (b *backend) NetworkChanged(ifname string) {
 	}
 }
 
-// getDNSBaseConfig 获取基础 DNS 配置，优先读取平台配置，必要时兜底 Google DNS。
-// 返回 dns.OSConfig 和错误。
-func (b *backend) getDNSBaseConfig() (ret dns.OSConfig, _ error) {
-	defer func() {
-		// 若无 DNS，兜底用 Google DNS
-		if len(ret.Nameservers) == 0 && b.appCtx.ShouldUseGoogleDNSFallback() {
-			log.Printf("getDNSBaseConfig: none found; falling back to Google public DNS")
-			ret.Nameservers = append(ret.Nameservers, googleDNSServers...)
-		}
-	}()
-	baseConfig := b.getPlatformDNSConfig()
-	lines := strings.Split(baseConfig, "\n")
-	if len(lines) == 0 {
-		return dns.OSConfig{}, nil
+// getDNSBaseConfig 获取基础 DNS 配置：使用默认网络的 DNS 服务器与搜索域，格式见 platformdns.go。
+// 默认网络没有 DNS 服务器时使用兜底列表（见 dnsfallback.go）；
+// 但若该网络启用了严格模式的 Private DNS，不兜底明文 DNS，避免绕过用户指定的加密 DNS。
+func (b *backend) getDNSBaseConfig() (dns.OSConfig, error) {
+	n, _ := b.platformDNS().defaultNetwork()
+	config := n.osConfig()
+	if len(config.Nameservers) > 0 {
+		return config, nil
 	}
-
-	config := dns.OSConfig{}
-	addrs := strings.Trim(lines[0], " \n")
-	for _, addr := range strings.Split(addrs, " ") {
-		ip, err := netip.ParseAddr(addr)
-		if err == nil {
-			config.Nameservers = append(config.Nameservers, ip)
-		}
+	if n.PrivateDNS.Mode == privateDNSStrict {
+		log.Printf("getDNSBaseConfig: none found; strict Private DNS (%s) active, not falling back", n.PrivateDNS.Hostname)
+		return config, nil
 	}
-
-	if len(lines) > 1 {
-		for _, s := range strings.Split(strings.Trim(lines[1], " \n"), " ") {
-			domain, err := dnsname.ToFQDN(s)
-			if err != nil {
-				log.Printf("getDNSBaseConfig: unable to parse %q: %v", s, err)
-				continue
-			}
-			config.SearchDomains = append(config.SearchDomains, domain)
-		}
+	if fallback := b.dnsFallback().servers; len(fallback) > 0 {
+		log.Printf("getDNSBaseConfig: none found; falling back to %v", fallback)
+		config.Nameservers = fallback
 	}
-
 	return config, nil
 }
 
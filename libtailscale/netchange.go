@@ -0,0 +1,159 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// netchange.go 串行处理 Android 上报的网络变化：Wi-Fi 与蜂窝网络来回切换时会在短时间内连续回调
+// OnDNSConfigChanged，这里把一阵变化合并为一次，并始终按最新的接口名生效，避免旧接口覆盖新接口。
+package libtailscale
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/util/clientmetric"
+)
+
+const (
+	// netChangeDebounce 最后一次网络变化后等待的时间，期间的新变化会重新计时。
+	netChangeDebounce = 300 * time.Millisecond
+	// netChangeMaxDelay 一阵变化从首次到生效的最长等待时间，避免持续抖动时迟迟不生效。
+	netChangeMaxDelay = 2 * time.Second
+)
+
+var (
+	// metricNetChangeCoalesced 被更新的网络变化覆盖、未单独生效的变化数量。
+	metricNetChangeCoalesced = clientmetric.NewCounter("android_netchange_coalesced")
+	// metricNetChangeDropped 处理器已停止或没有运行中的 App 而被丢弃的网络变化数量。
+	metricNetChangeDropped = clientmetric.NewCounter("android_netchange_dropped")
+	// metricNetChangeApplied 实际生效的网络变化数量。
+	metricNetChangeApplied = clientmetric.NewCounter("android_netchange_applied")
+)
+
+// netChangeProcessor 串行、去抖地处理网络变化。
+// submit 永不阻塞；单个协程在一阵变化平息后以最新的接口名调用 apply，apply 之间不会并发。
+type netChangeProcessor struct {
+	debounce time.Duration
+	maxDelay time.Duration
+	apply    func(ifname string)
+
+	signal chan struct{}
+	done   chan struct{}
+
+	mu         sync.Mutex
+	pending    string // 待生效的接口名
+	hasPending bool
+	stopped    bool
+}
+
+// newNetChangeProcessor 创建处理器并启动处理协程，调用 stop 结束。
+func newNetChangeProcessor(debounce, maxDelay time.Duration, apply func(ifname string)) *netChangeProcessor {
+	p := &netChangeProcessor{
+		debounce: debounce,
+		maxDelay: maxDelay,
+		apply:    apply,
+		signal:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// submit 提交一次网络变化，覆盖尚未生效的变化。
+func (p *netChangeProcessor) submit(ifname string) {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		metricNetChangeDropped.Add(1)
+		log.Printf("netchange: processor stopped, dropping change to %q", ifname)
+		return
+	}
+	if p.hasPending {
+		metricNetChangeCoalesced.Add(1)
+	}
+	p.pending, p.hasPending = ifname, true
+	p.mu.Unlock()
+
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// stop 停止处理协程，尚未生效的变化被丢弃。可重复调用。
+func (p *netChangeProcessor) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	if p.hasPending {
+		metricNetChangeDropped.Add(1)
+		p.hasPending = false
+	}
+	close(p.done)
+}
+
+// run 等待一阵变化平息（或达到 maxDelay）后生效最新的接口名。
+func (p *netChangeProcessor) run() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.signal:
+		}
+		if !p.settle() {
+			return
+		}
+		p.mu.Lock()
+		ifname, ok := p.pending, p.hasPending
+		p.hasPending = false
+		p.mu.Unlock()
+		if !ok {
+			continue
+		}
+		metricNetChangeApplied.Add(1)
+		p.apply(ifname)
+	}
+}
+
+// settle 等待 debounce 内没有新的变化，或自首次变化起已过 maxDelay。处理器停止时返回 false。
+func (p *netChangeProcessor) settle() bool {
+	quiet := time.NewTimer(p.debounce)
+	defer quiet.Stop()
+	deadline := time.NewTimer(p.maxDelay)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-p.done:
+			return false
+		case <-deadline.C:
+			return true
+		case <-quiet.C:
+			return true
+		case <-p.signal:
+			quiet.Reset(p.debounce)
+		}
+	}
+}
+
+// applyNetworkChange 是 backend 的 netChangeProcessor 回调：通知 netmon 后发布 networkSettledEvent，
+// 由 runBackendOnce 调用 onNetworkSettled。
+func (b *backend) applyNetworkChange(ifname string) {
+	b.NetworkChanged(ifname)
+	b.events.backend.publish(networkSettledEvent{ifname})
+}
+
+// onNetworkSettled 一阵网络变化平息后，按最新的接口名更新网络状态与平台 DNS。
+// 返回重建 TUN 的错误，调用方据此关闭 VPN。
+func (b *backend) onNetworkSettled(ifname string, state ipn.State) error {
+	log.Printf("runBackendOnce: network settled on %q", ifname)
+	b.updateNetworkStatus(ifname)
+	if state >= ipn.Starting && b.vpn.currentService() != nil && b.platformDNSChanged() {
+		// Split DNS 下平台 DNS 随网络变化，需要重建 TUN 以更新回退的 DNS 服务器
+		log.Printf("runBackendOnce: platform DNS changed, updating TUN")
+		return b.updateTUN(b.lastCfg, b.lastDNSCfg)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// applyRecorder 记录 netChangeProcessor 调用 apply 的接口名。
+type applyRecorder struct {
+	mu      sync.Mutex
+	applied []string
+	// running 正在执行的 apply 数量，用于检查 apply 不会并发。
+	running, maxRunning int
+	delay               time.Duration
+}
+
+func (r *applyRecorder) apply(ifname string) {
+	r.mu.Lock()
+	r.running++
+	r.maxRunning = max(r.maxRunning, r.running)
+	r.mu.Unlock()
+	time.Sleep(r.delay)
+	r.mu.Lock()
+	r.running--
+	r.applied = append(r.applied, ifname)
+	r.mu.Unlock()
+}
+
+func (r *applyRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.applied...)
+}
+
+// counterDelta 返回 f 执行期间各网络变化计数器的增量。
+func counterDelta(f func()) (coalesced, dropped, applied int64) {
+	c0, d0, a0 := metricNetChangeCoalesced.Value(), metricNetChangeDropped.Value(), metricNetChangeApplied.Value()
+	f()
+	return metricNetChangeCoalesced.Value() - c0, metricNetChangeDropped.Value() - d0, metricNetChangeApplied.Value() - a0
+}
+
+// TestNetChangeProcessorFlaps Wi-Fi 与蜂窝网络快速来回切换时只生效一次，且使用最新的接口名。
+func TestNetChangeProcessorFlaps(t *testing.T) {
+	var r applyRecorder
+	p := newNetChangeProcessor(100*time.Millisecond, 5*time.Second, r.apply)
+	defer p.stop()
+
+	const flaps = 20
+	coalesced, dropped, applied := counterDelta(func() {
+		for i := range flaps {
+			if i%2 == 0 {
+				p.submit("wlan0")
+			} else {
+				p.submit("rmnet_data0")
+			}
+		}
+		p.submit("wlan0")
+		waitFor(t, "apply", func() bool { return len(r.get()) > 0 })
+		// 再等待若干个去抖周期，确认没有多余的 apply
+		time.Sleep(300 * time.Millisecond)
+	})
+
+	if got := r.get(); len(got) != 1 || got[0] != "wlan0" {
+		t.Errorf("applied %q, want a single apply of wlan0", got)
+	}
+	if coalesced != flaps {
+		t.Errorf("coalesced = %d, want %d", coalesced, flaps)
+	}
+	if dropped != 0 {
+		t.Errorf("dropped = %d, want 0", dropped)
+	}
+	if applied != 1 {
+		t.Errorf("applied = %d, want 1", applied)
+	}
+}
+
+// TestNetChangeProcessorMaxDelay 持续抖动时最迟在 maxDelay 后生效，不会一直推迟。
+func TestNetChangeProcessorMaxDelay(t *testing.T) {
+	var r applyRecorder
+	p := newNetChangeProcessor(50*time.Millisecond, 200*time.Millisecond, r.apply)
+	defer p.stop()
+
+	deadline := time.Now().Add(600 * time.Millisecond)
+	for i := 0; time.Now().Before(deadline); i++ {
+		p.submit(fmt.Sprintf("wlan%d", i))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := r.get(); len(got) < 2 {
+		t.Errorf("applied %q during 600ms of flapping with maxDelay 200ms, want at least 2 applies", got)
+	}
+}
+
+// TestNetChangeProcessorSerialApply apply 执行期间的新变化排队到下一次，apply 之间不会并发，最终生效最新的接口名。
+func TestNetChangeProcessorSerialApply(t *testing.T) {
+	r := applyRecorder{delay: 100 * time.Millisecond}
+	p := newNetChangeProcessor(10*time.Millisecond, time.Second, r.apply)
+	defer p.stop()
+
+	p.submit("wlan0")
+	waitFor(t, "first apply to start", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.running > 0
+	})
+	p.submit("rmnet_data0")
+	p.submit("wlan0")
+	p.submit("rmnet_data0")
+	waitFor(t, "second apply", func() bool { return len(r.get()) == 2 })
+	time.Sleep(50 * time.Millisecond)
+
+	if got, want := r.get(), []string{"wlan0", "rmnet_data0"}; !slices.Equal(got, want) {
+		t.Errorf("applied %q, want %q", got, want)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxRunning != 1 {
+		t.Errorf("%d concurrent applies, want 1", r.maxRunning)
+	}
+}
+
+// TestNetChangeProcessorStop 停止时尚未生效的变化与之后提交的变化都被丢弃并计数。
+func TestNetChangeProcessorStop(t *testing.T) {
+	var r applyRecorder
+	p := newNetChangeProcessor(time.Hour, time.Hour, r.apply)
+
+	coalesced, dropped, applied := counterDelta(func() {
+		p.submit("wlan0")
+		p.submit("rmnet_data0")
+		p.stop()
+		p.stop()
+		p.submit("wlan0")
+	})
+
+	if got := r.get(); len(got) != 0 {
+		t.Errorf("applied %q after stop", got)
+	}
+	if coalesced != 1 {
+		t.Errorf("coalesced = %d, want 1", coalesced)
+	}
+	// 停止时待生效的 rmnet_data0，以及停止后提交的 wlan0
+	if dropped != 2 {
+		t.Errorf("dropped = %d, want 2", dropped)
+	}
+	if applied != 0 {
+		t.Errorf("applied = %d, want 0", applied)
+	}
+}
+
+// fakeNetAppContext 模拟 Android 侧的默认网络：connect 切换当前接口，GetInterfacesJSON 返回对应的快照。
+type fakeNetAppContext struct {
+	*fakePolicyAppContext
+
+	mu     sync.Mutex
+	ifaces []interfaceInfo
+}
+
+func (c *fakeNetAppContext) connect(ifaces ...interfaceInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ifaces = ifaces
+}
+
+func (c *fakeNetAppContext) GetInterfacesJSON() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, err := json.Marshal(interfaceSnapshot{Version: interfaceSnapshotVersion, Interfaces: c.ifaces})
+	return string(b), err
+}
+
+// TestNetworkChangedEvents 从 OnDNSConfigChanged 到 networkSettledEvent 走完整的事件链路：
+// Wi-Fi 与 LTE 快速来回切换时，netChangeProcessor 只生效一次，网络状态按最后一次切换后的接口计算。
+func TestNetworkChangedEvents(t *testing.T) {
+	wifi := interfaceInfo{Name: "wlan0", Up: true, Type: ifaceTypeWiFi}
+	lte := interfaceInfo{Name: "rmnet_data0", Up: true, Type: ifaceTypeCellular, Metered: true}
+	tests := []struct {
+		name   string
+		flaps  []interfaceInfo // 依次成为默认网络的接口，Name 为空表示断网
+		policy map[string]bool
+		want   networkStatus
+	}{
+		{
+			name:  "settles on Wi-Fi",
+			flaps: []interfaceInfo{wifi, lte, wifi, lte, wifi, lte, wifi},
+			want:  networkStatus{Interface: "wlan0", Type: ifaceTypeWiFi},
+		},
+		{
+			name:   "settles on LTE with cellular pause",
+			flaps:  []interfaceInfo{lte, wifi, lte, wifi, lte},
+			policy: map[string]bool{cellularPauseSharingPolicyKey: true},
+			want: networkStatus{
+				Interface: "rmnet_data0", Type: ifaceTypeCellular, Metered: true,
+				TaildropPaused: true, ProxyPaused: true,
+			},
+		},
+		{
+			name:  "settles offline",
+			flaps: []interfaceInfo{wifi, lte, {}},
+			want:  networkStatus{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appCtx := &fakeNetAppContext{fakePolicyAppContext: &fakePolicyAppContext{bools: tt.policy}}
+			a := &App{appCtx: appCtx, events: newAppEvents(), network: newNetworkState(nil)}
+			a.policyStore = &syspolicyHandler{a: a}
+			defer a.events.close()
+			setCurrentApp(a)
+			defer setCurrentAppIf(a, nil)
+
+			b := &backend{
+				appCtx:             appCtx,
+				events:             a.events,
+				policy:             a.policyStore,
+				store:              newStateStore(newMemStateStore(), stateStoreMemory),
+				network:            a.network,
+				snapshotInterfaces: a.interfaceSnapshot,
+			}
+			b.netChanges = newNetChangeProcessor(50*time.Millisecond, 5*time.Second, b.applyNetworkChange)
+			defer b.netChanges.stop()
+
+			// 与 runBackendOnce 相同的分发
+			settled := make(chan networkStatus, len(tt.flaps))
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					case ev := <-a.events.backend.C():
+						switch ev := ev.(type) {
+						case networkChangedEvent:
+							b.netChanges.submit(ev.ifname)
+						case networkSettledEvent:
+							if err := b.onNetworkSettled(ev.ifname, ipn.NoState); err != nil {
+								t.Errorf("onNetworkSettled: %v", err)
+							}
+							settled <- b.network.get()
+						}
+					}
+				}
+			}()
+
+			coalesced, dropped, applied := counterDelta(func() {
+				for _, n := range tt.flaps {
+					if n.Name == "" {
+						appCtx.connect()
+					} else {
+						appCtx.connect(n)
+					}
+					OnDNSConfigChanged(n.Name)
+				}
+				select {
+				case st := <-settled:
+					if st != tt.want {
+						t.Errorf("settled on %+v, want %+v", st, tt.want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for networkSettledEvent")
+				}
+				// 再等待若干个去抖周期，确认没有多余的 networkSettledEvent
+				time.Sleep(200 * time.Millisecond)
+			})
+			if n := len(settled); n != 0 {
+				t.Errorf("%d extra networkSettledEvents", n)
+			}
+			if applied != 1 || dropped != 0 {
+				t.Errorf("applied = %d, dropped = %d; want 1 and 0", applied, dropped)
+			}
+			// 事件队列逐个投递，部分变化可能在上一次生效前才到达，最多合并 len(flaps)-1 次
+			if coalesced > int64(len(tt.flaps)-1) {
+				t.Errorf("coalesced = %d, want at most %d", coalesced, len(tt.flaps)-1)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// netmapdelta.go 实现 NetMap 增量通知：对比相邻两次 NetMap，只下发新增、删除、变化的 peer，减少大 tailnet 下的跨语言传输量。
+package libtailscale
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// androidNotify 在 ipn.Notify 基础上追加 Android 扩展字段，序列化后字段平铺在同一层 JSON 中。
+type androidNotify struct {
+	*ipn.Notify
+
+	// NetMapDelta 非 nil 时表示本条通知的 NetMap 以增量形式下发。
+	NetMapDelta *netmapDelta `json:",omitempty"`
+	// Lockdown 非 nil 时表示锁定模式状态发生了变化，见 lockdown.go。
+	Lockdown *lockdownStatus `json:",omitempty"`
+	// VPN 非 nil 时表示 VPN 会话状态发生了变化，见 vpnsession.go。
+	VPN *vpnStatus `json:",omitempty"`
+	// Network 非 nil 时表示网络类型或据此生效的限制发生了变化，见 netpolicy.go。
+	Network *networkStatus `json:",omitempty"`
+}
+
+// netmapDelta 描述相对上一条 NetMap 的变化。
+// Full 为 true 时完整 NetMap 位于通知的 NetMap 字段中，接收方应丢弃本地副本并以此为准；
+// 否则 Header 携带除 Peers 外的 NetMap 字段，Peers 需按三个列表在本地副本上增删改。
+type netmapDelta struct {
+	// Seq 从 1 开始单调递增，接收方发现不连续时应调用 NotificationManager.ResyncNetMap。
+	Seq  uint64
+	Full bool `json:",omitempty"`
+
+	Header       *netmap.NetworkMap `json:",omitempty"`
+	PeersAdded   []tailcfg.NodeView `json:",omitempty"`
+	PeersChanged []tailcfg.NodeView `json:",omitempty"`
+	PeersRemoved []tailcfg.NodeID   `json:",omitempty"`
+}
+
+// netmapDiffer 保存单个订阅者最近一次下发的 NetMap，用于计算下一次增量。
+type netmapDiffer struct {
+	mu       sync.Mutex
+	seq      uint64             // 最近一次下发的序号
+	last     *netmap.NetworkMap // 最近一次下发的 NetMap
+	needFull bool               // 下一次必须全量下发
+}
+
+// newNetmapDiffer 创建 netmapDiffer，首次下发总是全量。
+func newNetmapDiffer() *netmapDiffer {
+	return &netmapDiffer{needFull: true}
+}
+
+// apply 将通知中的 NetMap 转换为增量形式。不含 NetMap 的通知原样返回。
+func (d *netmapDiffer) apply(n *ipn.Notify) *androidNotify {
+	if n.NetMap == nil {
+		return &androidNotify{Notify: n}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	nm := n.NetMap
+	d.seq++
+	delta := &netmapDelta{Seq: d.seq}
+	if d.needFull || d.last == nil {
+		d.needFull = false
+		d.last = nm
+		delta.Full = true
+		return &androidNotify{Notify: n, NetMapDelta: delta}
+	}
+
+	header := *nm
+	header.Peers = nil
+	delta.Header = &header
+	delta.PeersAdded, delta.PeersChanged, delta.PeersRemoved = diffPeers(d.last.Peers, nm.Peers)
+	d.last = nm
+
+	cp := *n
+	cp.NetMap = nil
+	return &androidNotify{Notify: &cp, NetMapDelta: delta}
+}
+
+// resync 要求下一次下发全量 NetMap，并返回最近一份 NetMap 以便立即重新下发（可能为 nil）。
+func (d *netmapDiffer) resync() *netmap.NetworkMap {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.needFull = true
+	return d.last
+}
+
+// diffPeers 对比两组 peer，返回新增、变化和删除的部分，结果按 Node.ID 排序。
+// NetMap 中的 peer 通常已按 Node.ID 排序；未排序时先排序副本，不修改传入的切片。
+func diffPeers(old, cur []tailcfg.NodeView) (added, changed []tailcfg.NodeView, removed []tailcfg.NodeID) {
+	old, cur = sortedPeers(old), sortedPeers(cur)
+	i, j := 0, 0
+	for i < len(old) && j < len(cur) {
+		o, c := old[i], cur[j]
+		switch {
+		case o.ID() == c.ID():
+			if !o.Equal(c) {
+				changed = append(changed, c)
+			}
+			i++
+			j++
+		case o.ID() < c.ID():
+			removed = append(removed, o.ID())
+			i++
+		default:
+			added = append(added, c)
+			j++
+		}
+	}
+	for ; i < len(old); i++ {
+		removed = append(removed, old[i].ID())
+	}
+	added = append(added, cur[j:]...)
+	return added, changed, removed
+}
+
+// sortedPeers 返回按 Node.ID 排序的 peers，已排序时原样返回。
+func sortedPeers(peers []tailcfg.NodeView) []tailcfg.NodeView {
+	byID := func(a, b tailcfg.NodeView) int { return cmp.Compare(a.ID(), b.ID()) }
+	if slices.IsSortedFunc(peers, byID) {
+		return peers
+	}
+	return slices.SortedFunc(slices.Values(peers), byID)
+}
@@ -0,0 +1,180 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// peer 返回 ID 为 id、名称为 name 的 peer。
+func peer(id tailcfg.NodeID, name string) tailcfg.NodeView {
+	return (&tailcfg.Node{ID: id, Name: name}).View()
+}
+
+func peerIDs(peers []tailcfg.NodeView) []tailcfg.NodeID {
+	var ids []tailcfg.NodeID
+	for _, p := range peers {
+		ids = append(ids, p.ID())
+	}
+	return ids
+}
+
+func TestDiffPeers(t *testing.T) {
+	tests := []struct {
+		name        string
+		old, cur    []tailcfg.NodeView
+		wantAdded   []tailcfg.NodeID
+		wantChanged []tailcfg.NodeID
+		wantRemoved []tailcfg.NodeID
+	}{
+		{name: "both empty"},
+		{
+			name:      "all added",
+			cur:       []tailcfg.NodeView{peer(1, "a"), peer(2, "b")},
+			wantAdded: []tailcfg.NodeID{1, 2},
+		},
+		{
+			name:        "all removed",
+			old:         []tailcfg.NodeView{peer(1, "a"), peer(2, "b")},
+			wantRemoved: []tailcfg.NodeID{1, 2},
+		},
+		{
+			name: "unchanged",
+			old:  []tailcfg.NodeView{peer(1, "a"), peer(2, "b")},
+			cur:  []tailcfg.NodeView{peer(1, "a"), peer(2, "b")},
+		},
+		{
+			name:        "added, changed and removed",
+			old:         []tailcfg.NodeView{peer(1, "a"), peer(3, "c"), peer(5, "e"), peer(7, "g")},
+			cur:         []tailcfg.NodeView{peer(2, "b"), peer(3, "c2"), peer(5, "e"), peer(8, "h")},
+			wantAdded:   []tailcfg.NodeID{2, 8},
+			wantChanged: []tailcfg.NodeID{3},
+			wantRemoved: []tailcfg.NodeID{1, 7},
+		},
+		{
+			name:        "unsorted input",
+			old:         []tailcfg.NodeView{peer(7, "g"), peer(1, "a"), peer(3, "c")},
+			cur:         []tailcfg.NodeView{peer(3, "c2"), peer(8, "h"), peer(2, "b"), peer(7, "g")},
+			wantAdded:   []tailcfg.NodeID{2, 8},
+			wantChanged: []tailcfg.NodeID{3},
+			wantRemoved: []tailcfg.NodeID{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, cur := slices.Clone(tt.old), slices.Clone(tt.cur)
+			added, changed, removed := diffPeers(old, cur)
+			if got := peerIDs(added); !slices.Equal(got, tt.wantAdded) {
+				t.Errorf("added = %v, want %v", got, tt.wantAdded)
+			}
+			if got := peerIDs(changed); !slices.Equal(got, tt.wantChanged) {
+				t.Errorf("changed = %v, want %v", got, tt.wantChanged)
+			}
+			if !slices.Equal(removed, tt.wantRemoved) {
+				t.Errorf("removed = %v, want %v", removed, tt.wantRemoved)
+			}
+			if !slices.Equal(peerIDs(old), peerIDs(tt.old)) || !slices.Equal(peerIDs(cur), peerIDs(tt.cur)) {
+				t.Error("diffPeers reordered its input")
+			}
+		})
+	}
+}
+
+// TestNetmapDifferSeq 序号从 1 起连续递增；首次、resync 后为全量，其余为增量，不含 NetMap 的通知不占序号。
+func TestNetmapDifferSeq(t *testing.T) {
+	d := newNetmapDiffer()
+	nm := func(peers ...tailcfg.NodeView) *ipn.Notify {
+		return &ipn.Notify{NetMap: &netmap.NetworkMap{Domain: "example.ts.net", Peers: peers}}
+	}
+	st := ipn.Running
+	steps := []struct {
+		name     string
+		n        *ipn.Notify
+		resync   bool
+		wantSeq  uint64
+		wantFull bool
+	}{
+		{name: "first netmap", n: nm(peer(1, "a")), wantSeq: 1, wantFull: true},
+		{name: "delta", n: nm(peer(1, "a"), peer(2, "b")), wantSeq: 2},
+		{name: "no netmap", n: &ipn.Notify{State: &st}},
+		{name: "delta after other notify", n: nm(peer(2, "b")), wantSeq: 3},
+		{name: "after resync", n: nm(peer(2, "b")), resync: true, wantSeq: 4, wantFull: true},
+		{name: "delta after resync", n: nm(peer(2, "b2")), wantSeq: 5},
+	}
+	for _, s := range steps {
+		if s.resync {
+			d.resync()
+		}
+		v := d.apply(s.n)
+		if s.wantSeq == 0 {
+			if v.NetMapDelta != nil || v.Notify != s.n {
+				t.Errorf("%s: notify without NetMap was changed", s.name)
+			}
+			continue
+		}
+		if v.NetMapDelta == nil {
+			t.Fatalf("%s: no NetMapDelta", s.name)
+		}
+		if v.NetMapDelta.Seq != s.wantSeq || v.NetMapDelta.Full != s.wantFull {
+			t.Errorf("%s: Seq %d Full %v, want Seq %d Full %v", s.name, v.NetMapDelta.Seq, v.NetMapDelta.Full, s.wantSeq, s.wantFull)
+		}
+		if s.wantFull {
+			if v.NetMap != s.n.NetMap || v.NetMapDelta.Header != nil {
+				t.Errorf("%s: full delta should carry the NetMap and no header", s.name)
+			}
+			continue
+		}
+		if v.NetMap != nil {
+			t.Errorf("%s: delta still carries the full NetMap", s.name)
+		}
+		if h := v.NetMapDelta.Header; h == nil || h.Domain != "example.ts.net" || h.Peers != nil {
+			t.Errorf("%s: header = %+v, want domain without peers", s.name, h)
+		}
+		if s.n.NetMap.Peers == nil {
+			t.Errorf("%s: apply modified the shared NetMap", s.name)
+		}
+	}
+}
+
+// TestResyncNetMap 接收方发现序号不连续时调用 ResyncNetMap，立即收到带下一个序号的全量 NetMap。
+func TestResyncNetMap(t *testing.T) {
+	nm := &notificationManager{
+		ctx:    context.Background(),
+		queue:  newNotifyQueue(false),
+		differ: newNetmapDiffer(),
+	}
+	// 未收到过 NetMap 时没有可重发的内容
+	nm.ResyncNetMap()
+	if n, _ := nm.queue.next(time.Now()); n != nil {
+		t.Fatalf("ResyncNetMap before any NetMap queued %s", notifyKinds(n))
+	}
+
+	last := &netmap.NetworkMap{Domain: "b", Peers: []tailcfg.NodeView{peer(1, "a")}}
+	nm.differ.apply(&ipn.Notify{NetMap: &netmap.NetworkMap{Domain: "a"}})
+	nm.differ.apply(&ipn.Notify{NetMap: last})
+
+	nm.ResyncNetMap()
+	n, _ := nm.queue.next(time.Now())
+	if n == nil || n.NetMap != last {
+		t.Fatalf("ResyncNetMap queued %v, want the last NetMap", n)
+	}
+	v := nm.differ.apply(n)
+	if d := v.NetMapDelta; d == nil || !d.Full || d.Seq != 3 {
+		t.Errorf("resent NetMap delta = %+v, want Full with Seq 3", d)
+	}
+
+	// 未开启 NotifyNetMapDelta 时为空操作
+	plain := &notificationManager{queue: newNotifyQueue(false)}
+	plain.ResyncNetMap()
+	if n, _ := plain.queue.next(time.Now()); n != nil {
+		t.Errorf("ResyncNetMap without delta queued %s", notifyKinds(n))
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// netpolicy.go 按当前网络类型调整后端行为：蜂窝网络下暂停 Taildrop 与代理共享，
+// 按流量计费的网络下降低日志上传频率，漫游时拒绝充当出口节点。
+// 网络类型来自接口快照（见 ifsnapshot.go），每项行为都需由 Android 专有策略显式开启，未配置时行为不变。
+// 计费、漫游标志变化时 Android 侧通过 OnNetworkCapabilitiesChanged 通知，见 callbacks.go。
+package libtailscale
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/util/syspolicy"
+)
+
+const (
+	// cellularPauseSharingPolicyKey 蜂窝网络下是否暂停 Taildrop 与代理共享，未设置时关闭。
+	cellularPauseSharingPolicyKey = "CellularPauseSharing"
+	// meteredReduceLoggingPolicyKey 按流量计费的网络下是否降低日志上传频率，未设置时关闭。
+	meteredReduceLoggingPolicyKey = "MeteredReduceLogging"
+	// roamingBlockExitNodePolicyKey 漫游时是否拒绝充当出口节点，未设置时关闭。
+	roamingBlockExitNodePolicyKey = "RoamingBlockExitNode"
+
+	// exitNodePausedPrefKey 标记出口节点因漫游被撤下，漫游结束（包括进程重启后）据此恢复。
+	exitNodePausedPrefKey = "exitnodepausedroaming"
+	// networkStatusEndpoint 查询当前网络状态的 Android 扩展 LocalAPI。
+	networkStatusEndpoint = "/localapi/v0/android/network"
+	// filePutEndpointPrefix 发送 Taildrop 文件的 LocalAPI 路径前缀。
+	filePutEndpointPrefix = "/localapi/v0/file-put/"
+)
+
+const (
+	// defaultLogFlushDelay 默认的日志批量上传间隔。
+	defaultLogFlushDelay = 2 * time.Minute
+	// meteredLogFlushDelay 按流量计费的网络下的日志批量上传间隔。
+	meteredLogFlushDelay = 15 * time.Minute
+)
+
+// errTaildropPaused 表示蜂窝网络下 Taildrop 已暂停。
+var errTaildropPaused = errors.New("Taildrop is paused on cellular networks")
+
+// networkStatus 当前默认网络的类型与据此生效的限制，通过通知的 Network 字段下发给 Android 侧。
+type networkStatus struct {
+	Interface     string `json:",omitempty"` // 默认网络接口名，离线时为空
+	Type          string `json:",omitempty"` // wifi、cellular、ethernet 或 other，未知时为空
+	Metered       bool   `json:",omitempty"`
+	Roaming       bool   `json:",omitempty"`
+	CaptivePortal bool   `json:",omitempty"` // 网络需要登录认证页面
+
+	TaildropPaused  bool `json:",omitempty"` // Taildrop 收发已暂停
+	ProxyPaused     bool `json:",omitempty"` // 代理共享已停止
+	LogsReduced     bool `json:",omitempty"` // 日志上传间隔已延长
+	ExitNodeBlocked bool `json:",omitempty"` // 拒绝充当出口节点
+
+	PortalDetected bool `json:",omitempty"` // Go 侧探测到强制门户，见 captive.go
+	TUNHeld        bool `json:",omitempty"` // 因强制门户暂缓建立 TUN
+}
+
+// networkState 由 App 持有的网络状态，跨后端重启保留，所有字段由 mu 保护。
+type networkState struct {
+	mu     sync.Mutex
+	status networkStatus
+	// changed 状态变化时调用，用于唤醒通知订阅者。
+	changed func()
+}
+
+// newNetworkState 创建空的网络状态，changed 可为 nil。
+func newNetworkState(changed func()) *networkState {
+	return &networkState{changed: changed}
+}
+
+// get 返回当前网络状态。
+func (s *networkState) get() networkStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// set 更新网络状态并返回旧值，状态变化时调用 changed。
+func (s *networkState) set(st networkStatus) (old networkStatus) {
+	s.mu.Lock()
+	old = s.status
+	s.status = st
+	s.mu.Unlock()
+	if old != st && s.changed != nil {
+		s.changed()
+	}
+	return old
+}
+
+// update 在锁内修改网络状态，状态变化时调用 changed。
+func (s *networkState) update(f func(*networkStatus)) {
+	s.mu.Lock()
+	old := s.status
+	f(&s.status)
+	st := s.status
+	s.mu.Unlock()
+	if old != st && s.changed != nil {
+		s.changed()
+	}
+}
+
+// policyEnabled 读取布尔型 Android 专有策略，未设置或读取失败时返回 false。
+func (b *backend) policyEnabled(key string) bool {
+	if b.policy == nil {
+		return false
+	}
+	on, err := b.policy.ReadBoolean(key)
+	if err != nil {
+		if !errors.Is(err, syspolicy.ErrNoSuchKey) {
+			log.Printf("netpolicy: read %s policy: %v", key, err)
+		}
+		return false
+	}
+	return on
+}
+
+// lookupNetwork 从接口快照中查找 ifname 的网络类型，并按策略计算应生效的限制。
+// 旧版文本快照不含网络类型，此时不施加任何限制。
+func (b *backend) lookupNetwork(ifname string) networkStatus {
+	st := networkStatus{Interface: ifname}
+	if ifname == "" || b.snapshotInterfaces == nil {
+		return st
+	}
+	snap, err := b.snapshotInterfaces()
+	if err != nil {
+		log.Printf("netpolicy: interface snapshot: %v", err)
+		return st
+	}
+	for _, info := range snap.Interfaces {
+		if info.Name != ifname {
+			continue
+		}
+		st.Type = info.Type
+		st.Metered = info.Metered
+		st.Roaming = info.Roaming
+		st.CaptivePortal = info.CaptivePortal
+		break
+	}
+	if st.Type == ifaceTypeCellular && b.policyEnabled(cellularPauseSharingPolicyKey) {
+		st.TaildropPaused = true
+		st.ProxyPaused = true
+	}
+	st.LogsReduced = st.Metered && b.policyEnabled(meteredReduceLoggingPolicyKey)
+	st.ExitNodeBlocked = st.Roaming && b.policyEnabled(roamingBlockExitNodePolicyKey)
+	return st
+}
+
+// updateNetworkStatus 默认网络或策略变化时重新计算网络状态，并对变化的限制生效。
+func (b *backend) updateNetworkStatus(ifname string) {
+	b.meteredFlushDelay.Store(int64(b.policyMeteredFlushDelay()))
+	st := b.lookupNetwork(ifname)
+	// 强制门户状态由探测结果维护，见 captive.go
+	cur := b.network.get()
+	st.PortalDetected, st.TUNHeld = cur.PortalDetected, cur.TUNHeld
+	old := b.network.set(st)
+	if old == st {
+		return
+	}
+	log.Printf("netpolicy: network %q type=%q metered=%v roaming=%v captive=%v", st.Interface, st.Type, st.Metered, st.Roaming, st.CaptivePortal)
+	if st.ProxyPaused != old.ProxyPaused {
+		if st.ProxyPaused {
+			log.Printf("netpolicy: cellular network, pausing proxy sharing")
+			stopProxyService()
+		} else if b.lastCfg != nil && b.hasTUNProvider() {
+			log.Printf("netpolicy: resuming proxy sharing")
+			startProxyService()
+		}
+	}
+	if st.CaptivePortal != old.CaptivePortal && st.Interface == old.Interface && b.captive != nil {
+		// Android 侧门户标志变化而接口未变（例如用户刚完成登录），netmon 不会触发重新探测
+		b.captive.start(st.Interface)
+	}
+	if st.LogsReduced != old.LogsReduced {
+		log.Printf("netpolicy: metered=%v, log flush delay %v", st.LogsReduced, b.logFlushDelay())
+	}
+	// 进程首次得到网络状态时 old 为空值，也尝试恢复上次进程漫游时撤下的出口节点
+	if st.ExitNodeBlocked != old.ExitNodeBlocked || old == (networkStatus{}) {
+		if st.ExitNodeBlocked {
+			go b.withdrawExitNode(b.backend.Prefs())
+		} else {
+			go b.restoreExitNode()
+		}
+	}
+}
+
+// logFlushDelay 返回当前的日志批量上传间隔，作为 logtail 的 FlushDelayFn。
+func (b *backend) logFlushDelay() time.Duration {
+	if b.network != nil && b.network.get().LogsReduced {
+		if d := time.Duration(b.meteredFlushDelay.Load()); d > 0 {
+			return d
+		}
+		return meteredLogFlushDelay
+	}
+	return defaultLogFlushDelay
+}
+
+// policyMeteredFlushDelay 读取 meteredLogFlushMinutesPolicyKey 策略，未设置、为 0 或读取失败时返回 meteredLogFlushDelay。
+// 策略值不小于默认上传间隔，避免在按流量计费的网络下反而更频繁地上传。
+func (b *backend) policyMeteredFlushDelay() time.Duration {
+	if b.policy == nil {
+		return meteredLogFlushDelay
+	}
+	mins, err := b.policy.ReadUInt64(meteredLogFlushMinutesPolicyKey)
+	if err != nil {
+		if !errors.Is(err, syspolicy.ErrNoSuchKey) {
+			log.Printf("netpolicy: read %s policy: %v", meteredLogFlushMinutesPolicyKey, err)
+		}
+		return meteredLogFlushDelay
+	}
+	if mins == 0 {
+		return meteredLogFlushDelay
+	}
+	return max(time.Duration(min(mins, 24*60))*time.Minute, defaultLogFlushDelay)
+}
+
+// withdrawExitNode 漫游期间撤下出口节点广播，并记录以便漫游结束后恢复。
+// 漫游期间重新开启的出口节点同样会被撤下。
+func (b *backend) withdrawExitNode(prefs ipn.PrefsView) {
+	if !prefs.Valid() || !prefs.AdvertisesExitNode() {
+		return
+	}
+	log.Printf("netpolicy: roaming, withdrawing exit node advertisement")
+	if err := b.store.WriteBool(exitNodePausedPrefKey, true); err != nil {
+		log.Printf("netpolicy: write %s: %v", exitNodePausedPrefKey, err)
+	}
+	b.setAdvertiseExitNode(prefs, false)
+}
+
+// restoreExitNode 漫游结束后恢复因漫游撤下的出口节点广播。
+func (b *backend) restoreExitNode() {
+	paused, err := b.store.ReadBool(exitNodePausedPrefKey, false)
+	if err != nil {
+		log.Printf("netpolicy: read %s: %v", exitNodePausedPrefKey, err)
+	}
+	if !paused {
+		return
+	}
+	if err := b.store.WriteBool(exitNodePausedPrefKey, false); err != nil {
+		log.Printf("netpolicy: write %s: %v", exitNodePausedPrefKey, err)
+	}
+	prefs := b.backend.Prefs()
+	if !prefs.Valid() || prefs.AdvertisesExitNode() {
+		return
+	}
+	log.Printf("netpolicy: roaming ended, restoring exit node advertisement")
+	b.setAdvertiseExitNode(prefs, true)
+}
+
+// setAdvertiseExitNode 在 prefs 的基础上开启或关闭出口节点广播，保留其他子网路由。
+func (b *backend) setAdvertiseExitNode(prefs ipn.PrefsView, on bool) {
+	mp := &ipn.MaskedPrefs{AdvertiseRoutesSet: true}
+	mp.AdvertiseRoutes = prefs.AdvertiseRoutes().AsSlice()
+	mp.SetAdvertiseExitNode(on)
+	if _, err := b.backend.EditPrefs(mp); err != nil {
+		log.Printf("netpolicy: set exit node advertisement to %v: %v", on, err)
+	}
+}
+
+// checkNetworkPolicy 拒绝当前网络状态下被暂停的 LocalAPI 调用。
+func (app *App) checkNetworkPolicy(endpoint string) error {
+	if strings.HasPrefix(endpoint, filePutEndpointPrefix) && app.network.get().TaildropPaused {
+		return errTaildropPaused
+	}
+	return nil
+}
+
+// networkStatusHandler 处理 networkStatusEndpoint，GET 返回当前网络状态。
+type networkStatusHandler struct {
+	network *networkState
+}
+
+// ServeHTTP 以 JSON 返回当前网络状态。
+func (h networkStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.network.get())
+}
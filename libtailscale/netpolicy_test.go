@@ -0,0 +1,291 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tsd"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/logid"
+	"tailscale.com/wgengine"
+)
+
+var (
+	testWiFi = interfaceInfo{Name: "wlan0", Up: true, Type: ifaceTypeWiFi}
+	testLTE  = interfaceInfo{Name: "rmnet_data0", Up: true, Type: ifaceTypeCellular, Metered: true}
+	// testRoaming 漫游中的蜂窝网络。
+	testRoaming = interfaceInfo{Name: "rmnet_data1", Up: true, Type: ifaceTypeCellular, Metered: true, Roaming: true}
+)
+
+// newNetPolicyTestBackend 返回以 ifaces 为接口快照、按 policy 读取策略的 backend。
+func newNetPolicyTestBackend(policy *fakePolicyAppContext, ifaces ...interfaceInfo) *backend {
+	a := &App{appCtx: policy}
+	a.policyStore = &syspolicyHandler{a: a}
+	return &backend{
+		appCtx:  policy,
+		policy:  a.policyStore,
+		store:   newStateStore(newMemStateStore(), stateStoreMemory),
+		network: newNetworkState(nil),
+		snapshotInterfaces: func() (*interfaceSnapshot, error) {
+			return &interfaceSnapshot{Version: interfaceSnapshotVersion, Interfaces: ifaces}, nil
+		},
+	}
+}
+
+func TestLookupNetwork(t *testing.T) {
+	allPolicies := map[string]bool{
+		cellularPauseSharingPolicyKey: true,
+		meteredReduceLoggingPolicyKey: true,
+		roamingBlockExitNodePolicyKey: true,
+	}
+	tests := []struct {
+		name   string
+		ifname string
+		policy map[string]bool
+		snap   func() (*interfaceSnapshot, error) // 为 nil 时使用 testWiFi、testLTE 与 testRoaming
+		want   networkStatus
+	}{
+		{name: "offline", ifname: "", policy: allPolicies},
+		{name: "interface not in snapshot", ifname: "tun9", policy: allPolicies, want: networkStatus{Interface: "tun9"}},
+		{name: "wifi", ifname: "wlan0", policy: allPolicies, want: networkStatus{Interface: "wlan0", Type: ifaceTypeWiFi}},
+		{
+			name:   "cellular without policies",
+			ifname: "rmnet_data1",
+			want:   networkStatus{Interface: "rmnet_data1", Type: ifaceTypeCellular, Metered: true, Roaming: true},
+		},
+		{
+			name:   "cellular pause",
+			ifname: "rmnet_data0",
+			policy: map[string]bool{cellularPauseSharingPolicyKey: true},
+			want: networkStatus{
+				Interface: "rmnet_data0", Type: ifaceTypeCellular, Metered: true,
+				TaildropPaused: true, ProxyPaused: true,
+			},
+		},
+		{
+			name:   "metered reduce logging",
+			ifname: "rmnet_data0",
+			policy: map[string]bool{meteredReduceLoggingPolicyKey: true},
+			want:   networkStatus{Interface: "rmnet_data0", Type: ifaceTypeCellular, Metered: true, LogsReduced: true},
+		},
+		{
+			name:   "roaming blocks exit node",
+			ifname: "rmnet_data1",
+			policy: map[string]bool{roamingBlockExitNodePolicyKey: true},
+			want:   networkStatus{Interface: "rmnet_data1", Type: ifaceTypeCellular, Metered: true, Roaming: true, ExitNodeBlocked: true},
+		},
+		{
+			name:   "roaming policy off",
+			ifname: "rmnet_data1",
+			policy: map[string]bool{roamingBlockExitNodePolicyKey: false},
+			want:   networkStatus{Interface: "rmnet_data1", Type: ifaceTypeCellular, Metered: true, Roaming: true},
+		},
+		{
+			name:   "legacy snapshot without types",
+			ifname: "rmnet_data0",
+			policy: allPolicies,
+			snap: func() (*interfaceSnapshot, error) {
+				return &interfaceSnapshot{Interfaces: []interfaceInfo{{Name: "rmnet_data0", Up: true}}}, nil
+			},
+			want: networkStatus{Interface: "rmnet_data0"},
+		},
+		{
+			name:   "snapshot error",
+			ifname: "rmnet_data0",
+			policy: allPolicies,
+			snap:   func() (*interfaceSnapshot, error) { return nil, errors.New("no interfaces") },
+			want:   networkStatus{Interface: "rmnet_data0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newNetPolicyTestBackend(&fakePolicyAppContext{bools: tt.policy}, testWiFi, testLTE, testRoaming)
+			if tt.snap != nil {
+				b.snapshotInterfaces = tt.snap
+			}
+			if got := b.lookupNetwork(tt.ifname); got != tt.want {
+				t.Errorf("lookupNetwork(%q) = %+v, want %+v", tt.ifname, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUpdateNetworkStatus 切换网络时按新网络更新状态与 Taildrop 限制，保留强制门户探测的结果。
+func TestUpdateNetworkStatus(t *testing.T) {
+	policy := &fakePolicyAppContext{bools: map[string]bool{cellularPauseSharingPolicyKey: true}}
+	b := newNetPolicyTestBackend(policy, testWiFi, testLTE)
+	changes := 0
+	b.network = newNetworkState(func() { changes++ })
+	app := &App{network: b.network}
+
+	steps := []struct {
+		ifname      string
+		wantPaused  bool
+		wantChanges int
+	}{
+		{ifname: "wlan0", wantChanges: 1},
+		{ifname: "wlan0", wantChanges: 1}, // 未变化时不通知
+		{ifname: "rmnet_data0", wantPaused: true, wantChanges: 2},
+		{ifname: "wlan0", wantChanges: 3},
+	}
+	for _, s := range steps {
+		b.updateNetworkStatus(s.ifname)
+		st := b.network.get()
+		if st.Interface != s.ifname || st.TaildropPaused != s.wantPaused || st.ProxyPaused != s.wantPaused {
+			t.Errorf("on %s: status = %+v, want Taildrop and proxy paused %v", s.ifname, st, s.wantPaused)
+		}
+		err := app.checkNetworkPolicy(filePutEndpointPrefix + "node/file.txt")
+		if s.wantPaused != errors.Is(err, errTaildropPaused) {
+			t.Errorf("on %s: checkNetworkPolicy = %v, want paused %v", s.ifname, err, s.wantPaused)
+		}
+		if changes != s.wantChanges {
+			t.Errorf("on %s: %d change notifications, want %d", s.ifname, changes, s.wantChanges)
+		}
+	}
+
+	b.network.update(func(st *networkStatus) { st.PortalDetected, st.TUNHeld = true, true })
+	b.updateNetworkStatus("rmnet_data0")
+	if st := b.network.get(); !st.PortalDetected || !st.TUNHeld {
+		t.Errorf("network change cleared the captive portal probe result: %+v", st)
+	}
+
+	// 策略关闭后在同一网络上重新计算即解除暂停
+	policy.bools[cellularPauseSharingPolicyKey] = false
+	b.updateNetworkStatus("rmnet_data0")
+	if st := b.network.get(); st.TaildropPaused || st.ProxyPaused {
+		t.Errorf("status after the policy was turned off = %+v, want nothing paused", st)
+	}
+}
+
+func TestPolicyMeteredFlushDelay(t *testing.T) {
+	tests := []struct {
+		name string
+		ints map[string]int64 // 为 nil 时策略未设置
+		want time.Duration
+	}{
+		{name: "unset", want: meteredLogFlushDelay},
+		{name: "zero", ints: map[string]int64{meteredLogFlushMinutesPolicyKey: 0}, want: meteredLogFlushDelay},
+		{name: "negative", ints: map[string]int64{meteredLogFlushMinutesPolicyKey: -10}, want: meteredLogFlushDelay},
+		{name: "below the default interval", ints: map[string]int64{meteredLogFlushMinutesPolicyKey: 1}, want: defaultLogFlushDelay},
+		{name: "in range", ints: map[string]int64{meteredLogFlushMinutesPolicyKey: 30}, want: 30 * time.Minute},
+		{name: "capped at a day", ints: map[string]int64{meteredLogFlushMinutesPolicyKey: 100000}, want: 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &fakePolicyAppContext{
+				bools: map[string]bool{meteredReduceLoggingPolicyKey: true},
+				ints:  tt.ints,
+			}
+			b := newNetPolicyTestBackend(policy, testLTE)
+			if got := b.policyMeteredFlushDelay(); got != tt.want {
+				t.Errorf("policyMeteredFlushDelay = %v, want %v", got, tt.want)
+			}
+			// 只在按流量计费的网络下生效
+			b.updateNetworkStatus("rmnet_data0")
+			if got := b.logFlushDelay(); got != tt.want {
+				t.Errorf("logFlushDelay on a metered network = %v, want %v", got, tt.want)
+			}
+			b.network.set(networkStatus{Interface: "wlan0"})
+			if got := b.logFlushDelay(); got != defaultLogFlushDelay {
+				t.Errorf("logFlushDelay on an unmetered network = %v, want %v", got, defaultLogFlushDelay)
+			}
+		})
+	}
+
+	var b backend
+	if got := b.policyMeteredFlushDelay(); got != meteredLogFlushDelay {
+		t.Errorf("policyMeteredFlushDelay without a policy handler = %v, want %v", got, meteredLogFlushDelay)
+	}
+}
+
+// newTestLocalBackend 返回使用内存存储与假引擎、未启动的 LocalBackend。
+func newTestLocalBackend(t *testing.T) *ipnlocal.LocalBackend {
+	t.Helper()
+	sys := tsd.NewSystem()
+	sys.Set(new(mem.Store))
+	eng, err := wgengine.NewFakeUserspaceEngine(logger.Discard, sys.Set, sys.HealthTracker(), sys.UserMetricsRegistry(), sys.Bus.Get())
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	sys.Set(eng)
+	lb, err := ipnlocal.NewLocalBackend(logger.Discard, logid.PublicID{}, sys, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	t.Cleanup(lb.Shutdown)
+	return lb
+}
+
+// TestRoamingExitNode 漫游时撤下出口节点并保留其他子网路由，漫游期间重新开启的也撤下；
+// 漫游结束或进程重启后不再漫游时恢复。
+func TestRoamingExitNode(t *testing.T) {
+	subnet := netip.MustParsePrefix("10.0.0.0/24")
+	policy := &fakePolicyAppContext{bools: map[string]bool{roamingBlockExitNodePolicyKey: true}}
+	b := newNetPolicyTestBackend(policy, testWiFi, testRoaming)
+	b.backend = newTestLocalBackend(t)
+
+	advertise := func() {
+		t.Helper()
+		mp := &ipn.MaskedPrefs{AdvertiseRoutesSet: true}
+		mp.AdvertiseRoutes = append([]netip.Prefix{subnet}, tsaddr.ExitRoutes()...)
+		if _, err := b.backend.EditPrefs(mp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitExitNode := func(what string, want bool) {
+		t.Helper()
+		waitFor(t, what, func() bool { return b.backend.Prefs().AdvertisesExitNode() == want })
+		if !slices.Contains(b.backend.Prefs().AdvertiseRoutes().AsSlice(), subnet) {
+			t.Errorf("%s: subnet route %v was dropped", what, subnet)
+		}
+		if paused, _ := b.store.ReadBool(exitNodePausedPrefKey, false); paused == want {
+			t.Errorf("%s: %s = %v", what, exitNodePausedPrefKey, paused)
+		}
+	}
+
+	advertise()
+	b.updateNetworkStatus("wlan0")
+	if !b.backend.Prefs().AdvertisesExitNode() {
+		t.Fatal("exit node withdrawn on Wi-Fi")
+	}
+
+	b.updateNetworkStatus("rmnet_data1")
+	if !b.network.get().ExitNodeBlocked {
+		t.Fatal("ExitNodeBlocked not set while roaming")
+	}
+	waitExitNode("withdraw while roaming", false)
+
+	// runBackendOnce 收到重新开启出口节点的 prefs 时再次撤下
+	advertise()
+	b.withdrawExitNode(b.backend.Prefs())
+	waitExitNode("withdraw after re-enabling", false)
+
+	b.updateNetworkStatus("wlan0")
+	waitExitNode("restore after roaming", true)
+
+	// 进程在漫游期间退出：标记仍在，重启后首次得到非漫游的网络时恢复
+	b.updateNetworkStatus("rmnet_data1")
+	waitExitNode("withdraw before restart", false)
+	b.network = newNetworkState(nil)
+	b.updateNetworkStatus("wlan0")
+	waitExitNode("restore after restart", true)
+
+	// 策略关闭时漫游不撤下
+	policy.bools[roamingBlockExitNodePolicyKey] = false
+	b.updateNetworkStatus("rmnet_data1")
+	time.Sleep(50 * time.Millisecond)
+	if !b.backend.Prefs().AdvertisesExitNode() {
+		t.Error("exit node withdrawn while roaming with the policy off")
+	}
+}
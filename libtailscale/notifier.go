@@ -8,13 +8,33 @@ import (
 	"context"       // 用于通知监听的上下文管理，实现取消与超时
 	"encoding/json" // 通知序列化为 JSON，便于跨语言传递
 	"log"           // 日志输出，便于调试和异常追踪
-	"runtime/debug" // panic 时打印堆栈，便于定位问题
 
-	"tailscale.com/ipn" // 通知结构体与选项定义
+	"tailscale.com/ipn"          // 通知结构体与选项定义
+	"tailscale.com/ipn/ipnlocal" // 后端重启后重新挂接订阅
+	"tailscale.com/util/set"     // 订阅登记
+)
+
+// Android 侧扩展的通知掩码位，位于 ipn.NotifyWatchOpt 已用位之外，传给后端前会被剥离。
+const (
+	// NotifyFilterState 仅转发携带 State 的通知，且只保留 State 字段。
+	NotifyFilterState = 1 << 24
+	// NotifyFilterNetMap 仅转发携带 NetMap 的通知，且只保留 NetMap 字段。
+	NotifyFilterNetMap = 1 << 25
+	// NotifyFilterHealth 仅转发携带 Health 的通知，且只保留 Health 字段。
+	NotifyFilterHealth = 1 << 26
+	// NotifyCoalesceNetMaps 合并短时间内的多次 NetMap 更新，按 netmapCoalesceInterval 限速投递最新一份。
+	NotifyCoalesceNetMaps = 1 << 27
+	// NotifyNetMapDelta 以 NetMapDelta 增量形式下发 NetMap，见 netmapDelta。
+	NotifyNetMapDelta = 1 << 28
+
+	// notifyFilterMask 所有字段过滤位。
+	notifyFilterMask = NotifyFilterState | NotifyFilterNetMap | NotifyFilterHealth
+	// androidNotifyMask 所有 Android 扩展位，不能传给 LocalBackend。
+	androidNotifyMask = notifyFilterMask | NotifyCoalesceNetMaps | NotifyNetMapDelta
 )
 
 // WatchNotifications 启动通知监听，异步接收并分发 Tailscale 后端的通知。
-// mask: 通知掩码，指定感兴趣的通知类型。
+// mask: 通知掩码，指定感兴趣的通知类型，可叠加 NotifyFilter*、NotifyCoalesceNetMaps 与 NotifyNetMapDelta 扩展位。
 // cb: 通知回调接口，负责处理每条通知。
 // 返回 NotificationManager，可用于后续取消监听。
 func (app *App) WatchNotifications(mask int, cb NotificationCallback) NotificationManager {
@@ -23,40 +43,175 @@ func (app *App) WatchNotifications(mask int, cb NotificationCallback) Notificati
 
 	// 创建可取消的上下文，便于后续主动停止监听。
 	ctx, cancel := context.WithCancel(context.Background())
-	// 启动后端通知监听，采用 goroutine 异步处理，避免阻塞主线程。
-	go app.backend.WatchNotifications(ctx, ipn.NotifyWatchOpt(mask), func() {}, func(notify *ipn.Notify) bool {
-		// 捕获 panic，防止回调异常导致 goroutine 泄漏。
+
+	// 后端回调只做过滤与入队，序列化和 Kotlin 回调都在投递协程中完成，
+	// 避免慢回调阻塞后端通知总线。
+	nm := &notificationManager{
+		app:    app,
+		opts:   ipn.NotifyWatchOpt(mask &^ androidNotifyMask),
+		filter: mask & notifyFilterMask,
+		ctx:    ctx,
+		cancel: cancel,
+		queue:  newNotifyQueue(mask&NotifyCoalesceNetMaps != 0),
+	}
+	if mask&NotifyNetMapDelta != 0 {
+		nm.differ = newNetmapDiffer()
+	}
+	differ := nm.differ
+	// lastLockdown、lastVPN、lastNetwork 最近一次下发给该订阅者的锁定状态、VPN 会话状态与网络状态，仅由投递协程访问。
+	var (
+		lastLockdown lockdownStatus
+		lastVPN      vpnStatus
+		lastNetwork  networkStatus
+	)
+	go nm.queue.run(ctx, func(notify *ipn.Notify) {
+		// 捕获 panic 交给 supervisor，本条通知丢弃，投递协程继续处理后续通知。
 		defer func() {
 			if p := recover(); p != nil {
-				log.Printf("panic in WatchNotifications %s: %s", p, debug.Stack())
-				panic(p)
+				reportPanic("WatchNotifications", p)
 			}
 		}()
 
 		// 将通知结构体序列化为 JSON，便于 Android 侧或其他语言处理。
-		b, err := json.Marshal(notify)
+		v := &androidNotify{Notify: notify}
+		if differ != nil {
+			v = differ.apply(notify)
+		}
+		// 锁定状态、VPN 会话状态与网络状态变化时随本条通知下发；仅用于唤醒的空通知在状态均未变时直接丢弃。
+		if ld := app.lockdown.get(); ld != lastLockdown {
+			lastLockdown = ld
+			v.Lockdown = &ld
+		}
+		if vs := app.vpn.status(); vs != lastVPN {
+			lastVPN = vs
+			v.VPN = &vs
+		}
+		if ns := app.network.get(); ns != lastNetwork {
+			lastNetwork = ns
+			v.Network = &ns
+		}
+		if v.Lockdown == nil && v.VPN == nil && v.Network == nil && isEmptyNotify(notify) {
+			return
+		}
+		b, err := json.Marshal(v)
 		if err != nil {
 			log.Printf("error: WatchNotifications: marshal notify: %s", err)
-			return true // 返回 true 继续监听，避免因单条错误中断整体监听
+			return // 单条错误不中断整体监听
 		}
 		// 调用回调接口处理通知，若处理失败记录日志。
-		err = cb.OnNotify(b)
-		if err != nil {
+		if err := cb.OnNotify(b); err != nil {
 			log.Printf("error: WatchNotifications: OnNotify: %s", err)
-			return true // 返回 true 继续监听
+			if differ != nil {
+				// 接收方可能没有应用这次增量，下一次改为全量。
+				differ.resync()
+			}
 		}
-		return true // 始终返回 true，保持监听活跃
 	})
+
+	// 登记订阅并挂接到当前后端；后端重启时 runBackendOnce 会把它挂接到新的 LocalBackend。
+	// 挂接在 backendMu 内完成，保证不会与重启时的重新挂接交错而停留在旧后端上。
+	app.backendMu.Lock()
+	defer app.backendMu.Unlock()
+	if app.ctx.Err() != nil {
+		// App 已关闭，返回一个已停止的管理器。
+		cancel()
+		return nm
+	}
+	nm.handle = app.watchers.Add(nm)
+	nm.watch(app.backend)
 	// 返回通知管理器，封装取消函数。
-	return &notificationManager{cancel}
+	return nm
+}
+
+// filterNotify 按过滤位裁剪通知。filter 为 0 时原样返回；
+// 否则仅保留选中的字段，若一个都不包含则返回 nil。
+// 后端会把同一个 Notify 分发给所有订阅者，因此这里只能复制，不能修改原值。
+func filterNotify(n *ipn.Notify, filter int) *ipn.Notify {
+	if filter == 0 {
+		return n
+	}
+	out := &ipn.Notify{Version: n.Version}
+	if filter&NotifyFilterState != 0 {
+		out.State = n.State
+	}
+	if filter&NotifyFilterNetMap != 0 {
+		out.NetMap = n.NetMap
+	}
+	if filter&NotifyFilterHealth != 0 {
+		out.Health = n.Health
+	}
+	if isEmptyNotify(out) {
+		return nil
+	}
+	return out
 }
 
 // notificationManager 封装通知监听的取消逻辑，便于外部主动停止监听。
 type notificationManager struct {
-	cancel func() // 取消函数，调用后终止监听 goroutine
+	app    *App
+	handle set.Handle         // 在 app.watchers 中的句柄
+	opts   ipn.NotifyWatchOpt // 传给 LocalBackend 的掩码（已剥离 Android 扩展位）
+	filter int                // 字段过滤位
+	ctx    context.Context    // 订阅生命周期，Stop 时取消
+	cancel func()             // 取消函数，调用后终止监听 goroutine
+	queue  *notifyQueue       // 该订阅者的通知队列
+	differ *netmapDiffer      // NetMap 增量计算器，未开启 NotifyNetMapDelta 时为 nil
+
+	// watchCancel 取消对当前 LocalBackend 的订阅，由 app.backendMu 保护。
+	watchCancel context.CancelFunc
+}
+
+// watch 把订阅挂接到 lb，并取消对上一个 LocalBackend 的订阅。调用方需持有 app.backendMu。
+func (nm *notificationManager) watch(lb *ipnlocal.LocalBackend) {
+	if nm.watchCancel != nil {
+		nm.watchCancel()
+		nm.watchCancel = nil
+	}
+	if lb == nil || nm.ctx.Err() != nil {
+		return
+	}
+	if nm.differ != nil {
+		// 新后端的 NetMap 与旧副本无关，下一次必须全量。
+		nm.differ.resync()
+	}
+	ctx, cancel := context.WithCancel(nm.ctx)
+	nm.watchCancel = cancel
+	// 启动后端通知监听，采用 goroutine 异步处理，避免阻塞主线程。
+	go lb.WatchNotifications(ctx, nm.opts, func() {}, func(notify *ipn.Notify) bool {
+		if n := filterNotify(notify, nm.filter); n != nil {
+			nm.queue.push(n)
+		}
+		return true // 始终返回 true，保持监听活跃
+	})
 }
 
 // Stop 主动停止通知监听，释放资源。
 func (nm *notificationManager) Stop() {
 	nm.cancel()
+	nm.app.backendMu.Lock()
+	delete(nm.app.watchers, nm.handle)
+	nm.app.backendMu.Unlock()
+	if n := nm.queue.droppedCount(); n > 0 {
+		log.Printf("WatchNotifications: stopped, %d notifications dropped", n)
+	}
+}
+
+// wakeWatchers 唤醒所有订阅者，使锁定状态、VPN 会话状态或网络状态的变化随下一条通知下发。
+func (app *App) wakeWatchers() {
+	app.backendMu.Lock()
+	defer app.backendMu.Unlock()
+	for _, nm := range app.watchers {
+		nm.queue.push(&ipn.Notify{})
+	}
+}
+
+// ResyncNetMap 要求重新全量下发 NetMap，接收方发现 NetMapDelta.Seq 不连续时调用。
+// 未开启 NotifyNetMapDelta 时为空操作。
+func (nm *notificationManager) ResyncNetMap() {
+	if nm.differ == nil {
+		return
+	}
+	if last := nm.differ.resync(); last != nil {
+		nm.queue.push(&ipn.Notify{NetMap: last})
+	}
 }
@@ -0,0 +1,200 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// notifyqueue.go 实现通知的有界队列与 NetMap 合并，使 Kotlin 侧回调与后端通知总线解耦。
+package libtailscale
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/util/clientmetric"
+)
+
+// notifyQueueSize 每个订阅者队列的最大长度，超出时丢弃最旧的可合并通知（见 isCoalescibleNotify）。
+const notifyQueueSize = 64
+
+// netmapCoalesceInterval 开启 NotifyCoalesceNetMaps 时两次 NetMap 投递的最小间隔。
+const netmapCoalesceInterval = 2 * time.Second
+
+var (
+	// metricNotifyDropped 因队列已满被丢弃的可合并通知数量。
+	metricNotifyDropped = clientmetric.NewCounter("android_notify_dropped")
+	// metricNotifyNetMapsCoalesced 被更新版本覆盖、未投递的 NetMap 数量。
+	metricNotifyNetMapsCoalesced = clientmetric.NewCounter("android_notify_netmaps_coalesced")
+)
+
+// notifyQueue 是单个订阅者的通知队列。
+// 后端协程只负责入队，永不阻塞；投递协程负责序列化并调用 Kotlin 回调。
+type notifyQueue struct {
+	// coalesce 为 true 时 NetMap 不直接入队，而是只保留最新一份并限速投递。
+	coalesce bool
+
+	// signal 有新通知入队时被非阻塞写入。
+	signal chan struct{}
+
+	mu         sync.Mutex
+	items      []*ipn.Notify // 待投递通知，按入队顺序排列
+	netmap     *ipn.Notify   // 待投递的最新 NetMap（仅 coalesce 时使用）
+	lastNetMap time.Time     // 上一次投递 NetMap 的时间
+	dropped    int64         // 本队列累计丢弃数量
+}
+
+// newNotifyQueue 创建通知队列。
+func newNotifyQueue(coalesce bool) *notifyQueue {
+	return &notifyQueue{
+		coalesce: coalesce,
+		signal:   make(chan struct{}, 1),
+	}
+}
+
+// push 将通知入队，队列满时丢弃最旧的一条可合并通知。
+// 待合并的 NetMap 不会被排到之后到达的不可合并通知（如 State）后面：
+// 这类通知入队前先把待合并的 NetMap 放入队列，携带 NetMap 的则直接取代它。
+// 该方法在后端通知协程中调用，必须保持非阻塞。
+func (q *notifyQueue) push(n *ipn.Notify) {
+	q.mu.Lock()
+	switch {
+	case q.coalesce && n.NetMap != nil && isCoalescibleNotify(n):
+		if q.netmap != nil {
+			metricNotifyNetMapsCoalesced.Add(1)
+		}
+		q.netmap = &ipn.Notify{Version: n.Version, NetMap: n.NetMap}
+		if rest := withoutNetMap(n); rest != nil {
+			q.appendLocked(rest)
+		}
+	case q.netmap != nil && !isCoalescibleNotify(n):
+		if n.NetMap != nil {
+			metricNotifyNetMapsCoalesced.Add(1)
+		} else {
+			q.appendLocked(q.netmap)
+		}
+		q.netmap = nil
+		q.appendLocked(n)
+	default:
+		q.appendLocked(n)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// appendLocked 追加通知，超过 notifyQueueSize 时丢弃最旧的一条可合并通知。
+// 不可合并的通知从不丢弃，队列中全是这类通知时允许暂时超出上限。调用方需持有 q.mu。
+func (q *notifyQueue) appendLocked(n *ipn.Notify) {
+	if len(q.items) >= notifyQueueSize {
+		if i := slices.IndexFunc(q.items, isCoalescibleNotify); i >= 0 {
+			q.items = slices.Delete(q.items, i, i+1)
+			q.dropped++
+			metricNotifyDropped.Add(1)
+		}
+	}
+	q.items = append(q.items, n)
+}
+
+// next 取出下一条可投递的通知。
+// 若没有可立即投递的通知，返回 nil 以及下一份合并 NetMap 到期前需等待的时长（0 表示无需等待）。
+func (q *notifyQueue) next(now time.Time) (*ipn.Notify, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) > 0 {
+		n := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		return n, 0
+	}
+	if q.netmap == nil {
+		return nil, 0
+	}
+	if wait := q.lastNetMap.Add(netmapCoalesceInterval).Sub(now); wait > 0 {
+		return nil, wait
+	}
+	n := q.netmap
+	q.netmap = nil
+	q.lastNetMap = now
+	return n, 0
+}
+
+// run 持续投递通知直到 ctx 取消。deliver 在本协程中被顺序调用。
+func (q *notifyQueue) run(ctx context.Context, deliver func(*ipn.Notify)) {
+	// go.mod 声明的 Go 版本 >= 1.23，Stop/Reset 后不会再收到旧的到期值，无需手动排空。
+	timer := time.NewTimer(netmapCoalesceInterval)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		n, wait := q.next(time.Now())
+		if n != nil {
+			deliver(n)
+			continue
+		}
+		var timerC <-chan time.Time
+		if wait > 0 {
+			timer.Reset(wait)
+			timerC = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.signal:
+		case <-timerC:
+		}
+		timer.Stop()
+	}
+}
+
+// droppedCount 返回本队列累计丢弃的通知数量。
+func (q *notifyQueue) droppedCount() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// withoutNetMap 返回去掉 NetMap 字段后的通知副本；若去掉后已无其他内容则返回 nil。
+func withoutNetMap(n *ipn.Notify) *ipn.Notify {
+	if n.NetMap == nil {
+		return n
+	}
+	cp := *n
+	cp.NetMap = nil
+	if isEmptyNotify(&cp) {
+		return nil
+	}
+	return &cp
+}
+
+// isCoalescibleNotify 报告 n 是否只携带可被后续通知取代的快照字段（NetMap、Engine、Health 等），
+// 队列满时可以丢弃。携带 SessionID（初始通知）、State、LoginFinished、BrowseToURL 或 ErrMessage 的
+// 通知是一次性事件，丢弃后 Kotlin 侧无法恢复，不可合并。
+func isCoalescibleNotify(n *ipn.Notify) bool {
+	return n.SessionID == "" &&
+		n.State == nil &&
+		n.LoginFinished == nil &&
+		n.BrowseToURL == nil &&
+		n.ErrMessage == nil
+}
+
+// isEmptyNotify 判断通知是否不携带任何有效字段（Version 除外）。
+func isEmptyNotify(n *ipn.Notify) bool {
+	return n.SessionID == "" &&
+		n.ErrMessage == nil &&
+		n.LoginFinished == nil &&
+		n.State == nil &&
+		n.Prefs == nil &&
+		n.NetMap == nil &&
+		n.Engine == nil &&
+		n.BrowseToURL == nil &&
+		n.FilesWaiting == nil &&
+		n.IncomingFiles == nil &&
+		n.OutgoingFiles == nil &&
+		n.LocalTCPPort == nil &&
+		n.ClientVersion == nil &&
+		n.DriveShares.IsNil() &&
+		n.Health == nil
+}
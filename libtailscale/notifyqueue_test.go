@@ -0,0 +1,278 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/empty"
+	"tailscale.com/types/netmap"
+)
+
+// notifyKinds 描述通知携带的字段，便于比较投递顺序。
+func notifyKinds(n *ipn.Notify) string {
+	var s string
+	add := func(ok bool, kind string) {
+		if !ok {
+			return
+		}
+		if s != "" {
+			s += "+"
+		}
+		s += kind
+	}
+	add(n.SessionID != "", "Session")
+	add(n.State != nil, "State:"+stateName(n.State))
+	add(n.NetMap != nil, "NetMap:"+netmapName(n.NetMap))
+	add(n.Engine != nil, "Engine")
+	add(n.Health != nil, "Health")
+	add(n.BrowseToURL != nil, "BrowseToURL")
+	add(n.LoginFinished != nil, "LoginFinished")
+	if s == "" {
+		return "empty"
+	}
+	return s
+}
+
+func stateName(st *ipn.State) string {
+	if st == nil {
+		return ""
+	}
+	return st.String()
+}
+
+func netmapName(nm *netmap.NetworkMap) string {
+	if nm == nil {
+		return ""
+	}
+	return nm.Domain
+}
+
+func stateNotify(st ipn.State) *ipn.Notify { return &ipn.Notify{State: &st} }
+
+func netmapNotify(name string) *ipn.Notify {
+	return &ipn.Notify{NetMap: &netmap.NetworkMap{Domain: name}}
+}
+
+func engineNotify() *ipn.Notify { return &ipn.Notify{Engine: &ipn.EngineStatus{}} }
+
+// drain 取出 q 中所有可立即投递的通知，now 之后不再等待合并间隔。
+func drain(q *notifyQueue, now time.Time) []string {
+	var got []string
+	for {
+		n, _ := q.next(now)
+		if n == nil {
+			return got
+		}
+		got = append(got, notifyKinds(n))
+	}
+}
+
+// dropDelta 返回 f 执行期间丢弃与合并计数器的增量。
+func dropDelta(f func()) (dropped, coalesced int64) {
+	d0, c0 := metricNotifyDropped.Value(), metricNotifyNetMapsCoalesced.Value()
+	f()
+	return metricNotifyDropped.Value() - d0, metricNotifyNetMapsCoalesced.Value() - c0
+}
+
+func TestFilterNotify(t *testing.T) {
+	st := ipn.Running
+	full := &ipn.Notify{
+		Version: "v1",
+		State:   &st,
+		NetMap:  &netmap.NetworkMap{Domain: "a"},
+		Engine:  &ipn.EngineStatus{},
+	}
+	tests := []struct {
+		name   string
+		n      *ipn.Notify
+		filter int
+		want   string
+	}{
+		{name: "no filter", n: full, filter: 0, want: "State:Running+NetMap:a+Engine"},
+		{name: "state", n: full, filter: NotifyFilterState, want: "State:Running"},
+		{name: "netmap", n: full, filter: NotifyFilterNetMap, want: "NetMap:a"},
+		{name: "state and netmap", n: full, filter: NotifyFilterState | NotifyFilterNetMap, want: "State:Running+NetMap:a"},
+		{name: "nothing selected", n: engineNotify(), filter: NotifyFilterState | NotifyFilterHealth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterNotify(tt.n, tt.filter)
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("filterNotify = %s, want nil", notifyKinds(got))
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("filterNotify = nil, want %s", tt.want)
+			}
+			if k := notifyKinds(got); k != tt.want {
+				t.Errorf("filterNotify = %s, want %s", k, tt.want)
+			}
+			if tt.filter != 0 && got.Version != full.Version {
+				t.Errorf("Version = %q, want %q", got.Version, full.Version)
+			}
+		})
+	}
+	if full.Engine == nil || full.NetMap == nil {
+		t.Error("filterNotify modified the shared notify")
+	}
+}
+
+// TestNotifyQueueDrop 队列满时只丢弃可合并的通知，一次性事件始终保留并按序投递。
+func TestNotifyQueueDrop(t *testing.T) {
+	q := newNotifyQueue(false)
+	url := "https://login.example.com"
+	dropped, _ := dropDelta(func() {
+		q.push(&ipn.Notify{SessionID: "s1", State: new(ipn.State)})
+		q.push(stateNotify(ipn.NeedsLogin))
+		q.push(&ipn.Notify{BrowseToURL: &url})
+		for range notifyQueueSize {
+			q.push(engineNotify())
+		}
+		q.push(&ipn.Notify{LoginFinished: &empty.Message{}})
+	})
+	if want := int64(4); dropped != want {
+		t.Errorf("dropped counter +%d, want +%d", dropped, want)
+	}
+	if n := q.droppedCount(); n != 4 {
+		t.Errorf("droppedCount = %d, want 4", n)
+	}
+	got := drain(q, time.Now())
+	want := []string{"Session+State:NoState", "State:NeedsLogin", "BrowseToURL"}
+	for range notifyQueueSize - 4 {
+		want = append(want, "Engine")
+	}
+	want = append(want, "LoginFinished")
+	if !slices.Equal(got, want) {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+}
+
+// TestNotifyQueueOverflowKeepsEvents 队列中全是一次性事件时超出上限也不丢弃。
+func TestNotifyQueueOverflowKeepsEvents(t *testing.T) {
+	q := newNotifyQueue(false)
+	dropped, _ := dropDelta(func() {
+		for range notifyQueueSize + 3 {
+			q.push(stateNotify(ipn.Running))
+		}
+	})
+	if dropped != 0 {
+		t.Errorf("dropped %d State notifies", dropped)
+	}
+	if got := drain(q, time.Now()); len(got) != notifyQueueSize+3 {
+		t.Errorf("delivered %d notifies, want %d", len(got), notifyQueueSize+3)
+	}
+}
+
+func TestNotifyQueueCoalesce(t *testing.T) {
+	t0 := time.Now()
+	tests := []struct {
+		name          string
+		push          []*ipn.Notify
+		want          []string
+		wantCoalesced int64
+	}{
+		{
+			name:          "latest netmap wins",
+			push:          []*ipn.Notify{netmapNotify("a"), netmapNotify("b"), netmapNotify("c")},
+			want:          []string{"NetMap:c"},
+			wantCoalesced: 2,
+		},
+		{
+			name: "netmap is not reordered after a later State",
+			push: []*ipn.Notify{netmapNotify("a"), stateNotify(ipn.Stopped), netmapNotify("b")},
+			want: []string{"NetMap:a", "State:Stopped", "NetMap:b"},
+		},
+		{
+			name:          "State carrying a netmap replaces the pending one",
+			push:          []*ipn.Notify{netmapNotify("a"), {State: ptrTo(ipn.Running), NetMap: &netmap.NetworkMap{Domain: "b"}}},
+			want:          []string{"State:Running+NetMap:b"},
+			wantCoalesced: 1,
+		},
+		{
+			name: "snapshots do not flush the pending netmap",
+			push: []*ipn.Notify{netmapNotify("a"), engineNotify(), {Engine: &ipn.EngineStatus{}, NetMap: &netmap.NetworkMap{Domain: "b"}}},
+			want: []string{"Engine", "Engine", "NetMap:b"},
+			// 第二份 NetMap 取代第一份
+			wantCoalesced: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newNotifyQueue(true)
+			var got []string
+			_, coalesced := dropDelta(func() {
+				for _, n := range tt.push {
+					q.push(n)
+				}
+				got = drain(q, t0)
+			})
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("delivered %q, want %q", got, tt.want)
+			}
+			if coalesced != tt.wantCoalesced {
+				t.Errorf("coalesced counter +%d, want +%d", coalesced, tt.wantCoalesced)
+			}
+		})
+	}
+}
+
+// TestNotifyQueueCoalesceInterval 合并的 NetMap 按 netmapCoalesceInterval 限速投递。
+func TestNotifyQueueCoalesceInterval(t *testing.T) {
+	q := newNotifyQueue(true)
+	t0 := time.Now()
+	q.push(netmapNotify("a"))
+	if n, _ := q.next(t0); n == nil || n.NetMap.Domain != "a" {
+		t.Fatalf("first netmap not delivered immediately")
+	}
+	q.push(netmapNotify("b"))
+	n, wait := q.next(t0.Add(time.Second))
+	if n != nil {
+		t.Fatalf("netmap delivered %v after the previous one", time.Second)
+	}
+	if wait != netmapCoalesceInterval-time.Second {
+		t.Errorf("wait = %v, want %v", wait, netmapCoalesceInterval-time.Second)
+	}
+	if n, _ := q.next(t0.Add(netmapCoalesceInterval)); n == nil || n.NetMap.Domain != "b" {
+		t.Errorf("netmap not delivered after the interval")
+	}
+}
+
+// TestNotifyQueueRun 投递协程按序投递，ctx 取消后退出。
+func TestNotifyQueueRun(t *testing.T) {
+	q := newNotifyQueue(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	got := make(chan string, 4)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.run(ctx, func(n *ipn.Notify) { got <- notifyKinds(n) })
+	}()
+	q.push(stateNotify(ipn.Starting))
+	q.push(netmapNotify("a"))
+	for _, want := range []string{"State:Starting", "NetMap:a"} {
+		select {
+		case k := <-got:
+			if k != want {
+				t.Errorf("delivered %s, want %s", k, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not exit after cancel")
+	}
+}
+
+func ptrTo[T any](v T) *T { return &v }
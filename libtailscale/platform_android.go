@@ -0,0 +1,20 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// platform_android.go 封装只在 Android 上存在的 tailscale 接口，非 Android 平台的替代实现见 platform_other.go。
+package libtailscale
+
+import (
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/netns"
+)
+
+// setProtectFunc 设置 netns 创建套接字时调用的保护函数（VpnService.protect），使 Tailscale 自身的流量绕过 VPN；nil 表示取消。
+func setProtectFunc(f func(fd int) error) {
+	netns.SetAndroidProtectFunc(f)
+}
+
+// setDefaultRouteInterface 更新 netmon 记录的默认路由接口，Android 上无法从路由表读取。
+func setDefaultRouteInterface(ifname string) {
+	netmon.UpdateLastKnownDefaultRouteInterface(ifname)
+}
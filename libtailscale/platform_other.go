@@ -0,0 +1,13 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !android
+
+// platform_other.go 非 Android 平台（测试、设备外运行）的替代实现：没有 VpnService，默认路由由 netmon 自行读取。
+package libtailscale
+
+// setProtectFunc 在非 Android 平台上不做任何事。
+func setProtectFunc(f func(fd int) error) {}
+
+// setDefaultRouteInterface 在非 Android 平台上不做任何事。
+func setDefaultRouteInterface(ifname string) {}
@@ -0,0 +1,138 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// platformdns.go 解析 Android 侧上报的平台 DNS 配置，兜底 DNS 见 dnsfallback.go。
+// 优先使用带版本号的 JSON 格式（AppContext.GetPlatformDNSConfigJSON），其中包含每个网络的解析器、
+// 所属接口与 Private DNS（DoT）设置；旧版 Android 侧不支持时回退到 GetPlatformDNSConfig 的两行文本格式。
+package libtailscale
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"tailscale.com/net/dns"
+	"tailscale.com/util/dnsname"
+)
+
+// platformDNSVersion 当前支持的平台 DNS 配置格式版本。更高版本只按已知字段解析。
+const platformDNSVersion = 1
+
+// Private DNS 模式，对应 Android 设置中的“私人 DNS”。
+const (
+	privateDNSOff           = "off"
+	privateDNSOpportunistic = "opportunistic" // 自动：服务器支持时使用 DoT
+	privateDNSStrict        = "strict"        // 指定主机名：只通过 DoT 查询 Hostname
+)
+
+// platformDNSConfig 平台 DNS 配置，对应 GetPlatformDNSConfigJSON 返回的 JSON。
+type platformDNSConfig struct {
+	Version int
+	// Default 当前默认网络的接口名，Tailscale 以其 DNS 作为平台 DNS。
+	Default string `json:",omitempty"`
+	// Networks 所有非 VPN 网络的 DNS 设置。
+	Networks []platformNetworkDNS
+}
+
+// platformNetworkDNS 单个网络的 DNS 设置。
+type platformNetworkDNS struct {
+	Interface     string       // 接口名，旧版文本格式下为空
+	Type          string       `json:",omitempty"` // wifi、cellular、ethernet 或 other
+	Nameservers   []netip.Addr // DHCP/RA 下发的 DNS 服务器
+	SearchDomains []string     `json:",omitempty"`
+	PrivateDNS    privateDNS
+}
+
+// privateDNS Android Private DNS（DoT）设置。
+type privateDNS struct {
+	Mode     string // off、opportunistic 或 strict
+	Hostname string `json:",omitempty"` // strict 模式下的 DoT 服务器主机名
+}
+
+// parsePlatformDNSConfig 解析 JSON 格式的平台 DNS 配置。
+func parsePlatformDNSConfig(b []byte) (*platformDNSConfig, error) {
+	var c platformDNSConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("platform DNS config: %w", err)
+	}
+	if c.Version < 1 {
+		return nil, fmt.Errorf("platform DNS config: unsupported version %d", c.Version)
+	}
+	if c.Version > platformDNSVersion {
+		log.Printf("platform DNS config: version %d is newer than %d, ignoring unknown fields", c.Version, platformDNSVersion)
+	}
+	return &c, nil
+}
+
+// parseLegacyPlatformDNS 解析旧版两行文本格式：第一行为空格分隔的 DNS 服务器，第二行为空格分隔的搜索域。
+// 结果只包含一个接口名未知的网络。
+func parseLegacyPlatformDNS(s string) *platformDNSConfig {
+	var n platformNetworkDNS
+	lines := strings.Split(s, "\n")
+	for _, addr := range strings.Fields(lines[0]) {
+		if ip, err := netip.ParseAddr(addr); err == nil {
+			n.Nameservers = append(n.Nameservers, ip)
+		}
+	}
+	if len(lines) > 1 {
+		n.SearchDomains = strings.Fields(lines[1])
+	}
+	return &platformDNSConfig{Networks: []platformNetworkDNS{n}}
+}
+
+// defaultNetwork 返回默认网络的 DNS 设置；Default 为空或找不到时使用第一个网络。
+func (c *platformDNSConfig) defaultNetwork() (platformNetworkDNS, bool) {
+	for _, n := range c.Networks {
+		if c.Default != "" && n.Interface == c.Default {
+			return n, true
+		}
+	}
+	if len(c.Networks) > 0 {
+		return c.Networks[0], true
+	}
+	return platformNetworkDNS{}, false
+}
+
+// osConfig 转换为 dns.OSConfig，无法解析的搜索域记录日志后跳过。
+func (n platformNetworkDNS) osConfig() dns.OSConfig {
+	config := dns.OSConfig{Nameservers: n.Nameservers}
+	for _, s := range n.SearchDomains {
+		domain, err := dnsname.ToFQDN(s)
+		if err != nil {
+			log.Printf("getDNSBaseConfig: unable to parse %q: %v", s, err)
+			continue
+		}
+		config.SearchDomains = append(config.SearchDomains, domain)
+	}
+	return config
+}
+
+// errNoPlatformDNSJSON 表示 Android 侧未提供 JSON 配置（旧版本），需回退到文本格式。
+var errNoPlatformDNSJSON = errors.New("platform DNS JSON config not available")
+
+// platformDNS 获取平台 DNS 配置，优先使用 JSON 格式，失败时回退到旧版文本格式。
+func (b *backend) platformDNS() *platformDNSConfig {
+	c, err := b.platformDNSJSON()
+	if err == nil {
+		return c
+	}
+	if !errors.Is(err, errNoPlatformDNSJSON) {
+		log.Printf("getDNSBaseConfig: %v, falling back to text format", err)
+	}
+	return parseLegacyPlatformDNS(b.getPlatformDNSConfig())
+}
+
+// platformDNSJSON 通过 GetPlatformDNSConfigJSON 获取 JSON 配置。
+func (b *backend) platformDNSJSON() (*platformDNSConfig, error) {
+	s, err := b.appCtx.GetPlatformDNSConfigJSON()
+	if err != nil {
+		return nil, fmt.Errorf("GetPlatformDNSConfigJSON: %w", err)
+	}
+	if s == "" {
+		return nil, errNoPlatformDNSJSON
+	}
+	return parsePlatformDNSConfig([]byte(s))
+}
@@ -0,0 +1,263 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// policydiag.go 按 syspolicy 的设置定义校验每一次策略读取，记录未知键、类型不符、取值非法与格式错误的 JSON 数组，
+// 汇总为诊断报告，管理员可通过 policyDiagnosticsEndpoint 获取。
+// Android 专有策略在此注册设置定义，与 tailscale 内置的定义一起参与校验。
+package libtailscale
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/setting"
+)
+
+const (
+	// policyDiagnosticsEndpoint 获取策略诊断报告的 Android 扩展 LocalAPI。
+	policyDiagnosticsEndpoint = "/localapi/v0/android/policy-diagnostics"
+	// meteredLogFlushMinutesPolicyKey 按流量计费的网络下日志批量上传间隔（分钟），覆盖 meteredLogFlushDelay。
+	meteredLogFlushMinutesPolicyKey = "MeteredLogFlushMinutes"
+)
+
+// 策略诊断问题的类型。
+const (
+	policyIssueUnknownKey     = "unknown-key"     // 键不在任何设置定义中
+	policyIssueTypeMismatch   = "type-mismatch"   // 读取类型或配置值类型与定义不符
+	policyIssueInvalidValue   = "invalid-value"   // 值无法按定义的类型解析
+	policyIssueMalformedArray = "malformed-array" // 字符串数组不是合法的 JSON
+	policyIssueReadError      = "read-error"      // Android 侧读取失败
+)
+
+// androidPolicyDefinitions Android 专有策略的设置定义，仅在 Android 上生效。
+var androidPolicyDefinitions = []*setting.Definition{
+	setting.NewDefinition(tunnelMTUPolicyKey, setting.DeviceSetting, setting.IntegerValue, "android"),
+	setting.NewDefinition(lockdownPolicyKey, setting.DeviceSetting, setting.BooleanValue, "android"),
+	setting.NewDefinition(dnsFallbackPolicyKey, setting.DeviceSetting, setting.StringValue, "android"),
+	setting.NewDefinition(includedPackagesPolicyKey, setting.DeviceSetting, setting.StringValue, "android"),
+	setting.NewDefinition(excludedPackagesPolicyKey, setting.DeviceSetting, setting.StringValue, "android"),
+	setting.NewDefinition(cellularPauseSharingPolicyKey, setting.DeviceSetting, setting.BooleanValue, "android"),
+	setting.NewDefinition(meteredReduceLoggingPolicyKey, setting.DeviceSetting, setting.BooleanValue, "android"),
+	setting.NewDefinition(meteredLogFlushMinutesPolicyKey, setting.DeviceSetting, setting.IntegerValue, "android"),
+	setting.NewDefinition(roamingBlockExitNodePolicyKey, setting.DeviceSetting, setting.BooleanValue, "android"),
+	setting.NewDefinition(allowStateBackupPolicyKey, setting.DeviceSetting, setting.BooleanValue, "android"),
+}
+
+func init() {
+	// 设置定义必须在首次读取策略前注册
+	for _, d := range androidPolicyDefinitions {
+		setting.RegisterDefinition(d)
+	}
+}
+
+// policyIssue 诊断报告中的一条问题，同一键只保留最近一次。
+type policyIssue struct {
+	Key       string
+	Kind      string
+	Expected  string    `json:",omitempty"` // 定义中的类型
+	Requested string    `json:",omitempty"` // 读取时使用的类型
+	Detail    string    `json:",omitempty"`
+	Count     int       // 自上次策略变化以来出现的次数
+	LastSeen  time.Time // 最近一次出现的时间
+}
+
+// policyReport 策略诊断报告。
+type policyReport struct {
+	Generated time.Time
+	Checked   int // 本次主动检查的定义数量
+	Issues    []policyIssue
+}
+
+// policyDiagnostics 记录策略读取中发现的问题，策略变化时清空，由 syspolicyHandler 持有。
+type policyDiagnostics struct {
+	mu     sync.Mutex
+	issues map[string]*policyIssue // 按键索引
+}
+
+// record 记录 key 的问题，新出现或类型变化时写日志。
+func (d *policyDiagnostics) record(is policyIssue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.issues == nil {
+		d.issues = make(map[string]*policyIssue)
+	}
+	old := d.issues[is.Key]
+	if old == nil || old.Kind != is.Kind {
+		log.Printf("syspolicy: %s %s: %s", is.Kind, is.Key, is.Detail)
+	} else {
+		is.Count = old.Count
+	}
+	is.Count++
+	is.LastSeen = time.Now()
+	d.issues[is.Key] = &is
+}
+
+// clear 清除 key 的问题，在一次合法的读取之后调用。
+func (d *policyDiagnostics) clear(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.issues, key)
+}
+
+// reset 清除全部问题，在策略变化时调用。
+func (d *policyDiagnostics) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clear(d.issues)
+}
+
+// list 按键排序返回当前所有问题。
+func (d *policyDiagnostics) list() []policyIssue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	issues := make([]policyIssue, 0, len(d.issues))
+	for _, is := range d.issues {
+		issues = append(issues, *is)
+	}
+	slices.SortFunc(issues, func(a, b policyIssue) int { return strings.Compare(a.Key, b.Key) })
+	return issues
+}
+
+// readTypeCompatible 报告以 read 类型读取定义为 def 类型的策略是否合法。
+// 偏好选项、可见性与时长在 Android 上均以字符串配置。
+func readTypeCompatible(def, read setting.Type) bool {
+	if def == read {
+		return true
+	}
+	switch def {
+	case setting.PreferenceOptionValue, setting.VisibilityValue, setting.DurationValue:
+		return read == setting.StringValue
+	}
+	return false
+}
+
+// validateStringValue 按定义的类型校验以字符串配置的值，返回问题说明，合法时为空。
+func validateStringValue(def setting.Type, s string) string {
+	switch def {
+	case setting.DurationValue:
+		if _, err := time.ParseDuration(s); err != nil {
+			return err.Error()
+		}
+	case setting.PreferenceOptionValue:
+		if s != "always" && s != "never" && s != "user-decides" {
+			return `want "always", "never" or "user-decides", got "` + s + `"`
+		}
+	case setting.VisibilityValue:
+		if s != "show" && s != "hide" {
+			return `want "show" or "hide", got "` + s + `"`
+		}
+	}
+	return ""
+}
+
+// validate 按设置定义校验一次以 read 类型读取 key 的结果。
+// value 为读取到的字符串值（仅 ReadString 使用），err 为读取错误；未配置的策略视为合法。
+func (h *syspolicyHandler) validate(key string, read setting.Type, value string, err error) {
+	def, derr := setting.DefinitionOf(setting.Key(key))
+	if derr != nil {
+		h.diag.record(policyIssue{
+			Key:       key,
+			Kind:      policyIssueUnknownKey,
+			Requested: read.String(),
+			Detail:    "not defined in the policy setting definitions",
+		})
+		return
+	}
+	if !readTypeCompatible(def.Type(), read) {
+		h.diag.record(policyIssue{
+			Key:       key,
+			Kind:      policyIssueTypeMismatch,
+			Expected:  def.Type().String(),
+			Requested: read.String(),
+			Detail:    "read as " + read.String() + " but defined as " + def.Type().String(),
+		})
+		return
+	}
+	if err != nil && !errors.Is(err, syspolicy.ErrNoSuchKey) {
+		kind := policyIssueReadError
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+			kind = policyIssueMalformedArray
+		case errors.Is(err, errPolicyNotNumber):
+			kind = policyIssueTypeMismatch
+		case errors.Is(err, errPolicyNegative):
+			kind = policyIssueInvalidValue
+		}
+		h.diag.record(policyIssue{
+			Key:      key,
+			Kind:     kind,
+			Expected: def.Type().String(),
+			Detail:   err.Error(),
+		})
+		return
+	}
+	if err == nil && read == setting.StringValue {
+		if msg := validateStringValue(def.Type(), value); msg != "" {
+			h.diag.record(policyIssue{
+				Key:      key,
+				Kind:     policyIssueInvalidValue,
+				Expected: def.Type().String(),
+				Detail:   msg,
+			})
+			return
+		}
+	}
+	h.diag.clear(key)
+}
+
+// scan 以定义的类型读取所有在 Android 上生效的策略，使诊断覆盖尚未被读取过的策略。返回检查的数量。
+func (h *syspolicyHandler) scan() int {
+	defs, err := setting.Definitions()
+	if err != nil {
+		log.Printf("syspolicy: definitions: %v", err)
+		return 0
+	}
+	n := 0
+	for _, d := range defs {
+		if !d.IsSupported() {
+			continue
+		}
+		key := string(d.Key())
+		switch d.Type() {
+		case setting.BooleanValue:
+			h.ReadBoolean(key)
+		case setting.IntegerValue:
+			h.ReadUInt64(key)
+		case setting.StringListValue:
+			h.ReadStringArray(key)
+		default:
+			h.ReadString(key)
+		}
+		n++
+	}
+	return n
+}
+
+// policyDiagnosticsHandler 处理 policyDiagnosticsEndpoint，GET 重新检查全部策略并返回诊断报告。
+type policyDiagnosticsHandler struct {
+	h *syspolicyHandler
+}
+
+// ServeHTTP 以 JSON 返回策略诊断报告。
+func (p policyDiagnosticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	report := policyReport{
+		Generated: time.Now(),
+		Checked:   p.h.scan(),
+		Issues:    p.h.diag.list(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,195 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"errors"
+	"testing"
+
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/setting"
+)
+
+// setPolicyDefinitionsForTest 测试期间只注册 Android 专有策略与 AllowedSuggestedExitNodes。
+// 测试中 syspolicy 不会自动注册内置的设置定义。
+func setPolicyDefinitionsForTest(t *testing.T) {
+	t.Helper()
+	exitNodes, err := syspolicy.WellKnownSettingDefinition(syspolicy.AllowedSuggestedExitNodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defs := append([]*setting.Definition{exitNodes}, androidPolicyDefinitions...)
+	if err := setting.SetDefinitionsForTest(t, defs...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newPolicyTestHandler 返回从 appCtx 读取策略的 syspolicyHandler。
+func newPolicyTestHandler(appCtx *fakePolicyAppContext) *syspolicyHandler {
+	a := &App{appCtx: appCtx}
+	a.policyStore = &syspolicyHandler{a: a}
+	return a.policyStore
+}
+
+func TestPolicyDiagnostics(t *testing.T) {
+	setPolicyDefinitionsForTest(t)
+	exitNodes := string(syspolicy.AllowedSuggestedExitNodes)
+	tests := []struct {
+		name     string
+		appCtx   fakePolicyAppContext
+		read     func(h *syspolicyHandler) error
+		wantErr  error
+		wantKey  string
+		wantKind string // 为空表示没有问题
+	}{
+		{
+			name: "unset policy",
+			read: func(h *syspolicyHandler) error {
+				_, err := h.ReadBoolean(lockdownPolicyKey)
+				return err
+			},
+			wantErr: syspolicy.ErrNoSuchKey,
+		},
+		{
+			name:   "valid integer",
+			appCtx: fakePolicyAppContext{ints: map[string]int64{meteredLogFlushMinutesPolicyKey: 30}},
+			read: func(h *syspolicyHandler) error {
+				_, err := h.ReadUInt64(meteredLogFlushMinutesPolicyKey)
+				return err
+			},
+		},
+		{
+			name: "unknown key",
+			read: func(h *syspolicyHandler) error {
+				_, err := h.ReadBoolean("NoSuchAndroidPolicy")
+				return err
+			},
+			wantErr:  syspolicy.ErrNoSuchKey,
+			wantKey:  "NoSuchAndroidPolicy",
+			wantKind: policyIssueUnknownKey,
+		},
+		{
+			name:   "read with the wrong type",
+			appCtx: fakePolicyAppContext{bools: map[string]bool{tunnelMTUPolicyKey: true}},
+			read: func(h *syspolicyHandler) error {
+				_, err := h.ReadBoolean(tunnelMTUPolicyKey)
+				return err
+			},
+			wantKey:  tunnelMTUPolicyKey,
+			wantKind: policyIssueTypeMismatch,
+		},
+		{
+			name: "integer policy set to a string",
+			appCtx: fakePolicyAppContext{errs: map[string]error{
+				meteredLogFlushMinutesPolicyKey: errors.New(`policy value is not an integer: MeteredLogFlushMinutes="soon"`),
+			}},
+			read: func(h *syspolicyHandler) error {
+				_, err := h.ReadUInt64(meteredLogFlushMinutesPolicyKey)
+				return err
+			},
+			wantErr:  errPolicyNotNumber,
+			wantKey:  meteredLogFlushMinutesPolicyKey,
+			wantKind: policyIssueTypeMismatch,
+		},
+		{
+			name: "integer policy read failure",
+			appCtx: fakePolicyAppContext{errs: map[string]error{
+				meteredLogFlushMinutesPolicyKey: errors.New("java.io.IOException: restrictions unavailable"),
+			}},
+			read: func(h *syspolicyHandler) error {
+				_, err := h.ReadUInt64(meteredLogFlushMinutesPolicyKey)
+				if errors.Is(err, errPolicyNotNumber) {
+					return errors.New("read failure reported as not a number")
+				}
+				return err
+			},
+			wantKey:  meteredLogFlushMinutesPolicyKey,
+			wantKind: policyIssueReadError,
+		},
+		{
+			name:   "negative integer",
+			appCtx: fakePolicyAppContext{ints: map[string]int64{meteredLogFlushMinutesPolicyKey: -5}},
+			read: func(h *syspolicyHandler) error {
+				_, err := h.ReadUInt64(meteredLogFlushMinutesPolicyKey)
+				return err
+			},
+			wantErr:  errPolicyNegative,
+			wantKey:  meteredLogFlushMinutesPolicyKey,
+			wantKind: policyIssueInvalidValue,
+		},
+		{
+			name:   "malformed JSON array",
+			appCtx: fakePolicyAppContext{arrays: map[string]string{exitNodes: `["a",`}},
+			read: func(h *syspolicyHandler) error {
+				_, err := h.ReadStringArray(exitNodes)
+				return err
+			},
+			wantKey:  exitNodes,
+			wantKind: policyIssueMalformedArray,
+		},
+		{
+			name:   "JSON that is not a string array",
+			appCtx: fakePolicyAppContext{arrays: map[string]string{exitNodes: `{"a":1}`}},
+			read: func(h *syspolicyHandler) error {
+				_, err := h.ReadStringArray(exitNodes)
+				return err
+			},
+			wantKey:  exitNodes,
+			wantKind: policyIssueMalformedArray,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newPolicyTestHandler(&tt.appCtx)
+			err := tt.read(h)
+			switch {
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("read error = %v, want %v", err, tt.wantErr)
+			case tt.wantErr == nil && tt.wantKind == "" && err != nil:
+				t.Errorf("read error = %v, want nil", err)
+			}
+			issues := h.diag.list()
+			if tt.wantKind == "" {
+				if len(issues) != 0 {
+					t.Errorf("issues = %+v, want none", issues)
+				}
+				return
+			}
+			if len(issues) != 1 || issues[0].Key != tt.wantKey || issues[0].Kind != tt.wantKind {
+				t.Fatalf("issues = %+v, want one %s for %s", issues, tt.wantKind, tt.wantKey)
+			}
+			// 同一问题重复出现只计数
+			tt.read(h)
+			if issues := h.diag.list(); len(issues) != 1 || issues[0].Count != 2 {
+				t.Errorf("after a second read issues = %+v, want one issue with Count 2", issues)
+			}
+		})
+	}
+}
+
+// TestPolicyDiagnosticsReset 合法的读取清除该键的问题；策略变化时清空全部问题。
+func TestPolicyDiagnosticsReset(t *testing.T) {
+	setPolicyDefinitionsForTest(t)
+	appCtx := &fakePolicyAppContext{ints: map[string]int64{meteredLogFlushMinutesPolicyKey: -1}}
+	h := newPolicyTestHandler(appCtx)
+	h.ReadUInt64(meteredLogFlushMinutesPolicyKey)
+	h.ReadBoolean("NoSuchAndroidPolicy")
+	if n := len(h.diag.list()); n != 2 {
+		t.Fatalf("%d issues, want 2", n)
+	}
+
+	appCtx.ints[meteredLogFlushMinutesPolicyKey] = 10
+	if _, err := h.ReadUInt64(meteredLogFlushMinutesPolicyKey); err != nil {
+		t.Fatal(err)
+	}
+	issues := h.diag.list()
+	if len(issues) != 1 || issues[0].Key != "NoSuchAndroidPolicy" {
+		t.Fatalf("after a valid read issues = %+v, want only the unknown key", issues)
+	}
+
+	h.notifyChanged()
+	if issues := h.diag.list(); len(issues) != 0 {
+		t.Errorf("after a policy change issues = %+v, want none", issues)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// routeplan.go 根据路由配置与当前网络环境计算下发给 VpnService.Builder 的地址、路由与排除路由，显式处理双栈、纯 IPv6 与 NAT64 网络。
+// planRoutes 是纯函数，不依赖 Android 环境，便于用记录调用的 VPNServiceBuilder 验证。
+package libtailscale
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/wgengine/router"
+)
+
+var (
+	// nat64Prefix RFC 6052 知名 NAT64 前缀，DNS64 合成的 AAAA 记录落在该前缀内。
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	// ipv6LinkLocal 与 ipv6Multicast 不应进入隧道，使用出口节点时显式排除。
+	ipv6LinkLocal = netip.MustParsePrefix("fe80::/10")
+	ipv6Multicast = netip.MustParsePrefix("ff00::/8")
+)
+
+// googleDNS64Servers NAT64 网络下的兜底 DNS（Google Public DNS64），纯 IPv6 网络无法访问 IPv4 DNS。
+var googleDNS64Servers = []netip.Addr{
+	netip.MustParseAddr("2001:4860:4860::6464"),
+	netip.MustParseAddr("2001:4860:4860::64"),
+}
+
+// netEnv 描述底层物理网络的地址族情况。
+type netEnv struct {
+	hasIPv4 bool // 存在可用的 IPv4 地址（不含 464XLAT 的 CLAT 地址）
+	hasIPv6 bool // 存在全局单播 IPv6 地址
+	nat64   bool // 纯 IPv6 网络或检测到 464XLAT，IPv4 目的地经 NAT64 访问
+	// localV6 物理接口上的 IPv6 前缀，允许局域网访问时需从出口节点默认路由中排除。
+	localV6 []netip.Prefix
+}
+
+// routePlan 下发给 VpnService.Builder 的完整路由方案。
+type routePlan struct {
+	addrs    []netip.Prefix
+	routes   []netip.Prefix
+	excludes []netip.Prefix
+}
+
+// planRoutes 计算路由方案：
+//   - 使用出口节点（任一默认路由）时同时下发 IPv4 与 IPv6 默认路由，避免另一地址族绕过隧道泄漏；
+//   - 排除 LocalRoutes（跳过回环），出口节点下额外排除 IPv6 链路本地与组播，
+//     允许局域网访问时排除物理接口的 IPv6 前缀；
+//   - 不使用出口节点时，NAT64 网络下若有路由覆盖 64:ff9b::/96 则将其排除，保证 DNS64 合成地址仍走运营商 NAT64。
+func planRoutes(rcfg *router.Config, env netEnv) routePlan {
+	var p routePlan
+	if rcfg == nil {
+		return p
+	}
+	p.addrs = slices.Clone(rcfg.LocalAddrs)
+
+	for _, r := range rcfg.Routes {
+		p.routes = appendPrefix(p.routes, r.Masked())
+	}
+	v4Default := slices.Contains(p.routes, tsaddr.AllIPv4())
+	v6Default := slices.Contains(p.routes, tsaddr.AllIPv6())
+	exitNode := v4Default || v6Default
+	if exitNode {
+		p.routes = appendPrefix(p.routes, tsaddr.AllIPv4())
+		p.routes = appendPrefix(p.routes, tsaddr.AllIPv6())
+	}
+
+	for _, r := range rcfg.LocalRoutes {
+		if r.Addr().IsLoopback() {
+			// Android 平台不允许排除回环路由，否则会抛异常。
+			continue
+		}
+		p.excludes = appendPrefix(p.excludes, r.Masked())
+	}
+	if exitNode {
+		p.excludes = appendPrefix(p.excludes, ipv6LinkLocal)
+		p.excludes = appendPrefix(p.excludes, ipv6Multicast)
+		if len(rcfg.LocalRoutes) > 0 {
+			// 存在 LocalRoutes 说明允许局域网访问
+			for _, r := range env.localV6 {
+				p.excludes = appendPrefix(p.excludes, r.Masked())
+			}
+		}
+	} else if env.nat64 && slices.ContainsFunc(p.routes, func(r netip.Prefix) bool { return r.Overlaps(nat64Prefix) }) {
+		p.excludes = appendPrefix(p.excludes, nat64Prefix)
+	}
+	return p
+}
+
+// appendPrefix 追加前缀并去重。
+func appendPrefix(ps []netip.Prefix, p netip.Prefix) []netip.Prefix {
+	if slices.Contains(ps, p) {
+		return ps
+	}
+	return append(ps, p)
+}
+
+// applyRoutePlan 将路由方案下发到 builder。
+func applyRoutePlan(builder VPNServiceBuilder, p routePlan) error {
+	for _, r := range p.routes {
+		if err := builder.AddRoute(r.Addr().String(), int32(r.Bits())); err != nil {
+			return err
+		}
+	}
+	for _, r := range p.excludes {
+		if err := builder.ExcludeRoute(r.Addr().String(), int32(r.Bits())); err != nil {
+			return err
+		}
+	}
+	for _, a := range p.addrs {
+		if err := builder.AddAddress(a.Addr().String(), int32(a.Bits())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentNetEnv 根据物理网络接口推断地址族情况，获取失败时视为普通双栈网络。
+func (b *backend) currentNetEnv() netEnv {
+	env := netEnv{hasIPv4: true, hasIPv6: true}
+	if b.getInterfaces == nil {
+		return env
+	}
+	ifaces, err := b.getInterfaces()
+	if err != nil {
+		log.Printf("currentNetEnv: getInterfaces: %v", err)
+		return env
+	}
+	env = netEnv{}
+	clat := false
+	for _, iface := range ifaces {
+		if iface.Interface == nil || iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if strings.HasPrefix(iface.Name, "tun") {
+			continue
+		}
+		if strings.HasPrefix(iface.Name, "v4-") {
+			// 464XLAT 的 CLAT 接口，其 IPv4 地址只是翻译层
+			clat = true
+			continue
+		}
+		for _, a := range iface.AltAddrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			pfx, ok := netipPrefixOf(ipnet)
+			if !ok || !pfx.Addr().IsGlobalUnicast() {
+				continue
+			}
+			if pfx.Addr().Is4() {
+				env.hasIPv4 = true
+			} else {
+				env.hasIPv6 = true
+				env.localV6 = appendPrefix(env.localV6, pfx.Masked())
+			}
+		}
+	}
+	env.nat64 = clat || (env.hasIPv6 && !env.hasIPv4)
+	return env
+}
+
+// netipPrefixOf 将 *net.IPNet 转换为 netip.Prefix。
+func netipPrefixOf(ipnet *net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ipnet.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	ones, _ := ipnet.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), ones), true
+}
@@ -0,0 +1,249 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"tailscale.com/wgengine/router"
+)
+
+// recordingBuilder 记录调用的 VPNServiceBuilder，每次调用记为一行 "方法 参数"。
+// failOn 非空时，对应的调用返回 errRecordingBuilder。
+type recordingBuilder struct {
+	calls  []string
+	failOn string
+}
+
+var errRecordingBuilder = errors.New("recordingBuilder: injected failure")
+
+func (b *recordingBuilder) record(format string, args ...any) error {
+	call := fmt.Sprintf(format, args...)
+	b.calls = append(b.calls, call)
+	if call == b.failOn {
+		return errRecordingBuilder
+	}
+	return nil
+}
+
+func (b *recordingBuilder) SetMTU(mtu int32) error { return b.record("mtu %d", mtu) }
+func (b *recordingBuilder) AddAllowedApplication(pkg string) error {
+	return b.record("allow %s", pkg)
+}
+func (b *recordingBuilder) AddDisallowedApplication(pkg string) error {
+	return b.record("disallow %s", pkg)
+}
+func (b *recordingBuilder) AddDNSServer(s string) error    { return b.record("dns %s", s) }
+func (b *recordingBuilder) AddSearchDomain(s string) error { return b.record("search %s", s) }
+func (b *recordingBuilder) AddRoute(addr string, bits int32) error {
+	return b.record("route %s/%d", addr, bits)
+}
+func (b *recordingBuilder) ExcludeRoute(addr string, bits int32) error {
+	return b.record("exclude %s/%d", addr, bits)
+}
+func (b *recordingBuilder) AddAddress(addr string, bits int32) error {
+	return b.record("addr %s/%d", addr, bits)
+}
+func (b *recordingBuilder) Establish() (ParcelFileDescriptor, error) {
+	return nil, b.record("establish")
+}
+
+func prefixes(ss ...string) []netip.Prefix {
+	ps := make([]netip.Prefix, len(ss))
+	for i, s := range ss {
+		ps[i] = netip.MustParsePrefix(s)
+	}
+	return ps
+}
+
+func TestPlanRoutes(t *testing.T) {
+	tailnetAddrs := prefixes("100.64.0.1/32", "fd7a:115c:a1e0::1/128")
+	tests := []struct {
+		name string
+		rcfg *router.Config
+		env  netEnv
+		want []string
+	}{
+		{
+			name: "nil config",
+			env:  netEnv{hasIPv4: true, hasIPv6: true},
+			want: nil,
+		},
+		{
+			name: "subnet routes only",
+			rcfg: &router.Config{
+				LocalAddrs: tailnetAddrs,
+				Routes:     prefixes("100.64.0.0/10", "fd7a:115c:a1e0::/48", "10.1.0.0/16"),
+			},
+			env: netEnv{hasIPv4: true, hasIPv6: true},
+			want: []string{
+				"route 100.64.0.0/10",
+				"route fd7a:115c:a1e0::/48",
+				"route 10.1.0.0/16",
+				"addr 100.64.0.1/32",
+				"addr fd7a:115c:a1e0::1/128",
+			},
+		},
+		{
+			name: "routes are masked and deduplicated",
+			rcfg: &router.Config{
+				LocalAddrs: tailnetAddrs[:1],
+				Routes:     prefixes("10.1.2.3/16", "10.1.0.0/16", "100.64.0.0/10"),
+			},
+			env: netEnv{hasIPv4: true},
+			want: []string{
+				"route 10.1.0.0/16",
+				"route 100.64.0.0/10",
+				"addr 100.64.0.1/32",
+			},
+		},
+		{
+			name: "IPv4 exit node also routes IPv6",
+			rcfg: &router.Config{
+				LocalAddrs: tailnetAddrs,
+				Routes:     prefixes("0.0.0.0/0", "100.64.0.0/10"),
+			},
+			env: netEnv{hasIPv4: true, hasIPv6: true},
+			want: []string{
+				"route 0.0.0.0/0",
+				"route 100.64.0.0/10",
+				"route ::/0",
+				"exclude fe80::/10",
+				"exclude ff00::/8",
+				"addr 100.64.0.1/32",
+				"addr fd7a:115c:a1e0::1/128",
+			},
+		},
+		{
+			name: "IPv6 exit node also routes IPv4",
+			rcfg: &router.Config{
+				LocalAddrs: tailnetAddrs,
+				Routes:     prefixes("::/0"),
+			},
+			env: netEnv{hasIPv6: true},
+			want: []string{
+				"route ::/0",
+				"route 0.0.0.0/0",
+				"exclude fe80::/10",
+				"exclude ff00::/8",
+				"addr 100.64.0.1/32",
+				"addr fd7a:115c:a1e0::1/128",
+			},
+		},
+		{
+			name: "exit node with LAN access excludes local routes and IPv6 prefixes",
+			rcfg: &router.Config{
+				LocalAddrs:  tailnetAddrs[:1],
+				Routes:      prefixes("0.0.0.0/0", "::/0"),
+				LocalRoutes: prefixes("192.168.1.0/24", "127.0.0.0/8", "192.168.1.7/24"),
+			},
+			env: netEnv{
+				hasIPv4: true,
+				hasIPv6: true,
+				localV6: prefixes("2001:db8:1::/64"),
+			},
+			want: []string{
+				"route 0.0.0.0/0",
+				"route ::/0",
+				"exclude 192.168.1.0/24",
+				"exclude fe80::/10",
+				"exclude ff00::/8",
+				"exclude 2001:db8:1::/64",
+				"addr 100.64.0.1/32",
+			},
+		},
+		{
+			name: "exit node without LAN access keeps local IPv6 in the tunnel",
+			rcfg: &router.Config{
+				LocalAddrs: tailnetAddrs[:1],
+				Routes:     prefixes("0.0.0.0/0", "::/0"),
+			},
+			env: netEnv{
+				hasIPv4: true,
+				hasIPv6: true,
+				localV6: prefixes("2001:db8:1::/64"),
+			},
+			want: []string{
+				"route 0.0.0.0/0",
+				"route ::/0",
+				"exclude fe80::/10",
+				"exclude ff00::/8",
+				"addr 100.64.0.1/32",
+			},
+		},
+		{
+			name: "NAT64 network excludes the well-known prefix from overlapping routes",
+			rcfg: &router.Config{
+				LocalAddrs: tailnetAddrs[1:],
+				Routes:     prefixes("fd7a:115c:a1e0::/48", "64::/16"),
+			},
+			env: netEnv{hasIPv6: true, nat64: true},
+			want: []string{
+				"route fd7a:115c:a1e0::/48",
+				"route 64::/16",
+				"exclude 64:ff9b::/96",
+				"addr fd7a:115c:a1e0::1/128",
+			},
+		},
+		{
+			name: "NAT64 network without overlapping routes",
+			rcfg: &router.Config{
+				LocalAddrs: tailnetAddrs[1:],
+				Routes:     prefixes("fd7a:115c:a1e0::/48"),
+			},
+			env: netEnv{hasIPv6: true, nat64: true},
+			want: []string{
+				"route fd7a:115c:a1e0::/48",
+				"addr fd7a:115c:a1e0::1/128",
+			},
+		},
+		{
+			name: "NAT64 network with exit node routes NAT64 through the tunnel",
+			rcfg: &router.Config{
+				LocalAddrs: tailnetAddrs[1:],
+				Routes:     prefixes("::/0"),
+			},
+			env: netEnv{hasIPv6: true, nat64: true},
+			want: []string{
+				"route ::/0",
+				"route 0.0.0.0/0",
+				"exclude fe80::/10",
+				"exclude ff00::/8",
+				"addr fd7a:115c:a1e0::1/128",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b recordingBuilder
+			if err := applyRoutePlan(&b, planRoutes(tt.rcfg, tt.env)); err != nil {
+				t.Fatalf("applyRoutePlan: %v", err)
+			}
+			if !slices.Equal(b.calls, tt.want) {
+				t.Errorf("builder calls:\n got %q\nwant %q", b.calls, tt.want)
+			}
+		})
+	}
+}
+
+// TestApplyRoutePlanStopsOnError 下发失败时返回错误且不再继续调用 builder。
+func TestApplyRoutePlanStopsOnError(t *testing.T) {
+	p := planRoutes(&router.Config{
+		LocalAddrs:  prefixes("100.64.0.1/32"),
+		Routes:      prefixes("10.1.0.0/16"),
+		LocalRoutes: prefixes("10.1.2.0/24"),
+	}, netEnv{hasIPv4: true})
+	b := recordingBuilder{failOn: "exclude 10.1.2.0/24"}
+	if err := applyRoutePlan(&b, p); !errors.Is(err, errRecordingBuilder) {
+		t.Fatalf("applyRoutePlan = %v, want %v", err, errRecordingBuilder)
+	}
+	want := []string{"route 10.1.0.0/16", "exclude 10.1.2.0/24"}
+	if !slices.Equal(b.calls, want) {
+		t.Errorf("builder calls = %q, want %q", b.calls, want)
+	}
+}
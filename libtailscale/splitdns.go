@@ -0,0 +1,81 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// splitdns.go 实现 Android 上的 Split DNS：只有 MagicDNS 与配置的域名路由交给 Tailscale 解析器，其余查询继续使用平台 DNS。
+//
+// VpnService.Builder 无法按域名指定 DNS 服务器，因此这里借助 Android 解析器的回退行为：
+// 100.100.100.100 排在第一位，对不属于 MatchDomains 的域名返回 SERVFAIL（没有 "." 路由），
+// Android 解析器收到 SERVFAIL 后会依次尝试后面的平台 DNS 服务器。
+package libtailscale
+
+import (
+	"log"
+	"net/netip"
+	"slices"
+
+	"tailscale.com/net/dns"
+	"tailscale.com/net/tsaddr"
+)
+
+// splitDNSNameservers 返回需要下发给 VpnService.Builder 的 DNS 服务器列表。
+// dcfg 为 Tailscale 的 DNS 配置，base 为平台 DNS 配置（见 getDNSBaseConfig）。
+// 非 Split DNS 配置（MatchDomains 为空）原样使用 dcfg.Nameservers；
+// 否则先放 Tailscale 解析器，再追加去重后的平台 DNS 服务器。
+func splitDNSNameservers(dcfg *dns.OSConfig, base dns.OSConfig) []netip.Addr {
+	if dcfg == nil {
+		return nil
+	}
+	if len(dcfg.MatchDomains) == 0 {
+		return dcfg.Nameservers
+	}
+	ns := slices.Clone(dcfg.Nameservers)
+	for _, ip := range base.Nameservers {
+		if ip == tsaddr.TailscaleServiceIP() || ip == tsaddr.TailscaleServiceIPv6() {
+			// 平台配置里不应出现 Tailscale 解析器，出现时说明读到的是 VPN 自己的配置
+			continue
+		}
+		if !slices.Contains(ns, ip) {
+			ns = append(ns, ip)
+		}
+	}
+	return ns
+}
+
+// tunNameservers 计算建立 TUN 时使用的 DNS 服务器，并记录本次使用的平台 DNS 服务器，
+// 以便平台 DNS 变化时重建 TUN（见 platformDNSChanged）。
+// env 为当前物理网络情况，NAT64 网络下兜底只使用 IPv6 服务器（见 emptyDNSFallback）。
+func (b *backend) tunNameservers(dcfg *dns.OSConfig, env netEnv) []netip.Addr {
+	b.lastPlatformDNS = nil
+	if dcfg == nil {
+		return nil
+	}
+	var base dns.OSConfig
+	if len(dcfg.MatchDomains) > 0 {
+		var err error
+		base, err = b.getDNSBaseConfig()
+		if err != nil {
+			log.Printf("tunNameservers: getDNSBaseConfig: %v", err)
+		}
+		b.lastPlatformDNS = base.Nameservers
+	}
+	ns := splitDNSNameservers(dcfg, base)
+	if b.avoidEmptyDNS && len(ns) == 0 {
+		// ChromeOS 平台特殊处理，避免 DNS 配置为空导致系统 DNS 被清空。
+		ns = b.emptyDNSFallback(env)
+	}
+	return ns
+}
+
+// platformDNSChanged 报告当前 Split DNS 配置所依赖的平台 DNS 服务器是否已变化。
+// 非 Split DNS 配置不依赖平台 DNS，始终返回 false。
+func (b *backend) platformDNSChanged() bool {
+	if b.lastCfg == nil || b.lastDNSCfg == nil || len(b.lastDNSCfg.MatchDomains) == 0 {
+		return false
+	}
+	base, err := b.getDNSBaseConfig()
+	if err != nil {
+		log.Printf("platformDNSChanged: getDNSBaseConfig: %v", err)
+		return false
+	}
+	return !slices.Equal(base.Nameservers, b.lastPlatformDNS)
+}
@@ -0,0 +1,240 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"tailscale.com/net/dns"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/wgengine/router"
+)
+
+// fakeDNSAppContext 只实现平台 DNS 相关方法的 AppContext，其余方法调用时 panic。
+// platformDNSJSON 为空时模拟旧版 Android 侧，回退到 GetPlatformDNSConfig 的文本格式。
+type fakeDNSAppContext struct {
+	AppContext
+	platformDNS     string
+	platformDNSJSON string
+	googleFallback  bool
+	// calls GetPlatformDNSConfig 与 GetPlatformDNSConfigJSON 被调用的总次数。
+	calls int
+}
+
+func (c *fakeDNSAppContext) GetPlatformDNSConfig() string {
+	c.calls++
+	return c.platformDNS
+}
+
+func (c *fakeDNSAppContext) GetPlatformDNSConfigJSON() (string, error) {
+	c.calls++
+	return c.platformDNSJSON, nil
+}
+
+func (c *fakeDNSAppContext) ShouldUseGoogleDNSFallback() bool { return c.googleFallback }
+
+func addrs(ss ...string) []netip.Addr {
+	ips := make([]netip.Addr, len(ss))
+	for i, s := range ss {
+		ips[i] = netip.MustParseAddr(s)
+	}
+	return ips
+}
+
+func TestTunNameservers(t *testing.T) {
+	quad100 := tsaddr.TailscaleServiceIP()
+	splitCfg := &dns.OSConfig{
+		Nameservers:  []netip.Addr{quad100},
+		MatchDomains: []dnsname.FQDN{"example.ts.net.", "corp.example.com."},
+	}
+	fullCfg := &dns.OSConfig{
+		Nameservers:   []netip.Addr{quad100},
+		SearchDomains: []dnsname.FQDN{"example.ts.net."},
+	}
+	tests := []struct {
+		name     string
+		dcfg     *dns.OSConfig
+		ctx      fakeDNSAppContext
+		chromeOS bool
+		env      netEnv
+		want     []netip.Addr
+		// wantPlatform 记录为本次使用的平台 DNS（lastPlatformDNS）。
+		wantPlatform []netip.Addr
+		// wantNoPlatformRead 不应读取平台 DNS 配置。
+		wantNoPlatformRead bool
+	}{
+		{
+			name:               "nil config",
+			ctx:                fakeDNSAppContext{platformDNS: "192.168.1.1"},
+			wantNoPlatformRead: true,
+		},
+		{
+			name:               "full tunnel DNS ignores the platform",
+			dcfg:               fullCfg,
+			ctx:                fakeDNSAppContext{platformDNS: "192.168.1.1"},
+			want:               []netip.Addr{quad100},
+			wantNoPlatformRead: true,
+		},
+		{
+			name:         "split DNS puts quad-100 first and appends platform DNS",
+			dcfg:         splitCfg,
+			ctx:          fakeDNSAppContext{platformDNS: "192.168.1.1 1.1.1.1 192.168.1.1\nlan"},
+			want:         append([]netip.Addr{quad100}, addrs("192.168.1.1", "1.1.1.1")...),
+			wantPlatform: addrs("192.168.1.1", "1.1.1.1", "192.168.1.1"),
+		},
+		{
+			name:         "split DNS skips Tailscale resolvers reported by the platform",
+			dcfg:         splitCfg,
+			ctx:          fakeDNSAppContext{platformDNS: "100.100.100.100 fd7a:115c:a1e0::53 10.0.0.1"},
+			want:         append([]netip.Addr{quad100}, addrs("10.0.0.1")...),
+			wantPlatform: addrs("100.100.100.100", "fd7a:115c:a1e0::53", "10.0.0.1"),
+		},
+		{
+			name: "split DNS uses the default network from the JSON config",
+			dcfg: splitCfg,
+			ctx: fakeDNSAppContext{
+				platformDNS:     "192.168.1.1",
+				platformDNSJSON: `{"Version":1,"Default":"rmnet0","Networks":[{"Interface":"wlan0","Nameservers":["192.168.1.1"],"PrivateDNS":{"Mode":"off"}},{"Interface":"rmnet0","Nameservers":["2001:db8::53"],"PrivateDNS":{"Mode":"off"}}]}`,
+			},
+			want:         append([]netip.Addr{quad100}, addrs("2001:db8::53")...),
+			wantPlatform: addrs("2001:db8::53"),
+		},
+		{
+			name:         "split DNS falls back to Google DNS when the platform has none",
+			dcfg:         splitCfg,
+			ctx:          fakeDNSAppContext{googleFallback: true},
+			want:         append([]netip.Addr{quad100}, googleDNSServers...),
+			wantPlatform: googleDNSServers,
+		},
+		{
+			name: "split DNS does not fall back under strict Private DNS",
+			dcfg: splitCfg,
+			ctx: fakeDNSAppContext{
+				googleFallback:  true,
+				platformDNSJSON: `{"Version":1,"Networks":[{"Interface":"wlan0","Nameservers":[],"PrivateDNS":{"Mode":"strict","Hostname":"dns.example.com"}}]}`,
+			},
+			want: []netip.Addr{quad100},
+		},
+		{
+			name: "split DNS without platform DNS or fallback",
+			dcfg: splitCfg,
+			ctx:  fakeDNSAppContext{},
+			want: []netip.Addr{quad100},
+		},
+		{
+			name:               "ChromeOS with no Tailscale DNS uses the fallback",
+			dcfg:               &dns.OSConfig{},
+			ctx:                fakeDNSAppContext{platformDNS: "192.168.1.1", googleFallback: true},
+			chromeOS:           true,
+			env:                netEnv{hasIPv4: true, hasIPv6: true},
+			want:               googleDNSServers,
+			wantNoPlatformRead: true,
+		},
+		{
+			name:               "ChromeOS on NAT64 uses DNS64",
+			dcfg:               &dns.OSConfig{},
+			ctx:                fakeDNSAppContext{googleFallback: true},
+			chromeOS:           true,
+			env:                netEnv{hasIPv6: true, nat64: true},
+			want:               googleDNS64Servers,
+			wantNoPlatformRead: true,
+		},
+		{
+			name:               "ChromeOS with fallback disabled stays empty",
+			dcfg:               &dns.OSConfig{},
+			ctx:                fakeDNSAppContext{},
+			chromeOS:           true,
+			want:               nil,
+			wantNoPlatformRead: true,
+		},
+		{
+			name:               "Android with no Tailscale DNS stays empty",
+			dcfg:               &dns.OSConfig{},
+			ctx:                fakeDNSAppContext{googleFallback: true},
+			want:               nil,
+			wantNoPlatformRead: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			b := &backend{
+				appCtx:          &ctx,
+				avoidEmptyDNS:   tt.chromeOS,
+				lastPlatformDNS: addrs("203.0.113.1"),
+			}
+			got := b.tunNameservers(tt.dcfg, tt.env)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("tunNameservers = %v, want %v", got, tt.want)
+			}
+			if !slices.Equal(b.lastPlatformDNS, tt.wantPlatform) {
+				t.Errorf("lastPlatformDNS = %v, want %v", b.lastPlatformDNS, tt.wantPlatform)
+			}
+			if tt.wantNoPlatformRead && ctx.calls != 0 {
+				t.Errorf("read the platform DNS config %d times, want 0", ctx.calls)
+			}
+		})
+	}
+}
+
+func TestSplitDNSNameservers(t *testing.T) {
+	quad100 := tsaddr.TailscaleServiceIP()
+	base := dns.OSConfig{Nameservers: addrs("192.168.1.1", "100.100.100.100", "fd7a:115c:a1e0::53", "192.168.1.1")}
+	tests := []struct {
+		name string
+		dcfg *dns.OSConfig
+		want []netip.Addr
+	}{
+		{name: "nil", dcfg: nil, want: nil},
+		{
+			name: "no match domains",
+			dcfg: &dns.OSConfig{Nameservers: []netip.Addr{quad100}},
+			want: []netip.Addr{quad100},
+		},
+		{
+			name: "match domains",
+			dcfg: &dns.OSConfig{Nameservers: []netip.Addr{quad100}, MatchDomains: []dnsname.FQDN{"ts.net."}},
+			want: append([]netip.Addr{quad100}, addrs("192.168.1.1")...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitDNSNameservers(tt.dcfg, base); !slices.Equal(got, tt.want) {
+				t.Errorf("splitDNSNameservers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPlatformDNSChanged 平台 DNS 变化只影响 Split DNS 配置。
+func TestPlatformDNSChanged(t *testing.T) {
+	ctx := &fakeDNSAppContext{platformDNS: "192.168.1.1"}
+	b := &backend{appCtx: ctx}
+	splitCfg := &dns.OSConfig{
+		Nameservers:  []netip.Addr{tsaddr.TailscaleServiceIP()},
+		MatchDomains: []dnsname.FQDN{"ts.net."},
+	}
+	b.lastCfg, b.lastDNSCfg = nil, splitCfg
+	if b.platformDNSChanged() {
+		t.Error("platformDNSChanged with no TUN")
+	}
+
+	b.lastCfg = &router.Config{LocalAddrs: prefixes("100.64.0.1/32")}
+	b.tunNameservers(splitCfg, netEnv{})
+	if b.platformDNSChanged() {
+		t.Error("platformDNSChanged right after tunNameservers")
+	}
+	ctx.platformDNS = "10.0.0.1"
+	if !b.platformDNSChanged() {
+		t.Error("platformDNSChanged = false after the platform DNS changed")
+	}
+
+	b.lastDNSCfg = &dns.OSConfig{Nameservers: splitCfg.Nameservers}
+	if b.platformDNSChanged() {
+		t.Error("platformDNSChanged for a full tunnel DNS config")
+	}
+}
@@ -0,0 +1,587 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// statestore.go 定义状态存储后端 StateStore 及其实现：
+//   - prefs：Android EncryptedSharedPreferences（默认，密钥保存在 Android Keystore）；
+//   - file：dataDir 下的 AES-GCM 加密文件，不依赖 Keystore，Keystore 被清除后仍可恢复状态，也可在设备外运行；
+//   - memory：仅保存在内存中，用于测试。
+//
+// 当前使用的后端记录在 dataDir 的 stateStoreKindFile 中，MigrateStateStore 在后端之间迁移全部状态。
+package libtailscale
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// StateStore 状态存储后端，键为字符串，值为任意字节。实现需支持并发调用。
+type StateStore interface {
+	// Read 读取 key，不存在时返回 nil, nil。
+	Read(key string) ([]byte, error)
+	// Write 写入 key。
+	Write(key string, value []byte) error
+	// Delete 删除 key，不存在时不报错。
+	Delete(key string) error
+	// Keys 列出所有键，顺序不定。
+	Keys() ([]string, error)
+}
+
+// BatchStateStore 可选接口，支持原子地写入多个键。
+// 未实现时 stateStore 借助日志键（stateJournalKey）保证多键写入在崩溃后仍能完整生效。
+type BatchStateStore interface {
+	StateStore
+	// WriteBatch 原子地写入 batch 中的所有键，值为 nil 表示删除该键。
+	WriteBatch(batch map[string][]byte) error
+}
+
+// errKeystoreUnavailable 表示存储后端暂时无法读写（例如 Android Keystore 被清除或尚未解锁），
+// 与键不存在（read 返回 nil、ReadState 返回 ipn.ErrStateNotExist）不同，调用方不应据此重新生成状态。
+var errKeystoreUnavailable = errors.New("state store: keystore unavailable")
+
+// stateJournalKey 多键写入的日志键：先整体写入日志，再逐键写入，最后删除日志。
+// 启动时发现残留的日志说明上次写入中断，按日志补齐，见 replayStateJournal。
+const stateJournalKey = "statejournal"
+
+// 状态存储后端类型，用于 MigrateStateStore 与 stateStoreKindFile。
+const (
+	stateStorePrefs  = "prefs"
+	stateStoreFile   = "file"
+	stateStoreMemory = "memory"
+)
+
+const (
+	// stateStoreKindFile 记录当前后端类型的文件，位于 dataDir，不存在时使用 prefs。
+	stateStoreKindFile = "statestore-kind"
+	// stateStoreDataFile 文件后端的数据文件，位于 dataDir。
+	stateStoreDataFile = "statestore.enc"
+	// stateStoreKeyFile 文件后端的密钥文件，位于 dataDir，仅应用自身可读。
+	stateStoreKeyFile = "statestore.key"
+)
+
+// migratedKeys 需要随后端迁移的固定键；另有所有 statestore- 前缀的 ipn 状态键，见 isMigratedKey。
+var migratedKeys = []string{
+	logPrefKey,
+	loginMethodPrefKey,
+	customLoginServerPrefKey,
+	crashHistoryPrefKey,
+	dnsFallbackPrefKey,
+	exitNodePausedPrefKey,
+}
+
+// isMigratedKey 报告 key 是否属于 Go 侧状态，需要随后端迁移。
+// prefs 后端与 Android 侧其他设置共用同一个 SharedPreferences，其余键不能动。
+func isMigratedKey(key string) bool {
+	return strings.HasPrefix(key, prefKeyFor("")) || slices.Contains(migratedKeys, key)
+}
+
+// prefsStateStore 基于 Android EncryptedSharedPreferences 的后端，值以 base64 存储。
+type prefsStateStore struct {
+	appCtx AppContext
+}
+
+// Read 实现 StateStore。
+func (s prefsStateStore) Read(key string) ([]byte, error) {
+	b64, err := s.appCtx.DecryptFromPref(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: read %s: %v", errKeystoreUnavailable, key, err)
+	}
+	if b64 == "" {
+		return nil, nil
+	}
+	v, err := base64.RawStdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: corrupt value: %w", key, err)
+	}
+	return v, nil
+}
+
+// Write 实现 StateStore。
+func (s prefsStateStore) Write(key string, value []byte) error {
+	if err := s.appCtx.EncryptToPref(key, base64.RawStdEncoding.EncodeToString(value)); err != nil {
+		return fmt.Errorf("%w: write %s: %v", errKeystoreUnavailable, key, err)
+	}
+	return nil
+}
+
+// Delete 实现 StateStore。Android 侧把空字符串视为不存在。
+func (s prefsStateStore) Delete(key string) error {
+	if err := s.appCtx.EncryptToPref(key, ""); err != nil {
+		return fmt.Errorf("%w: delete %s: %v", errKeystoreUnavailable, key, err)
+	}
+	return nil
+}
+
+// WriteBatch 实现 BatchStateStore，由 Android 侧在一次 SharedPreferences 提交中写入。
+func (s prefsStateStore) WriteBatch(batch map[string][]byte) error {
+	enc := make(map[string]string, len(batch))
+	for k, v := range batch {
+		if v == nil {
+			enc[k] = ""
+		} else {
+			enc[k] = base64.RawStdEncoding.EncodeToString(v)
+		}
+	}
+	js, err := json.Marshal(enc)
+	if err != nil {
+		return err
+	}
+	if err := s.appCtx.EncryptToPrefBatch(string(js)); err != nil {
+		return fmt.Errorf("%w: write batch: %v", errKeystoreUnavailable, err)
+	}
+	return nil
+}
+
+// Keys 实现 StateStore，只返回 Go 侧的键。
+func (s prefsStateStore) Keys() ([]string, error) {
+	js, err := s.appCtx.GetEncryptedPrefKeysJSON()
+	if err != nil {
+		return nil, fmt.Errorf("%w: list keys: %v", errKeystoreUnavailable, err)
+	}
+	var keys []string
+	if err := json.Unmarshal([]byte(js), &keys); err != nil {
+		return nil, fmt.Errorf("encrypted pref keys: %w", err)
+	}
+	return slices.DeleteFunc(keys, func(k string) bool { return !isMigratedKey(k) }), nil
+}
+
+// memStateStore 内存后端，进程退出后数据丢失。
+type memStateStore struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+// newMemStateStore 创建空的内存后端。
+func newMemStateStore() *memStateStore {
+	return &memStateStore{m: make(map[string][]byte)}
+}
+
+// Read 实现 StateStore。
+func (s *memStateStore) Read(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.m[key]), nil
+}
+
+// Write 实现 StateStore。
+func (s *memStateStore) Write(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[key] = bytes.Clone(value)
+	return nil
+}
+
+// Delete 实现 StateStore。
+func (s *memStateStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, key)
+	return nil
+}
+
+// WriteBatch 实现 BatchStateStore。
+func (s *memStateStore) WriteBatch(batch map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range batch {
+		if v == nil {
+			delete(s.m, k)
+		} else {
+			s.m[k] = bytes.Clone(v)
+		}
+	}
+	return nil
+}
+
+// Keys 实现 StateStore。
+func (s *memStateStore) Keys() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Collect(maps.Keys(s.m)), nil
+}
+
+// fileStateStore 加密文件后端：全部键值以 JSON 序列化后用 AES-256-GCM 加密，整体写入单个文件。
+// 写入先写临时文件再重命名，中途崩溃不会损坏已有数据。
+type fileStateStore struct {
+	path string
+	aead cipher.AEAD
+
+	mu sync.Mutex
+	m  map[string][]byte // 文件内容的内存副本
+}
+
+// NewFileStateStore 打开（或创建）path 处的加密文件后端，key 为 32 字节的 AES-256 密钥。
+// 用于在设备外运行 Go 后端，或在 Android Keystore 被清除后恢复状态。
+func NewFileStateStore(path string, key []byte) (StateStore, error) {
+	return newFileStateStore(path, key)
+}
+
+// newFileStateStore 同 NewFileStateStore，返回具体类型。
+func newFileStateStore(path string, key []byte) (*fileStateStore, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("state store key: want 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileStateStore{path: path, aead: aead, m: make(map[string][]byte)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load 读取并解密数据文件，文件不存在时从空状态开始。
+func (s *fileStateStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	n := s.aead.NonceSize()
+	if len(data) < n {
+		return fmt.Errorf("state file %s: truncated", s.path)
+	}
+	plain, err := s.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return fmt.Errorf("state file %s: decrypt: %w", s.path, err)
+	}
+	return json.Unmarshal(plain, &s.m)
+}
+
+// saveLocked 加密并原子地写回数据文件，调用方需持有 s.mu。
+func (s *fileStateStore) saveLocked() error {
+	plain, err := json.Marshal(s.m)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, s.aead.Seal(nonce, nonce, plain, nil))
+}
+
+// writeFileAtomic 以 0600 权限写入临时文件并 fsync，再重命名为 path，
+// 中途崩溃时 path 要么是旧内容，要么是完整的新内容。
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Read 实现 StateStore。
+func (s *fileStateStore) Read(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.m[key]), nil
+}
+
+// Write 实现 StateStore。写文件失败时内存副本回滚。
+func (s *fileStateStore) Write(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, had := s.m[key]
+	s.m[key] = bytes.Clone(value)
+	if err := s.saveLocked(); err != nil {
+		if had {
+			s.m[key] = old
+		} else {
+			delete(s.m, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete 实现 StateStore。
+func (s *fileStateStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, had := s.m[key]
+	if !had {
+		return nil
+	}
+	delete(s.m, key)
+	if err := s.saveLocked(); err != nil {
+		s.m[key] = old
+		return err
+	}
+	return nil
+}
+
+// WriteBatch 实现 BatchStateStore，所有键在同一次文件替换中生效。写文件失败时内存副本回滚。
+func (s *fileStateStore) WriteBatch(batch map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := maps.Clone(s.m)
+	for k, v := range batch {
+		if v == nil {
+			delete(s.m, k)
+		} else {
+			s.m[k] = bytes.Clone(v)
+		}
+	}
+	if err := s.saveLocked(); err != nil {
+		s.m = old
+		return err
+	}
+	return nil
+}
+
+// Keys 实现 StateStore。
+func (s *fileStateStore) Keys() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Collect(maps.Keys(s.m)), nil
+}
+
+// loadOrCreateStateKey 读取 dataDir 中的文件后端密钥，不存在时生成并以 0600 权限原子地保存，
+// 中途崩溃不会留下截断的密钥。密钥不经过 Android Keystore，只依赖应用私有目录的隔离。
+func loadOrCreateStateKey(dataDir string) ([]byte, error) {
+	path := filepath.Join(dataDir, stateStoreKeyFile)
+	key, err := os.ReadFile(path)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// openStateStore 按类型打开 dataDir 对应的后端。
+func openStateStore(kind, dataDir string, appCtx AppContext) (StateStore, error) {
+	switch kind {
+	case stateStorePrefs:
+		return prefsStateStore{appCtx}, nil
+	case stateStoreFile:
+		key, err := loadOrCreateStateKey(dataDir)
+		if err != nil {
+			return nil, fmt.Errorf("state store key: %w", err)
+		}
+		return newFileStateStore(filepath.Join(dataDir, stateStoreDataFile), key)
+	case stateStoreMemory:
+		return newMemStateStore(), nil
+	}
+	return nil, fmt.Errorf("unknown state store %q", kind)
+}
+
+// readStateStoreKind 读取 dataDir 中记录的后端类型，未记录时为 prefs。
+func readStateStoreKind(dataDir string) string {
+	b, err := os.ReadFile(filepath.Join(dataDir, stateStoreKindFile))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("stateStore: read %s: %v", stateStoreKindFile, err)
+		}
+		return stateStorePrefs
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// writeStateStoreKind 原子地记录后端类型，下次启动时使用。
+func writeStateStoreKind(dataDir, kind string) error {
+	return writeFileAtomic(filepath.Join(dataDir, stateStoreKindFile), []byte(kind+"\n"))
+}
+
+// openDefaultStateStore 打开 dataDir 记录的后端并返回其类型。
+// 打开失败时不回退到其他后端（那里没有当前状态，会生成新的节点身份），
+// 而是返回 unavailableStateStore：所有读写都失败并触发 statePersistWarnable。
+func openDefaultStateStore(dataDir string, appCtx AppContext) (StateStore, string) {
+	kind := readStateStoreKind(dataDir)
+	s, err := openStateStore(kind, dataDir, appCtx)
+	if err != nil {
+		log.Printf("stateStore: open %s: %v", kind, err)
+		return unavailableStateStore{kind: kind, err: err}, kind
+	}
+	return s, kind
+}
+
+// unavailableStateStore 无法打开的后端，所有操作返回包装 errKeystoreUnavailable 的错误。
+type unavailableStateStore struct {
+	kind string
+	err  error
+}
+
+// unavailable 返回操作 op 的错误。
+func (s unavailableStateStore) unavailable(op string) error {
+	return fmt.Errorf("%w: %s: open %s store: %v", errKeystoreUnavailable, op, s.kind, s.err)
+}
+
+// Read 实现 StateStore。
+func (s unavailableStateStore) Read(key string) ([]byte, error) {
+	return nil, s.unavailable("read " + key)
+}
+
+// Write 实现 StateStore。
+func (s unavailableStateStore) Write(key string, value []byte) error {
+	return s.unavailable("write " + key)
+}
+
+// Delete 实现 StateStore。
+func (s unavailableStateStore) Delete(key string) error {
+	return s.unavailable("delete " + key)
+}
+
+// Keys 实现 StateStore。
+func (s unavailableStateStore) Keys() ([]string, error) {
+	return nil, s.unavailable("list keys")
+}
+
+// writeBatch 原子地写入 batch（值为 nil 表示删除）。
+// s 实现 BatchStateStore 时直接使用；否则先写日志键，再逐键写入，最后删除日志。
+func writeBatch(s StateStore, batch map[string][]byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	if bs, ok := s.(BatchStateStore); ok {
+		return bs.WriteBatch(batch)
+	}
+	journal, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	if err := s.Write(stateJournalKey, journal); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := applyBatch(s, batch); err != nil {
+		// 日志保留，下次启动时补齐
+		return err
+	}
+	return s.Delete(stateJournalKey)
+}
+
+// applyBatch 逐键写入或删除 batch 中的键。
+func applyBatch(s StateStore, batch map[string][]byte) error {
+	for k, v := range batch {
+		var err error
+		if v == nil {
+			err = s.Delete(k)
+		} else {
+			err = s.Write(k, v)
+		}
+		if err != nil {
+			return fmt.Errorf("write %s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// replayStateJournal 补齐上次中断的多键写入，日志不存在时什么也不做。
+func replayStateJournal(s StateStore) error {
+	journal, err := s.Read(stateJournalKey)
+	if err != nil || journal == nil {
+		return err
+	}
+	var batch map[string][]byte
+	if err := json.Unmarshal(journal, &batch); err != nil {
+		log.Printf("stateStore: discarding corrupt journal: %v", err)
+		return s.Delete(stateJournalKey)
+	}
+	log.Printf("stateStore: replaying interrupted write of %d keys", len(batch))
+	if err := applyBatch(s, batch); err != nil {
+		return err
+	}
+	return s.Delete(stateJournalKey)
+}
+
+// copyState 把 from 中所有 Go 侧的键原子地复制到 to，返回复制的键；from 保持不变。
+func copyState(from, to StateStore) ([]string, error) {
+	keys, err := from.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("list keys: %w", err)
+	}
+	keys = slices.DeleteFunc(keys, func(k string) bool { return !isMigratedKey(k) })
+	batch := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		v, err := from.Read(k)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", k, err)
+		}
+		if v != nil {
+			batch[k] = v
+		}
+	}
+	if err := writeBatch(to, batch); err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+	return keys, nil
+}
+
+// deleteState 从 s 中删除 keys，失败只记录日志：此时状态已在新后端中，旧后端的残留不影响使用。
+func deleteState(s StateStore, keys []string) {
+	dels := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		dels[k] = nil
+	}
+	if err := writeBatch(s, dels); err != nil {
+		log.Printf("stateStore: migrate: delete from old store: %v", err)
+	}
+}
+
+// errMemoryStateStore 表示拒绝迁移到内存后端：迁移会从持久化后端删除状态，进程退出后节点身份随之丢失。
+var errMemoryStateStore = errors.New("state store: refusing to migrate persistent state into memory")
+
+// MigrateStateStore 把全部状态迁移到 kind 指定的后端（prefs 或 file），并在之后的启动中使用它。
+// 已在使用该后端时什么也不做；拒绝迁移到 memory。迁移期间状态读写被阻塞；失败时继续使用原后端。
+func (a *App) MigrateStateStore(kind string) error {
+	if kind == stateStoreMemory {
+		return errMemoryStateStore
+	}
+	if a.store.currentKind() == kind {
+		log.Printf("stateStore: already using %s", kind)
+		return nil
+	}
+	to, err := openStateStore(kind, a.dataDir, a.appCtx)
+	if err != nil {
+		return err
+	}
+	// 先记录新后端再从旧后端删除，中途崩溃时下次启动使用已含全部状态的新后端
+	n, err := a.store.migrate(kind, to, func() error { return writeStateStoreKind(a.dataDir, kind) })
+	if err != nil {
+		return fmt.Errorf("migrate state to %s: %w", kind, err)
+	}
+	log.Printf("stateStore: migrated %d keys to %s", n, kind)
+	return nil
+}
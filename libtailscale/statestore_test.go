@@ -0,0 +1,540 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package libtailscale
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+)
+
+// fakePrefsAppContext 只实现加密 SharedPreferences 相关方法的 AppContext，其余方法调用时 panic。
+// err 非 nil 时所有操作失败，模拟 Keystore 不可用；keysJSON 非空时代替键列表返回。
+type fakePrefsAppContext struct {
+	AppContext
+	prefs    map[string]string
+	err      error
+	keysJSON string
+}
+
+func newFakePrefsAppContext() *fakePrefsAppContext {
+	return &fakePrefsAppContext{prefs: make(map[string]string)}
+}
+
+func (c *fakePrefsAppContext) EncryptToPref(key, value string) error {
+	if c.err != nil {
+		return c.err
+	}
+	if value == "" {
+		delete(c.prefs, key)
+	} else {
+		c.prefs[key] = value
+	}
+	return nil
+}
+
+func (c *fakePrefsAppContext) DecryptFromPref(key string) (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	return c.prefs[key], nil
+}
+
+func (c *fakePrefsAppContext) EncryptToPrefBatch(batchJSON string) error {
+	if c.err != nil {
+		return c.err
+	}
+	var batch map[string]string
+	if err := json.Unmarshal([]byte(batchJSON), &batch); err != nil {
+		return err
+	}
+	for k, v := range batch {
+		c.EncryptToPref(k, v)
+	}
+	return nil
+}
+
+func (c *fakePrefsAppContext) GetEncryptedPrefKeysJSON() (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	if c.keysJSON != "" {
+		return c.keysJSON, nil
+	}
+	js, err := json.Marshal(slices.Collect(maps.Keys(c.prefs)))
+	return string(js), err
+}
+
+// flakyStateStore 不实现 BatchStateStore 的后端：写入 failKey 时返回 errFlaky，用于中断多键写入。
+type flakyStateStore struct {
+	m       *memStateStore
+	failKey string
+}
+
+var errFlaky = errors.New("injected write failure")
+
+func (s *flakyStateStore) Read(key string) ([]byte, error) { return s.m.Read(key) }
+func (s *flakyStateStore) Delete(key string) error         { return s.m.Delete(key) }
+func (s *flakyStateStore) Keys() ([]string, error)         { return s.m.Keys() }
+
+func (s *flakyStateStore) Write(key string, value []byte) error {
+	if key == s.failKey {
+		return errFlaky
+	}
+	return s.m.Write(key, value)
+}
+
+// contents 返回 s 中的全部键值。
+func contents(tb testing.TB, s StateStore) map[string][]byte {
+	tb.Helper()
+	keys, err := s.Keys()
+	if err != nil {
+		tb.Fatalf("Keys: %v", err)
+	}
+	m := make(map[string][]byte)
+	for _, k := range keys {
+		v, err := s.Read(k)
+		if err != nil {
+			tb.Fatalf("Read(%q): %v", k, err)
+		}
+		m[k] = v
+	}
+	return m
+}
+
+func TestMemStateStore(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(s *memStateStore) error
+		want map[string][]byte
+	}{
+		{
+			name: "write",
+			op:   func(s *memStateStore) error { return s.Write("b", []byte("2")) },
+			want: map[string][]byte{"a": []byte("1"), "b": []byte("2")},
+		},
+		{
+			name: "overwrite",
+			op:   func(s *memStateStore) error { return s.Write("a", []byte("3")) },
+			want: map[string][]byte{"a": []byte("3")},
+		},
+		{
+			name: "delete",
+			op:   func(s *memStateStore) error { return s.Delete("a") },
+			want: map[string][]byte{},
+		},
+		{
+			name: "delete missing",
+			op:   func(s *memStateStore) error { return s.Delete("missing") },
+			want: map[string][]byte{"a": []byte("1")},
+		},
+		{
+			name: "batch",
+			op: func(s *memStateStore) error {
+				return s.WriteBatch(map[string][]byte{"a": nil, "b": []byte("2"), "c": []byte("3")})
+			},
+			want: map[string][]byte{"b": []byte("2"), "c": []byte("3")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMemStateStore()
+			s.Write("a", []byte("1"))
+			if err := tt.op(s); err != nil {
+				t.Fatal(err)
+			}
+			if got := contents(t, s); !maps.EqualFunc(got, tt.want, bytes.Equal) {
+				t.Errorf("contents = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	s := newMemStateStore()
+	if v, err := s.Read("missing"); v != nil || err != nil {
+		t.Errorf("Read(missing) = %q, %v; want nil, nil", v, err)
+	}
+	val := []byte("x")
+	s.Write("k", val)
+	val[0] = 'y'
+	got, _ := s.Read("k")
+	got[0] = 'z'
+	if v, _ := s.Read("k"); string(v) != "x" {
+		t.Errorf("Read(k) = %q after mutating caller slices, want %q", v, "x")
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		failKey     string
+		wantErr     bool
+		want        map[string][]byte
+		wantJournal bool
+	}{
+		{
+			name: "complete",
+			want: map[string][]byte{"keep": []byte("1"), "b": []byte("2")},
+		},
+		{
+			name:        "interrupted",
+			failKey:     "b",
+			wantErr:     true,
+			wantJournal: true,
+		},
+		{
+			name:    "journal write fails",
+			failKey: stateJournalKey,
+			wantErr: true,
+			want:    map[string][]byte{"keep": []byte("1"), "old": []byte("0")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &flakyStateStore{m: newMemStateStore(), failKey: tt.failKey}
+			s.m.Write("keep", []byte("1"))
+			s.m.Write("old", []byte("0"))
+			err := writeBatch(s, map[string][]byte{"old": nil, "b": []byte("2")})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeBatch = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := contents(t, s)
+			_, hasJournal := got[stateJournalKey]
+			if hasJournal != tt.wantJournal {
+				t.Errorf("journal present = %v, want %v", hasJournal, tt.wantJournal)
+			}
+			if tt.want != nil && !maps.EqualFunc(got, tt.want, bytes.Equal) {
+				t.Errorf("contents = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	s := newMemStateStore()
+	if err := writeBatch(s, nil); err != nil {
+		t.Errorf("writeBatch(empty) = %v", err)
+	}
+}
+
+func TestReplayStateJournal(t *testing.T) {
+	s := &flakyStateStore{m: newMemStateStore(), failKey: "b"}
+	s.m.Write("a", []byte("old"))
+	s.m.Write("gone", []byte("x"))
+	batch := map[string][]byte{"a": []byte("new"), "b": []byte("2"), "gone": nil}
+	if err := writeBatch(s, batch); !errors.Is(err, errFlaky) {
+		t.Fatalf("writeBatch = %v, want the injected failure", err)
+	}
+
+	// 写入仍然失败时日志保留，等待下次启动
+	if err := replayStateJournal(s); !errors.Is(err, errFlaky) {
+		t.Fatalf("replayStateJournal with failing store = %v, want the injected failure", err)
+	}
+	if v, _ := s.Read(stateJournalKey); v == nil {
+		t.Fatal("journal removed after a failed replay")
+	}
+
+	s.failKey = ""
+	if err := replayStateJournal(s); err != nil {
+		t.Fatalf("replayStateJournal: %v", err)
+	}
+	want := map[string][]byte{"a": []byte("new"), "b": []byte("2")}
+	if got := contents(t, s); !maps.EqualFunc(got, want, bytes.Equal) {
+		t.Errorf("after replay = %q, want %q", got, want)
+	}
+
+	// 没有日志时什么也不做；损坏的日志被丢弃
+	if err := replayStateJournal(s); err != nil {
+		t.Errorf("replayStateJournal without journal: %v", err)
+	}
+	s.Write(stateJournalKey, []byte("{not json"))
+	if err := replayStateJournal(s); err != nil {
+		t.Errorf("replayStateJournal with corrupt journal: %v", err)
+	}
+	if got := contents(t, s); !maps.EqualFunc(got, want, bytes.Equal) {
+		t.Errorf("after corrupt journal = %q, want %q", got, want)
+	}
+}
+
+// TestNewStateStoreReplaysJournal 创建 stateStore 时补齐上次中断的写入。
+func TestNewStateStoreReplaysJournal(t *testing.T) {
+	s := &flakyStateStore{m: newMemStateStore(), failKey: "b"}
+	writeBatch(s, map[string][]byte{"a": []byte("1"), "b": []byte("2")})
+	s.failKey = ""
+	newStateStore(s, stateStoreMemory)
+	want := map[string][]byte{"a": []byte("1"), "b": []byte("2")}
+	if got := contents(t, s); !maps.EqualFunc(got, want, bytes.Equal) {
+		t.Errorf("contents = %q, want %q", got, want)
+	}
+}
+
+func TestCopyState(t *testing.T) {
+	state := prefKeyFor("_machinekey")
+	tests := []struct {
+		name string
+		from map[string][]byte
+		want map[string][]byte
+	}{
+		{name: "empty"},
+		{
+			name: "migrated keys only",
+			from: map[string][]byte{
+				state:            []byte("mk"),
+				logPrefKey:       []byte("log"),
+				"android-ui-key": []byte("ui"),
+			},
+			want: map[string][]byte{state: []byte("mk"), logPrefKey: []byte("log")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := newMemStateStore(), newMemStateStore()
+			for k, v := range tt.from {
+				from.Write(k, v)
+			}
+			keys, err := copyState(from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := contents(t, to)
+			if !maps.EqualFunc(got, tt.want, bytes.Equal) {
+				t.Errorf("copied = %q, want %q", got, tt.want)
+			}
+			slices.Sort(keys)
+			if want := slices.Sorted(maps.Keys(tt.want)); !slices.Equal(keys, want) {
+				t.Errorf("copyState keys = %q, want %q", keys, want)
+			}
+			if src := contents(t, from); len(src) != len(tt.from) {
+				t.Errorf("source has %d keys after copy, want %d", len(src), len(tt.from))
+			}
+		})
+	}
+}
+
+// TestMigrateStateStore 在 prefs 与 file 后端之间来回迁移：状态完整保留，
+// 旧后端只删除 Go 侧的键，失败的迁移不切换后端。
+func TestMigrateStateStore(t *testing.T) {
+	dir := t.TempDir()
+	ctx := newFakePrefsAppContext()
+	state := map[string][]byte{
+		prefKeyFor("_machinekey"): []byte("mk"),
+		prefKeyFor("profile-1"):   []byte("profile"),
+		logPrefKey:                []byte("log"),
+	}
+	prefs := prefsStateStore{ctx}
+	for k, v := range state {
+		prefs.Write(k, v)
+	}
+	ctx.prefs["android-ui-key"] = "ui"
+
+	s := newStateStore(prefs, stateStorePrefs)
+	commits := 0
+	commit := func() error { commits++; return nil }
+	migrate := func(kind string) {
+		t.Helper()
+		to, err := openStateStore(kind, dir, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := s.migrate(kind, to, commit)
+		if err != nil {
+			t.Fatalf("migrate to %s: %v", kind, err)
+		}
+		if n != len(state) {
+			t.Errorf("migrate to %s moved %d keys, want %d", kind, n, len(state))
+		}
+		if got, _ := s.dump(); !maps.EqualFunc(got, state, bytes.Equal) {
+			t.Errorf("state after migrating to %s = %q, want %q", kind, got, state)
+		}
+	}
+
+	migrate(stateStoreFile)
+	if len(ctx.prefs) != 1 || ctx.prefs["android-ui-key"] != "ui" {
+		t.Errorf("prefs after migrating to file = %q, want only the Android key", ctx.prefs)
+	}
+	// 重新打开文件后端，状态已持久化
+	reopened, err := openStateStore(stateStoreFile, dir, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(t, reopened); !maps.EqualFunc(got, state, bytes.Equal) {
+		t.Errorf("reopened file store = %q, want %q", got, state)
+	}
+
+	migrate(stateStorePrefs)
+	if f, _ := openStateStore(stateStoreFile, dir, ctx); len(contents(t, f)) != 0 {
+		t.Errorf("file store still has %q after migrating back", contents(t, f))
+	}
+	if ctx.prefs["android-ui-key"] != "ui" {
+		t.Error("Android key lost after migrating back")
+	}
+	if commits != 2 {
+		t.Errorf("commit called %d times, want 2", commits)
+	}
+
+	// commit 失败时继续使用原后端
+	to := newMemStateStore()
+	if _, err := s.migrate(stateStoreMemory, to, func() error { return errFlaky }); !errors.Is(err, errFlaky) {
+		t.Fatalf("migrate with failing commit = %v, want the injected failure", err)
+	}
+	if k := s.currentKind(); k != stateStorePrefs {
+		t.Errorf("kind after failed migrate = %q, want %q", k, stateStorePrefs)
+	}
+	if got, _ := s.dump(); !maps.EqualFunc(got, state, bytes.Equal) {
+		t.Errorf("state after failed migrate = %q, want %q", got, state)
+	}
+}
+
+// TestOpenDefaultStateStoreNoFallback 记录的后端无法打开时不回退到 prefs，读写返回 errKeystoreUnavailable。
+func TestOpenDefaultStateStoreNoFallback(t *testing.T) {
+	dir := t.TempDir()
+	ctx := newFakePrefsAppContext()
+	ctx.prefs[prefKeyFor("_machinekey")] = "c3RhbGU"
+	if err := writeStateStoreKind(dir, stateStoreFile); err != nil {
+		t.Fatal(err)
+	}
+	// 长度错误的密钥让文件后端无法打开
+	if err := os.WriteFile(filepath.Join(dir, stateStoreKeyFile), []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, kind := openDefaultStateStore(dir, ctx)
+	if kind != stateStoreFile {
+		t.Errorf("kind = %q, want %q", kind, stateStoreFile)
+	}
+	s := newStateStore(backend, kind)
+	if _, err := s.ReadState("_machinekey"); !errors.Is(err, errKeystoreUnavailable) {
+		t.Errorf("ReadState = %v, want errKeystoreUnavailable", err)
+	}
+	if err := s.WriteString(logPrefKey, "x"); !errors.Is(err, errKeystoreUnavailable) {
+		t.Errorf("WriteString = %v, want errKeystoreUnavailable", err)
+	}
+	if s.lastErr == nil {
+		t.Error("open failure not recorded for statePersistWarnable")
+	}
+}
+
+func TestLoadOrCreateStateKey(t *testing.T) {
+	dir := t.TempDir()
+	key, err := loadOrCreateStateKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 {
+		t.Fatalf("key is %d bytes, want 32", len(key))
+	}
+	path := filepath.Join(dir, stateStoreKeyFile)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", fi.Mode().Perm())
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary key file left behind: %v", err)
+	}
+	again, err := loadOrCreateStateKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, key) {
+		t.Error("second load returned a different key")
+	}
+}
+
+// TestStateStoreReport 持久化失败时设置 statePersistWarnable，成功写入后清除；
+// 设置跟踪器前发生的失败在设置时立即反映。
+func TestStateStoreReport(t *testing.T) {
+	ctx := newFakePrefsAppContext()
+	s := newStateStore(prefsStateStore{ctx}, stateStorePrefs)
+
+	ctx.err = errFlaky
+	if err := s.WriteString(logPrefKey, "x"); !errors.Is(err, errKeystoreUnavailable) {
+		t.Fatalf("WriteString = %v, want errKeystoreUnavailable", err)
+	}
+	ht := new(health.Tracker)
+	s.setHealthTracker(ht)
+	if !ht.IsUnhealthy(statePersistWarnable) {
+		t.Fatal("earlier failure not reported to the tracker")
+	}
+
+	ctx.err = nil
+	if _, err := s.ReadString(logPrefKey, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !ht.IsUnhealthy(statePersistWarnable) {
+		t.Error("successful read cleared the warning")
+	}
+	if err := s.WriteString(logPrefKey, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if ht.IsUnhealthy(statePersistWarnable) {
+		t.Error("warning still set after a successful write")
+	}
+
+	// 键不存在不是失败
+	if _, err := s.ReadState("missing"); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Errorf("ReadState(missing) = %v, want ipn.ErrStateNotExist", err)
+	}
+	if ht.IsUnhealthy(statePersistWarnable) {
+		t.Error("missing key raised the warning")
+	}
+	ctx.err = errFlaky
+	if _, err := s.ReadState("missing"); !errors.Is(err, errKeystoreUnavailable) {
+		t.Errorf("ReadState with keystore down = %v, want errKeystoreUnavailable", err)
+	}
+	if !ht.IsUnhealthy(statePersistWarnable) {
+		t.Error("keystore read failure not reported")
+	}
+}
+
+func TestPrefsStateStoreErrors(t *testing.T) {
+	ctx := newFakePrefsAppContext()
+	s := prefsStateStore{ctx}
+	if err := s.Write("k", []byte{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Read("k"); err != nil || !bytes.Equal(v, []byte{0, 1, 2}) {
+		t.Fatalf("Read = %v, %v; want the written value", v, err)
+	}
+	if v, err := s.Read("missing"); v != nil || err != nil {
+		t.Errorf("Read(missing) = %q, %v; want nil, nil", v, err)
+	}
+
+	// 值损坏与 Keystore 不可用不同，不能让调用方误以为可以重试
+	ctx.prefs["corrupt"] = "!!"
+	if _, err := s.Read("corrupt"); err == nil || errors.Is(err, errKeystoreUnavailable) {
+		t.Errorf("Read(corrupt) = %v, want a non-keystore error", err)
+	}
+	// Keys 只列出 Go 侧的键
+	ctx.prefs[logPrefKey] = "bG9n"
+	if keys, err := s.Keys(); err != nil || !slices.Equal(keys, []string{logPrefKey}) {
+		t.Errorf("Keys = %q, %v; want [%q]", keys, err, logPrefKey)
+	}
+	ctx.keysJSON = "not json"
+	if _, err := s.Keys(); err == nil || errors.Is(err, errKeystoreUnavailable) {
+		t.Errorf("Keys with malformed JSON = %v, want a non-keystore error", err)
+	}
+	ctx.keysJSON = ""
+
+	ctx.err = errFlaky
+	ops := map[string]func() error{
+		"Read":       func() error { _, err := s.Read("k"); return err },
+		"Write":      func() error { return s.Write("k", []byte("v")) },
+		"Delete":     func() error { return s.Delete("k") },
+		"WriteBatch": func() error { return s.WriteBatch(map[string][]byte{"k": nil}) },
+		"Keys":       func() error { _, err := s.Keys(); return err },
+	}
+	for name, op := range ops {
+		if err := op(); !errors.Is(err, errKeystoreUnavailable) {
+			t.Errorf("%s = %v, want errKeystoreUnavailable", name, err)
+		}
+	}
+}
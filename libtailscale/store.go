@@ -1,27 +1,166 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
-// store.go 负责 Tailscale Android 客户端的本地持久化存储，封装与 Android EncryptedSharedPreferences 的交互，支持状态、字符串、布尔值等多种类型安全存取，兼容加密与平台安全特性。
+// store.go 负责 Tailscale Android 客户端的本地持久化存储，在可替换的 StateStore 后端（见 statestore.go）之上，支持状态、字符串、布尔值等多种类型安全存取。
 package libtailscale
 
 import (
-	"encoding/base64" // 用于二进制数据与字符串互转，便于安全存储
+	"errors" // 区分后端不可用与其他错误
+	"fmt"    // 包装迁移错误
+	"log"    // 补齐中断写入失败时记录日志
+	"sync"   // 迁移期间阻塞读写
 
-	"tailscale.com/ipn" // 状态键与错误定义
+	"tailscale.com/health" // 持久化失败时的健康告警
+	"tailscale.com/ipn"    // 状态键与错误定义
 )
 
-// stateStore 封装 Android 侧加密持久化存储接口，负责所有本地状态的安全读写。
-// 设计说明：通过 AppContext 间接调用 Android EncryptedSharedPreferences，保证数据加密与隔离。
+// statePersistWarnable 状态读写失败时设置，下一次写入成功后清除。
+var statePersistWarnable = health.Register(&health.Warnable{
+	Code:     "android-state-persist-failed",
+	Title:    "Unable to save Tailscale state",
+	Severity: health.SeverityHigh,
+	Text: func(args health.Args) string {
+		return "Tailscale could not save its state on this device: " + args[health.ArgError] + ". Recent changes may be lost when the app restarts."
+	},
+})
+
+// stateStore 在 StateStore 后端之上提供类型化读写，负责所有本地状态的存取。
+// 设计说明：后端可在运行时迁移替换（见 migrate），默认为 Android EncryptedSharedPreferences。
 type stateStore struct {
-	// appCtx 是全局 Android 应用上下文，负责实际的存储操作。
-	appCtx AppContext
+	// mu 保护 backend，迁移时持有写锁。
+	mu sync.RWMutex
+	// backend 实际的存储后端。
+	backend StateStore
+	// kind backend 的类型（见 statestore.go），嵌入方自带的后端为空。
+	kind string
+
+	// healthMu 保护 ht 与 lastErr。
+	healthMu sync.Mutex
+	// ht 当前后端的健康状态跟踪器，后端创建前为 nil。
+	ht *health.Tracker
+	// lastErr 最近一次失败的错误，成功写入后清空。
+	lastErr error
+}
+
+// newStateStore 创建 stateStore 实例，注入存储后端及其类型，并补齐上次中断的多键写入。
+// 后端不可用时记录错误，健康状态跟踪器设置后立即显示 statePersistWarnable。
+func newStateStore(backend StateStore, kind string) *stateStore {
+	s := &stateStore{
+		backend: backend,
+		kind:    kind,
+	}
+	if err := replayStateJournal(backend); err != nil {
+		log.Printf("stateStore: replay journal: %v", err)
+		if errors.Is(err, errKeystoreUnavailable) {
+			s.report(err)
+		}
+	}
+	return s
+}
+
+// currentKind 返回当前后端的类型。
+func (s *stateStore) currentKind() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.kind
+}
+
+// setHealthTracker 设置持久化失败告警使用的健康状态跟踪器，由 newBackend 调用。
+// 此前发生的失败会立即反映到 ht 上。
+func (s *stateStore) setHealthTracker(ht *health.Tracker) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	s.ht = ht
+	if s.lastErr != nil {
+		ht.SetUnhealthy(statePersistWarnable, health.Args{health.ArgError: s.lastErr.Error()})
+	}
+}
+
+// report 记录一次读写的结果：失败时设置 statePersistWarnable，之前失败而本次成功时清除。
+func (s *stateStore) report(err error) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	if err == nil && s.lastErr == nil {
+		return
+	}
+	s.lastErr = err
+	if s.ht == nil {
+		return
+	}
+	if err != nil {
+		s.ht.SetUnhealthy(statePersistWarnable, health.Args{health.ArgError: err.Error()})
+	} else {
+		s.ht.SetHealthy(statePersistWarnable)
+	}
+}
+
+// migrate 把全部状态复制到类型为 kind 的 to，调用 commit 记录新后端后切换，最后从原后端删除。
+// 返回迁移的键数量。复制或 commit 失败时继续使用原后端，原后端的状态保持不变。
+func (s *stateStore) migrate(kind string, to StateStore, commit func() error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kind == s.kind {
+		return 0, nil
+	}
+	keys, err := copyState(s.backend, to)
+	if err != nil {
+		return 0, err
+	}
+	if err := commit(); err != nil {
+		return 0, fmt.Errorf("record new store: %w", err)
+	}
+	from := s.backend
+	s.backend, s.kind = to, kind
+	deleteState(from, keys)
+	return len(keys), nil
 }
 
-// newStateStore 创建 stateStore 实例，注入平台上下文。
-func newStateStore(appCtx AppContext) *stateStore {
-	return &stateStore{
-		appCtx: appCtx,
+// dump 返回全部 Go 侧状态的副本，键的范围见 isMigratedKey。
+func (s *stateStore) dump() (map[string][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys, err := s.backend.Keys()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]byte)
+	for _, k := range keys {
+		if !isMigratedKey(k) {
+			continue
+		}
+		v, err := s.backend.Read(k)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			m[k] = v
+		}
 	}
+	return m, nil
+}
+
+// replace 以 state 原子地替换全部 Go 侧状态：写入 state 中的键，并删除不在 state 中的旧键。
+// 读取旧键与写入期间持有写锁，避免其间写入的新键被遗漏。
+func (s *stateStore) replace(state map[string][]byte) error {
+	s.mu.Lock()
+	old, err := s.backend.Keys()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	batch := make(map[string][]byte, len(state)+len(old))
+	for _, k := range old {
+		if isMigratedKey(k) {
+			batch[k] = nil
+		}
+	}
+	for k, v := range state {
+		batch[k] = v
+	}
+	err = writeBatch(s.backend, batch)
+	s.mu.Unlock()
+	s.report(err)
+	return err
 }
 
 // prefKeyFor 生成状态键的持久化前缀，避免与其他存储冲突。
@@ -80,7 +219,7 @@ func (s *stateStore) WriteBool(key string, val bool) error {
 
 // ReadState 读取二进制状态数据，常用于 Tailscale 状态同步。
 // id: 状态键。
-// 返回：二进制数据和错误。
+// 返回：二进制数据和错误；不存在时为 ipn.ErrStateNotExist，后端不可用时错误包装 errKeystoreUnavailable。
 func (s *stateStore) ReadState(id ipn.StateKey) ([]byte, error) {
 	state, err := s.read(prefKeyFor(id))
 	if err != nil {
@@ -93,34 +232,48 @@ func (s *stateStore) ReadState(id ipn.StateKey) ([]byte, error) {
 }
 
 // WriteState 写入二进制状态数据。
+// LocalBackend 切换配置文件时逐键调用，这里只保证单个键的写入是原子的，多个键之间没有事务：
+// 切换中途崩溃可能只留下部分键，由 LocalBackend 下次启动时按已有状态处理。
+// 只有 replace 与迁移等一次性替换全部状态的操作经过 writeBatch 的日志路径。
 // id: 状态键。
-// bs: 待写入的二进制数据。
+// bs: 待写入的二进制数据，为空时删除该键。
 func (s *stateStore) WriteState(id ipn.StateKey, bs []byte) error {
 	prefKey := prefKeyFor(id)
+	if len(bs) == 0 {
+		return s.delete(prefKey)
+	}
 	return s.write(prefKey, bs)
 }
 
-// read 从加密存储读取数据，自动解码 base64。
+// read 从存储后端读取数据，不存在时返回 nil。
 // key: 存储键。
 // 返回：原始二进制数据和错误。
 func (s *stateStore) read(key string) ([]byte, error) {
-	// 调用 Android 侧解密接口，返回 base64 字符串
-	b64, err := s.appCtx.DecryptFromPref(key)
-	if err != nil {
-		return nil, err
-	}
-	if b64 == "" {
-		return nil, nil
+	s.mu.RLock()
+	v, err := s.backend.Read(key)
+	s.mu.RUnlock()
+	if errors.Is(err, errKeystoreUnavailable) {
+		s.report(err)
 	}
-	// 解码 base64，恢复原始数据
-	return base64.RawStdEncoding.DecodeString(b64)
+	return v, err
 }
 
-// write 写入加密存储，自动编码为 base64。
+// write 写入存储后端。
 // key: 存储键。
 // value: 原始二进制数据。
 func (s *stateStore) write(key string, value []byte) error {
-	// 编码为 base64，便于字符串安全存储
-	bs64 := base64.RawStdEncoding.EncodeToString(value)
-	return s.appCtx.EncryptToPref(key, bs64)
+	s.mu.RLock()
+	err := s.backend.Write(key, value)
+	s.mu.RUnlock()
+	s.report(err)
+	return err
+}
+
+// delete 从存储后端删除 key。
+func (s *stateStore) delete(key string) error {
+	s.mu.RLock()
+	err := s.backend.Delete(key)
+	s.mu.RUnlock()
+	s.report(err)
+	return err
 }
@@ -0,0 +1,195 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// supervisor.go 监督后端运行：捕获 runBackendOnce 的错误与 panic，持久化崩溃原因，并以指数退避自动重启。
+// 后端协程（multiTUN、日志转发、网络变化处理等）中的 panic 经 reportPanic 转交给 runBackendOnce，同样走这条路径。
+package libtailscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"tailscale.com/util/clientmetric"
+)
+
+// metricBackendCrashes runBackendOnce 出错或 panic 的次数。
+var metricBackendCrashes = clientmetric.NewCounter("android_backend_crashes")
+
+const (
+	// crashHistoryPrefKey 崩溃历史在 stateStore 中的键。
+	crashHistoryPrefKey = "crashhistory"
+	// crashHistoryLimit 最多保留的崩溃记录条数，超出时丢弃最旧的记录。
+	crashHistoryLimit = 20
+
+	// restartBackoffMin 与 restartBackoffMax 为自动重启的退避区间，每次连续崩溃退避时间翻倍。
+	restartBackoffMin = time.Second
+	restartBackoffMax = 5 * time.Minute
+	// restartBackoffReset 后端连续运行超过该时长后，认为已恢复稳定，退避时间重置。
+	restartBackoffReset = 5 * time.Minute
+
+	// crashHistoryEndpoint 查询（GET）或清空（DELETE）崩溃历史的 LocalAPI 路径。
+	crashHistoryEndpoint = "/localapi/v0/android/crash-history"
+)
+
+// crashRecord 一次后端崩溃的记录。
+type crashRecord struct {
+	Time    time.Time     // 崩溃时间
+	Reason  string        // 错误信息或 panic 值
+	Panic   bool          `json:",omitempty"` // 是否由 panic 引起
+	Stack   string        `json:",omitempty"` // panic 时的堆栈
+	Uptime  time.Duration // 本次运行持续的时长
+	Backoff time.Duration // 重启前的等待时长
+}
+
+// crashHistory 维护崩溃记录并持久化到 stateStore，进程重启后仍可查询。
+type crashHistory struct {
+	store *stateStore
+
+	mu      sync.Mutex
+	records []crashRecord // 按时间先后排列
+}
+
+// newCrashHistory 创建 crashHistory 并从 stateStore 加载已有记录，加载失败时从空记录开始。
+func newCrashHistory(store *stateStore) *crashHistory {
+	h := &crashHistory{store: store}
+	data, err := store.read(crashHistoryPrefKey)
+	if err != nil {
+		log.Printf("crashHistory: read: %v", err)
+		return h
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &h.records); err != nil {
+			log.Printf("crashHistory: decode: %v", err)
+			h.records = nil
+		}
+	}
+	return h
+}
+
+// add 追加一条记录并持久化。
+func (h *crashHistory) add(r crashRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	if n := len(h.records) - crashHistoryLimit; n > 0 {
+		h.records = append(h.records[:0], h.records[n:]...)
+	}
+	h.saveLocked()
+}
+
+// clear 清空所有记录。
+func (h *crashHistory) clear() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = nil
+	h.saveLocked()
+}
+
+// list 返回记录副本，按时间先后排列。
+func (h *crashHistory) list() []crashRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]crashRecord{}, h.records...)
+}
+
+// saveLocked 将记录写入 stateStore，调用方需持有 h.mu。
+func (h *crashHistory) saveLocked() {
+	data, err := json.Marshal(h.records)
+	if err != nil {
+		log.Printf("crashHistory: encode: %v", err)
+		return
+	}
+	if err := h.store.write(crashHistoryPrefKey, data); err != nil {
+		log.Printf("crashHistory: write: %v", err)
+	}
+}
+
+// ServeHTTP 处理 crashHistoryEndpoint：GET 返回 JSON 数组，DELETE 清空记录。
+func (h *crashHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.list())
+	case http.MethodDelete:
+		h.clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// runSupervised 运行一次 runBackendOnce，把 panic 转换为错误，避免整个进程退出。
+// 若发生 panic，stack 为其堆栈。
+func (a *App) runSupervised(ctx context.Context) (stack string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			stack = string(debug.Stack())
+			log.Printf("panic in runBackendOnce %v: %s", p, stack)
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	err = a.runBackendOnce(ctx)
+	var pe *goroutinePanicError
+	if errors.As(err, &pe) {
+		return pe.stack, err
+	}
+	return "", err
+}
+
+// goroutinePanicError 后端协程中的 panic，由 reportPanic 生成。
+type goroutinePanicError struct {
+	where string    // 发生 panic 的协程
+	value any       // panic 值
+	stack string    // panic 时的堆栈
+	at    time.Time // 发生时间
+}
+
+func (e *goroutinePanicError) Error() string {
+	return fmt.Sprintf("panic in %s: %v", e.where, e.value)
+}
+
+// backendPanicEvent 后端协程发生 panic，runBackendOnce 收到后返回 err，由 runBackend 记录崩溃并退避重启。
+type backendPanicEvent struct{ err *goroutinePanicError }
+
+// reportPanic 把协程中 recover 得到的 panic 交给当前 App 的 supervisor，代替原先的重新 panic，避免整个进程退出。
+// where 为协程名，p 为 recover 的返回值；须在 defer 的函数中调用，以便取得 panic 处的堆栈。
+// App 未启动时只记录日志。返回对应的错误。
+func reportPanic(where string, p any) error {
+	err := &goroutinePanicError{where: where, value: p, stack: string(debug.Stack()), at: time.Now()}
+	log.Printf("%v: %s", err, err.stack)
+	publishBackendEvent(backendPanicEvent{err})
+	return err
+}
+
+// handleBackendPanic 处理 backendPanicEvent，返回非 nil 时 runBackendOnce 应返回该错误。
+// started 为本次 runBackendOnce 的开始时间：之前的 panic 来自已拆除的后端，只记入崩溃历史，不再重启。
+func (a *App) handleBackendPanic(ev backendPanicEvent, started time.Time) error {
+	if !ev.err.at.Before(started) {
+		return ev.err
+	}
+	log.Printf("runBackendOnce: %v from a previous backend, not restarting", ev.err)
+	a.crashes.add(crashRecord{
+		Time:   ev.err.at,
+		Reason: ev.err.Error(),
+		Panic:  true,
+		Stack:  ev.err.stack,
+	})
+	metricBackendCrashes.Add(1)
+	return nil
+}
+
+// nextBackoff 返回下一次重启前的等待时长。
+// prev 为上一次的退避时长，uptime 为刚结束的这次运行持续的时长。
+func nextBackoff(prev, uptime time.Duration) time.Duration {
+	if prev == 0 || uptime >= restartBackoffReset {
+		return restartBackoffMin
+	}
+	return min(prev*2, restartBackoffMax)
+}
@@ -8,19 +8,30 @@ package libtailscale
 import (
 	"encoding/json" // 用于解析策略数组类型
 	"errors"        // 错误处理
+	"fmt"           // 包装数值策略错误
+	"strings"       // 识别 Android 侧的整数转换错误
 	"sync"          // 读写锁，保证回调并发安全
 
-	"tailscale.com/util/set"       // 回调句柄集合
-	"tailscale.com/util/syspolicy" // 策略接口与错误定义
+	"tailscale.com/util/set"               // 回调句柄集合
+	"tailscale.com/util/syspolicy"         // 策略接口与错误定义
+	"tailscale.com/util/syspolicy/setting" // 策略值类型，用于校验
+)
+
+var (
+	// errPolicyNotNumber 数值策略配置的值不是整数。Android 侧 NotAnIntegerException 的信息以同样的文本开头。
+	errPolicyNotNumber = errors.New("policy value is not an integer")
+	// errPolicyNegative 数值策略配置了负数。
+	errPolicyNegative = errors.New("policy value is negative")
 )
 
 // syspolicyHandler 是 Android 版 Tailscale 的系统策略处理器，
 // 支持通过 Android RestrictionsManager 读取企业/设备策略，
 // 并为主网络模块提供统一的策略读取接口。
 type syspolicyHandler struct {
-	a   *App                  // 应用实例，便于访问 appCtx
-	mu  sync.RWMutex          // 读写锁，保护回调集合
-	cbs set.HandleSet[func()] // 策略变更回调集合，支持多回调并发注册
+	a    *App                  // 应用实例，便于访问 appCtx
+	mu   sync.RWMutex          // 读写锁，保护回调集合
+	cbs  set.HandleSet[func()] // 策略变更回调集合，支持多回调并发注册
+	diag policyDiagnostics     // 策略读取的校验结果，见 policydiag.go
 }
 
 // ReadString 读取字符串类型的策略值。
@@ -31,7 +42,9 @@ func (h *syspolicyHandler) ReadString(key string) (string, error) {
 		return "", syspolicy.ErrNoSuchKey
 	}
 	retVal, err := h.a.appCtx.GetSyspolicyStringValue(key)
-	return retVal, translateHandlerError(err)
+	err = translateHandlerError(err)
+	h.validate(key, setting.StringValue, retVal, err)
+	return retVal, err
 }
 
 // ReadBoolean 读取布尔类型的策略值。
@@ -42,17 +55,29 @@ func (h *syspolicyHandler) ReadBoolean(key string) (bool, error) {
 		return false, syspolicy.ErrNoSuchKey
 	}
 	retVal, err := h.a.appCtx.GetSyspolicyBooleanValue(key)
-	return retVal, translateHandlerError(err)
+	err = translateHandlerError(err)
+	h.validate(key, setting.BooleanValue, "", err)
+	return retVal, err
 }
 
 // ReadUInt64 读取 uint64 类型的策略值。
-// 目前 Android 端未实现，直接返回错误。
+// key: 策略键。
+// 返回：策略值和错误；值不是整数时返回 errPolicyNotNumber，为负数时返回 errPolicyNegative，
+// 其他读取失败原样返回。
 func (h *syspolicyHandler) ReadUInt64(key string) (uint64, error) {
 	if key == "" {
 		return 0, syspolicy.ErrNoSuchKey
 	}
-	// 目前无 uint64 策略，返回未实现错误
-	return 0, errors.New("ReadUInt64 is not implemented on Android")
+	retVal, err := h.a.appCtx.GetSyspolicyIntegerValue(key)
+	err = translateIntegerError(translateHandlerError(err))
+	if err == nil && retVal < 0 {
+		err = fmt.Errorf("%w: %d", errPolicyNegative, retVal)
+	}
+	h.validate(key, setting.IntegerValue, "", err)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(retVal), nil
 }
 
 // ReadStringArray 读取字符串数组类型的策略值，支持 JSON 解码。
@@ -64,13 +89,16 @@ func (h *syspolicyHandler) ReadStringArray(key string) ([]string, error) {
 	}
 	retVal, err := h.a.appCtx.GetSyspolicyStringArrayJSONValue(key)
 	if err := translateHandlerError(err); err != nil {
+		h.validate(key, setting.StringListValue, "", err)
 		return nil, err
 	}
 	if retVal == "" {
+		h.validate(key, setting.StringListValue, "", syspolicy.ErrNoSuchKey)
 		return nil, syspolicy.ErrNoSuchKey
 	}
 	var arr []string
 	jsonErr := json.Unmarshal([]byte(retVal), &arr)
+	h.validate(key, setting.StringListValue, "", jsonErr)
 	if jsonErr != nil {
 		return nil, jsonErr
 	}
@@ -93,6 +121,8 @@ func (h *syspolicyHandler) RegisterChangeCallback(cb func()) (unregister func(),
 
 // notifyChanged 通知所有已注册回调，异步触发，避免阻塞主线程。
 func (h *syspolicyHandler) notifyChanged() {
+	// 之前的校验结果可能已失效，由回调中的重新读取重新校验
+	h.diag.reset()
 	h.mu.RLock()
 	for _, cb := range h.cbs {
 		go cb()
@@ -107,3 +137,15 @@ func translateHandlerError(err error) error {
 	}
 	return err // may be nil or non-nil
 }
+
+// translateIntegerError 把 Android 侧的 NotAnIntegerException 转换为 errPolicyNotNumber，按错误信息识别。
+// 存储读取失败等其他错误原样返回，不当作类型不符。
+func translateIntegerError(err error) error {
+	if err == nil || errors.Is(err, errPolicyNotNumber) {
+		return err
+	}
+	if _, detail, ok := strings.Cut(err.Error(), errPolicyNotNumber.Error()); ok {
+		return fmt.Errorf("%w%s", errPolicyNotNumber, detail)
+	}
+	return err
+}
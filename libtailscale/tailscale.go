@@ -9,8 +9,7 @@ import (
 	"log"           // 标准日志库，部分日志会重定向到远程
 	"net/http"      // 远程日志上传使用 HTTP 协议
 	"path/filepath" // 日志文件路径拼接
-	"runtime/debug" // panic 时打印堆栈
-	"time"          // 日志刷新、定时任务
+	"sync"          // ready 事件只生效一次
 
 	"tailscale.com/health"            // 健康状态跟踪
 	"tailscale.com/logpolicy"         // 日志策略配置
@@ -37,41 +36,61 @@ const (
 // dataDir: 应用数据目录，存储本地状态。
 // directFileRoot: 直连文件根目录。
 // appCtx: 平台相关上下文，封装 Android 侧接口。
+// store: 状态存储后端。
+// storeKind: store 的类型（见 statestore.go），嵌入方自带的后端为空。
 // 返回 Application 接口实例。
-func newApp(dataDir, directFileRoot string, appCtx AppContext) Application {
+func newApp(dataDir, directFileRoot string, appCtx AppContext, store StateStore, storeKind string) Application {
 	// 构造 App 结构体，初始化关键字段。
+	ctx, cancel := context.WithCancel(context.Background())
 	a := &App{
 		directFileRoot:   directFileRoot,         // 文件根目录
 		dataDir:          dataDir,                // 数据目录
 		appCtx:           appCtx,                 // 平台上下文
 		backendRestartCh: make(chan struct{}, 1), // 后端重启信号通道
+		events:           newAppEvents(),         // Java 回调事件分发器
+		ctx:              ctx,                    // App 生命周期上下文
+		cancel:           cancel,                 // Shutdown 时取消
+		runDone:          make(chan struct{}),    // runBackend 退出通知
 	}
 	// ready 用于同步后端和前端初始化，Add(2) 表示需等待两个事件。
 	a.ready.Add(2)
-
-	// 初始化状态存储，封装 Android 侧持久化。
-	a.store = newStateStore(a.appCtx)
+	a.backendReady = sync.OnceFunc(a.ready.Done)
+	a.startReady = sync.OnceFunc(a.ready.Done)
+
+	// 初始化状态存储，后端见 statestore.go。
+	a.store = newStateStore(store, storeKind)
+	// 加载崩溃历史，supervisor 重启后端时追加记录。
+	a.crashes = newCrashHistory(a.store)
+	// 锁定状态、VPN 会话状态与网络状态变化时唤醒通知订阅者
+	a.lockdown = newLockdownState(a.wakeWatchers)
+	a.vpn = newVPNSession(a.wakeWatchers)
+	a.network = newNetworkState(a.wakeWatchers)
 	// 注册系统策略处理器，适配企业策略。
 	a.policyStore = &syspolicyHandler{a: a}
 	// 注册网络接口获取器，便于 netmon 监控网络变化。
 	netmon.RegisterInterfaceGetter(a.getInterfaces)
 	// 注册系统策略处理器到全局。
 	syspolicy.RegisterHandler(a.policyStore)
+	// 之后 Java 侧的包级回调都会发布到该 App 的事件分发器。
+	setCurrentApp(a)
 	// 启动文件操作变更监听，便于同步文件状态。
 	go a.watchFileOpsChanges()
 
-	// 启动后端主循环，负责核心业务逻辑。
+	// 启动后端主循环，负责核心业务逻辑，Shutdown 取消 ctx 后退出。
 	go func() {
+		defer close(a.runDone)
+		// runBackendOnce 的 panic 已由 runSupervised 处理，这里兜住 supervisor 自身的 panic，
+		// 记为 runErr 后退出，不让整个进程崩溃；须在 close(a.runDone) 之前写入 runErr。
 		defer func() {
 			if p := recover(); p != nil {
-				log.Printf("panic in runBackend %s: %s", p, debug.Stack())
-				panic(p)
+				a.runErr = reportPanic("runBackend", p)
+				fatalErr(a.runErr)
 			}
 		}()
 
-		ctx := context.Background()
-		if err := a.runBackend(ctx); err != nil {
-			fatalErr(err)
+		a.runErr = a.runBackend(ctx)
+		if a.runErr != nil && ctx.Err() == nil {
+			fatalErr(a.runErr)
 		}
 	}()
 
@@ -139,7 +158,8 @@ func (b *backend) setupLogs(logDir string, logID logid.PrivateID, logf logger.Lo
 		CompressLogs:        true,
 	}
 	// 日志刷新延迟，2 分钟批量上传，兼顾实时性与流量消耗。
-	logcfg.FlushDelayFn = func() time.Duration { return 2 * time.Minute }
+	// 按流量计费的网络下延长间隔，见 netpolicy.go。
+	logcfg.FlushDelayFn = b.logFlushDelay
 
 	// 配置本地日志缓冲，filch 支持断网时日志持久化。
 	filchOpts := filch.Options{
@@ -168,18 +188,18 @@ func (b *backend) setupLogs(logDir string, logID logid.PrivateID, logf logger.Lo
 		log.Printf("SetupLogs: filch setup failed: %v", filchErr)
 	}
 
-	// 启动日志通道监听，onLog 为全局日志通道。
+	// 启动 Android 侧日志监听。
 	go func() {
 		for {
 			select {
-			case logstr := <-onLog:
-				b.logger.Logf(logstr)
+			case logstr, ok := <-b.events.logs.C():
+				if !ok {
+					return
+				}
+				b.logger.Logf("%s", logstr)
+			case <-b.done:
+				return
 			}
 		}
 	}()
 }
-
-// Close 关闭 App，当前无端口转发相关逻辑，预留接口。
-func (a *App) Close() {
-	// 已无端口转发相关逻辑
-}
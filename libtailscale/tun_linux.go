@@ -0,0 +1,27 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux && !android
+
+// tun_linux.go 在没有 VpnService 的 Linux 上通过 /dev/net/tun 创建 TUN，供测试环境（如网络命名空间）使用。
+package libtailscale
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+// OpenLinuxTUN 通过 /dev/net/tun 创建名为 name 的 TUN 设备，返回值可直接交给 App.AttachTUN。
+// 地址与路由须由调用方另行配置（如 ip addr/ip route），addrs、routes 仅用于覆盖检查。
+func OpenLinuxTUN(name string, mtu int, addrs, routes []netip.Prefix) (*ExternalTUN, error) {
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
+	dev, err := tun.CreateTUN(name, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("OpenLinuxTUN: %w", err)
+	}
+	return &ExternalTUN{Device: dev, MTU: mtu, Addrs: addrs, Routes: routes}, nil
+}
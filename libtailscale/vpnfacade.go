@@ -27,14 +27,13 @@ type VPNFacade struct {
 	// 若为 nil，GetBaseConfig 返回不支持错误。
 	GetBaseConfigFunc func() (dns.OSConfig, error)
 
-	// InitialMTU 指定 TUN 设备初始化时的 MTU，0 表示使用默认值。
-	// 仅在 TUN 创建后首次生效，后续忽略。
+	// InitialMTU 指定 TUN 设备的 MTU，0 表示由 updateTUN 自行选择（见 tunMTU）。
+	// 非 0 时注入每一份未指定 NewMTU 的路由配置，保证重建 TUN 时 MTU 一致。
 	InitialMTU uint32
 
-	mu        sync.Mutex     // 保护以下所有字段，保证多线程安全
-	didSetMTU bool           // 是否已设置过 MTU，防止重复下发
-	rcfg      *router.Config // 最近一次下发的路由配置
-	dcfg      *dns.OSConfig  // 最近一次下发的 DNS 配置
+	mu   sync.Mutex     // 保护以下所有字段，保证多线程安全
+	rcfg *router.Config // 最近一次下发的路由配置
+	dcfg *dns.OSConfig  // 最近一次下发的 DNS 配置
 }
 
 // Up 实现 wgengine.Router 接口，Android 平台无需额外初始化，直接返回 nil。
@@ -42,20 +41,19 @@ func (vf *VPNFacade) Up() error {
 	return nil // TODO: 检查所有调用方是否确实无需初始化
 }
 
-// Set 实现 wgengine.Router 接口，设置路由配置，支持 MTU 首次下发。
+// Set 实现 wgengine.Router 接口，设置路由配置，并注入 InitialMTU。
 // rcfg: 路由配置。
 func (vf *VPNFacade) Set(rcfg *router.Config) error {
 	vf.mu.Lock()
 	defer vf.mu.Unlock()
+	// 下发 MTU，须在比较之前注入，否则每次都会被视为配置变化
+	if rcfg != nil && rcfg.NewMTU == 0 {
+		rcfg.NewMTU = int(vf.InitialMTU)
+	}
 	// 若配置未变，直接返回，避免重复下发
 	if vf.rcfg.Equal(rcfg) {
 		return nil
 	}
-	// 首次设置时下发 MTU
-	if vf.didSetMTU == false {
-		vf.didSetMTU = true
-		rcfg.NewMTU = int(vf.InitialMTU)
-	}
 	vf.rcfg = rcfg
 	return nil
 }
@@ -78,9 +76,10 @@ func (vf *VPNFacade) SetDNS(dcfg dns.OSConfig) error {
 	return nil
 }
 
-// SupportsSplitDNS 实现 dns.OSConfigurator 接口，Android 端不支持 Split DNS，返回 false。
+// SupportsSplitDNS 实现 dns.OSConfigurator 接口。
+// Android 通过解析器的 SERVFAIL 回退实现 Split DNS，见 splitdns.go。
 func (vf *VPNFacade) SupportsSplitDNS() bool {
-	return false
+	return true
 }
 
 // GetBaseConfig 实现 dns.OSConfigurator 接口，返回当前 DNS 配置。
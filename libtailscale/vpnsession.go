@@ -0,0 +1,215 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// vpnsession.go 管理 App 持有的 VPN 会话：Android 侧 IPNService、当前 TUN 的 fd 归属以及会话状态。
+// 会话跟随 App 存在，后端重启时保留，新后端据此重新建立 TUN。
+package libtailscale
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// vpnState VPN 会话状态。
+type vpnState int
+
+const (
+	vpnIdle         vpnState = iota // 未建立 TUN（可能已有 IPNService）
+	vpnEstablishing                 // 正在通过 VpnService.Builder 建立 TUN
+	vpnUp                           // TUN 已建立并交给 multiTUN
+	vpnRevoked                      // VPN 被系统或用户撤销，需等待新的 IPNService
+	vpnError                        // 建立 TUN 失败
+)
+
+// String 返回状态名，用于日志与通知。
+func (s vpnState) String() string {
+	switch s {
+	case vpnIdle:
+		return "idle"
+	case vpnEstablishing:
+		return "establishing"
+	case vpnUp:
+		return "up"
+	case vpnRevoked:
+		return "revoked"
+	case vpnError:
+		return "error"
+	}
+	return fmt.Sprintf("vpnState(%d)", int(s))
+}
+
+// vpnTransitions 允许的状态迁移，其余迁移被拒绝并记录日志。
+var vpnTransitions = map[vpnState][]vpnState{
+	vpnIdle:         {vpnEstablishing, vpnRevoked},
+	vpnEstablishing: {vpnUp, vpnError, vpnRevoked, vpnIdle},
+	vpnUp:           {vpnEstablishing, vpnIdle, vpnRevoked, vpnError},
+	vpnRevoked:      {vpnIdle},
+	vpnError:        {vpnEstablishing, vpnIdle, vpnRevoked},
+}
+
+// vpnStatus VPN 会话状态，通过通知的 VPN 字段下发给 Android 侧。
+type vpnStatus struct {
+	State string
+	Error string `json:",omitempty"` // 进入 error 或 revoked 状态的原因
+}
+
+// vpnSession 由 App 持有的 VPN 会话，所有字段由 mu 保护。
+type vpnSession struct {
+	mu      sync.Mutex
+	service IPNService // Android 侧服务实例，未连接时为 nil
+	state   vpnState
+	err     error // 最近一次失败原因，仅 error/revoked 状态有效
+	// fd 已从 ParcelFileDescriptor 分离、尚未交给 tun.Device 的 fd，-1 表示没有。
+	// 交给 tun.Device 后由设备负责关闭，会话不再持有。
+	fd int32
+	// changed 状态变化时调用，用于唤醒通知订阅者。
+	changed func()
+}
+
+// newVPNSession 创建空闲的 VPN 会话，changed 可为 nil。
+func newVPNSession(changed func()) *vpnSession {
+	return &vpnSession{fd: -1, changed: changed}
+}
+
+// currentService 返回当前 IPNService，未连接时为 nil。
+func (s *vpnSession) currentService() IPNService {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.service
+}
+
+// status 返回当前状态。
+func (s *vpnSession) status() vpnStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := vpnStatus{State: s.state.String()}
+	if s.err != nil {
+		st.Error = s.err.Error()
+	}
+	return st
+}
+
+// setState 迁移到 to 状态，err 为 error/revoked 状态的原因。
+// 与当前状态相同时只更新原因；不允许的迁移返回错误且不改变状态。
+func (s *vpnSession) setState(to vpnState, err error) error {
+	s.mu.Lock()
+	changed, terr := s.setStateLocked(to, err)
+	notify := s.changed
+	s.mu.Unlock()
+	if changed && notify != nil {
+		notify()
+	}
+	return terr
+}
+
+// setStateLocked 是 setState 的加锁版本，返回状态是否变化。调用方需持有 s.mu。
+func (s *vpnSession) setStateLocked(to vpnState, err error) (bool, error) {
+	from := s.state
+	if to != vpnError && to != vpnRevoked {
+		err = nil
+	}
+	if from == to {
+		changed := fmt.Sprint(s.err) != fmt.Sprint(err)
+		s.err = err
+		return changed, nil
+	}
+	if !slices.Contains(vpnTransitions[from], to) {
+		terr := fmt.Errorf("vpn session: invalid transition %v -> %v", from, to)
+		log.Print(terr)
+		return false, terr
+	}
+	log.Printf("vpn session: %v -> %v (err=%v)", from, to, err)
+	s.state = to
+	s.err = err
+	return true, nil
+}
+
+// attach 记录新的 IPNService 并回到 idle 状态。service 与当前相同时返回 false。
+func (s *vpnSession) attach(service IPNService) bool {
+	s.mu.Lock()
+	if s.service != nil && s.service.ID() == service.ID() {
+		s.mu.Unlock()
+		return false
+	}
+	s.service = service
+	changed, _ := s.setStateLocked(vpnIdle, nil)
+	notify := s.changed
+	s.mu.Unlock()
+	if changed && notify != nil {
+		notify()
+	}
+	return true
+}
+
+// detach 在 service 为当前 IPNService 时解除关联，已建立或正在建立 TUN 时进入 revoked 状态。
+// 返回 service 是否为当前 IPNService。
+func (s *vpnSession) detach(service IPNService) bool {
+	s.mu.Lock()
+	if s.service == nil || s.service.ID() != service.ID() {
+		s.mu.Unlock()
+		return false
+	}
+	s.service = nil
+	changed := false
+	if s.state != vpnIdle {
+		changed, _ = s.setStateLocked(vpnRevoked, errors.New("VPN service disconnected"))
+	}
+	notify := s.changed
+	s.mu.Unlock()
+	if changed && notify != nil {
+		notify()
+	}
+	return true
+}
+
+// disconnect 因 err 主动断开 VPN：进入 error 状态（已被撤销时保持 revoked）并要求 Android 侧停止 VpnService。
+func (s *vpnSession) disconnect(err error) {
+	s.mu.Lock()
+	service := s.service
+	s.service = nil
+	changed := false
+	if s.state != vpnRevoked {
+		changed, _ = s.setStateLocked(vpnError, err)
+	}
+	notify := s.changed
+	s.mu.Unlock()
+	if changed && notify != nil {
+		notify()
+	}
+	if service != nil {
+		service.DisconnectVPN()
+	}
+}
+
+// setFD 记录刚从 ParcelFileDescriptor 分离的 fd，会话负责在交给 tun.Device 之前关闭它。
+func (s *vpnSession) setFD(fd int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fd = fd
+}
+
+// releaseFD 表示 fd 已交给 tun.Device，会话不再负责关闭。
+func (s *vpnSession) releaseFD() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fd = -1
+}
+
+// closeFD 关闭会话持有的 fd，没有持有时返回 nil。
+func (s *vpnSession) closeFD() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fd == -1 {
+		return nil
+	}
+	err := syscall.Close(int(s.fd))
+	s.fd = -1
+	if err != nil {
+		return fmt.Errorf("error closing file descriptor: %w", err)
+	}
+	return nil
+}